@@ -1,25 +1,37 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
 	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/Shopify/sarama"
 	"github.com/nais/liberator/pkg/conftools"
 	"github.com/nais/liberator/pkg/tlsutil"
+	"github.com/navikt/deployment-event-relays/pkg/admin"
 	"github.com/navikt/deployment-event-relays/pkg/config"
 	"github.com/navikt/deployment-event-relays/pkg/deployment"
-	"github.com/navikt/deployment-event-relays/pkg/influx"
+	"github.com/navikt/deployment-event-relays/pkg/filter"
+	"github.com/navikt/deployment-event-relays/pkg/health"
 	"github.com/navikt/deployment-event-relays/pkg/kafka/consumer"
+	"github.com/navikt/deployment-event-relays/pkg/kafka/deadletter"
 	"github.com/navikt/deployment-event-relays/pkg/logging"
 	"github.com/navikt/deployment-event-relays/pkg/metrics"
-	"github.com/navikt/deployment-event-relays/pkg/nora"
-	"github.com/navikt/deployment-event-relays/pkg/null"
-	"github.com/navikt/deployment-event-relays/pkg/vera"
+	"github.com/navikt/deployment-event-relays/pkg/outcome"
+	"github.com/navikt/deployment-event-relays/pkg/relay"
+	"github.com/navikt/deployment-event-relays/pkg/secret"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	sarama_metrics "github.com/rcrowley/go-metrics"
 	log "github.com/sirupsen/logrus"
@@ -28,54 +40,213 @@ import (
 	"google.golang.org/protobuf/types/known/anypb"
 )
 
-type Processor interface {
-	Process(event *deployment.Event) (retry bool, err error)
+// BatchProcessor is implemented by relays that deliver events asynchronously in batches.
+// The done function is called with the result once the event has been delivered.
+type BatchProcessor interface {
+	Enqueue(ctx context.Context, event *deployment.Event, done func(err error)) error
 }
 
-func kafkaConfig(cfg *config.Config, subsystem string, callback consumer.Callback) (*consumer.Config, error) {
-	tlsConfig, err := tlsutil.TLSConfigFromFiles(
+// closeFunc releases a resource on shutdown.
+type closeFunc func(ctx context.Context) error
+
+// consumerGroup is a running Kafka consumer, either of a single subsystem or shared by all subsystems in fan-out mode.
+type consumerGroup interface {
+	Close(ctx context.Context) error
+}
+
+// subsystem is a relay together with the settings used to consume events on its behalf.
+type subsystem struct {
+	processor       relay.Processor
+	deadLetterTopic string
+	retry           config.Retry
+	timeout         time.Duration
+	filters         []config.Filter
+	// dryRun means that the processor only builds payloads, and reports them with a relay.DryRunError.
+	dryRun bool
+	// groupSuffix is appended to the consumer group ID prefix. Defaults to the subsystem name.
+	groupSuffix string
+	// closer releases resources held by the processor, if any.
+	closer closeFunc
+}
+
+func tlsConfig(cfg *config.Config) (*tls.Config, error) {
+	return tlsutil.TLSConfigFromFiles(
 		cfg.Kafka.TLS.CertificatePath,
 		cfg.Kafka.TLS.PrivateKeyPath,
 		cfg.Kafka.TLS.CAPath,
 	)
+}
+
+func retryPolicy(retry config.Retry) consumer.RetryPolicy {
+	return consumer.RetryPolicy{
+		MaxAttempts:    retry.MaxAttempts,
+		InitialBackoff: retry.InitialBackoff,
+		MaxBackoff:     retry.MaxBackoff,
+		Multiplier:     retry.Multiplier,
+		Jitter:         retry.Jitter,
+		Fallback:       consumer.Fallback(retry.Fallback),
+	}
+}
+
+func kafkaConfig(cfg *config.Config, groupSuffix string, subscriber consumer.Subscriber) (*consumer.Config, error) {
+	tlsConfig, err := tlsConfig(cfg)
 	if err != nil {
 		return nil, err
 	}
 	return &consumer.Config{
 		Brokers:           cfg.Kafka.Brokers,
-		Callback:          callback,
-		GroupID:           cfg.Kafka.GroupIDPrefix + "/" + subsystem,
+		Callback:          subscriber.Callback,
+		DeadLetter:        subscriber.DeadLetter,
+		Decode:            decodeMessage,
+		GroupID:           cfg.Kafka.GroupIDPrefix + "/" + groupSuffix,
+		Key:               orderingKey,
 		MaxProcessingTime: time.Second * 3,
 		Logger:            log.StandardLogger(),
-		RetryInterval:     time.Second * 30,
+		Retry:             subscriber.Retry,
+		Subsystem:         subscriber.Subsystem,
+		Timeout:           subscriber.Timeout,
 		TlsConfig:         tlsConfig,
 		Topic:             cfg.Kafka.Topic,
+		Workers:           cfg.Kafka.Workers,
 	}, nil
 }
 
+// fanOutConfig configures the fan-out consumer. The shared group continues from the given per-subsystem groups.
+func fanOutConfig(cfg *config.Config, subscribers []consumer.Subscriber, seedGroupSuffixes []string) (*consumer.FanOutConfig, error) {
+	tlsConfig, err := tlsConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	seedGroupIDs := make([]string, 0, len(seedGroupSuffixes))
+	for _, suffix := range seedGroupSuffixes {
+		seedGroupIDs = append(seedGroupIDs, cfg.Kafka.GroupIDPrefix+"/"+suffix)
+	}
+	return &consumer.FanOutConfig{
+		Brokers:           cfg.Kafka.Brokers,
+		Decode:            decodeMessage,
+		GroupID:           cfg.Kafka.GroupIDPrefix + "/" + cfg.Kafka.FanOut.GroupSuffix,
+		Key:               orderingKey,
+		MaxProcessingTime: time.Second * 3,
+		Logger:            log.StandardLogger(),
+		QueueSize:         cfg.Kafka.FanOut.QueueSize,
+		SeedGroupIDs:      seedGroupIDs,
+		Subscribers:       subscribers,
+		TlsConfig:         tlsConfig,
+		Topic:             cfg.Kafka.Topic,
+		Workers:           cfg.Kafka.Workers,
+	}, nil
+}
+
+// decodeMessage parses a Kafka message into a deployment event. Messages of unknown types are dropped by the consumer.
+func decodeMessage(message *sarama.ConsumerMessage) (interface{}, error) {
+	event := &deployment.Event{}
+	any := &anypb.Any{}
+	err := proto.Unmarshal(message.Value, any)
+	if err == nil {
+		err = any.UnmarshalTo(event)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return event, nil
+}
+
+// orderingKey makes sure that events for the same application are processed in order.
+func orderingKey(_ *sarama.ConsumerMessage, decoded interface{}) string {
+	event, _ := decoded.(*deployment.Event)
+	return event.OrderingKey()
+}
+
+func deadLetterProducer(cfg *config.Config, subsystem, topic string) (*deadletter.Producer, error) {
+	tlsConfig, err := tlsConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return deadletter.New(deadletter.Config{
+		Brokers:   cfg.Kafka.Brokers,
+		Subsystem: subsystem,
+		TlsConfig: tlsConfig,
+		Topic:     topic,
+	})
+}
+
 func main() {
-	err := run()
+	var err error
+	if len(os.Args) > 1 && os.Args[1] == replayCommand {
+		err = replay()
+	} else {
+		err = run()
+	}
 	if err != nil {
 		log.Error(err)
 		os.Exit(1)
 	}
 }
 
-func run() error {
+// loadConfig reads and validates the configuration from flags, environment and configuration file,
+// and sets up logging accordingly. If --print-config is given, the configuration is printed
+// and the caller is expected to exit.
+//
+// The configuration flags are parsed from args with the given flag set. A flag set other than pflag.CommandLine,
+// such as that of a subcommand, gets the configuration flags added to its own.
+func loadConfig(flags *pflag.FlagSet, args []string) (*config.Config, error) {
 	cfg := config.DefaultConfig()
 	config.BindFlags(cfg)
 
+	relay.BindFlags(cfg)
+
+	if flags != pflag.CommandLine {
+		flags.AddFlagSet(pflag.CommandLine)
+	}
+	err := flags.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+
 	conftools.Initialize("DER")
 	config.BindNAIS()
-	err := conftools.Load(cfg)
+	err = config.Load(cfg)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	pflag.Parse()
+	err = relay.Decode(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("parse configuration: %w", err)
+	}
+
+	config.ApplyDefaults(cfg)
+
+	if cfg.PrintConfig {
+		err = config.Print(os.Stdout, cfg)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = config.Validate(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("invalid configuration:\n%w", err)
+	}
+
+	if cfg.PrintConfig {
+		return cfg, nil
+	}
 
 	err = logging.Apply(log.StandardLogger(), cfg.Log.Verbosity, cfg.Log.Format)
 	if err != nil {
+		return nil, err
+	}
+
+	config.RegisterSecrets(cfg)
+	secret.RedactLogs(log.StandardLogger())
+
+	return cfg, nil
+}
+
+func run() error {
+	cfg, err := loadConfig(pflag.CommandLine, os.Args[1:])
+	if err != nil || cfg.PrintConfig {
 		return err
 	}
 
@@ -84,10 +255,12 @@ func run() error {
 	log.Infof("deployment-event-relays starting up")
 	log.Infof("--- configuration ---")
 
-	disallowedKeys := []string{
-		"influxdb.password",
+	buf := &bytes.Buffer{}
+	err = config.Print(buf, cfg)
+	if err != nil {
+		return err
 	}
-	for _, configLine := range conftools.Format(disallowedKeys) {
+	for _, configLine := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
 		log.Info(configLine)
 	}
 
@@ -95,57 +268,55 @@ func run() error {
 
 	sarama.Logger = log.StandardLogger()
 
+	checks := health.NewRegistry()
+	var started atomic.Bool
+	checks.AddReadiness("startup", func() error {
+		if !started.Load() {
+			return fmt.Errorf("subsystems are still being set up")
+		}
+		return nil
+	})
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.Handle("/healthz", checks.Liveness())
+	mux.Handle("/readyz", checks.Readiness())
+	// Metrics used to be served on every path; keep doing so for existing scrape configurations.
+	mux.Handle("/", promhttp.Handler())
+
 	go func() {
-		err := http.ListenAndServe(cfg.Metrics.BindAddress, promhttp.Handler())
+		err := http.ListenAndServe(cfg.Metrics.BindAddress, mux)
 		if err != nil {
 			log.Errorf("Serve metrics: %s", err)
 			os.Exit(2)
 		}
 	}()
 
-	subsystems := make(map[string]Processor)
-
-	if len(cfg.InfluxDB.URL) > 0 {
-		subsystems["influxdb"] = &influx.Relay{
-			URL:      cfg.InfluxDB.URL,
-			Username: cfg.InfluxDB.Username,
-			Password: cfg.InfluxDB.Password,
-		}
-	}
-
-	if len(cfg.Nora.URL) > 0 {
-		subsystems["nora"] = &nora.Relay{
-			URL: cfg.InfluxDB.URL,
-		}
+	subsystems, err := buildSubsystems(cfg)
+	if err != nil {
+		return err
 	}
 
-	if len(cfg.Vera.URL) > 0 {
-		subsystems["vera"] = &vera.Relay{
-			URL: cfg.Vera.URL,
+	relays := make([]closeFunc, 0)
+	for _, sub := range subsystems {
+		if sub.closer != nil {
+			relays = append(relays, sub.closer)
 		}
 	}
+	closers := make([]closeFunc, 0)
 
-	if cfg.Null.Enabled {
-		subsystems["null"] = &null.Relay{}
-	}
-
-	if len(subsystems) == 0 {
-		return fmt.Errorf("no subsystems enabled")
-	}
+	consumers := make(map[string]consumerGroup)
+	history := admin.NewRegistry(cfg.Admin.HistorySize)
 
-	setup := func(key string, relayer Processor) error {
-		callback := func(message *sarama.ConsumerMessage, logger *log.Entry) (retry bool, err error) {
-			event := &deployment.Event{}
-			any := &anypb.Any{}
-			err = proto.Unmarshal(message.Value, any)
-			if err == nil {
-				err = any.UnmarshalTo(event)
-			}
-			if err != nil {
-				// unknown types are dropped
-				log.Tracef("Drop message: %s", err)
-				metrics.Process(key, metrics.LabelValueProcessedDropped, message.Offset+1)
-				return false, nil
+	setup := func(key string, sub subsystem) (*consumer.Subscriber, error) {
+		eventFilter, err := newFilter(sub.filters)
+		if err != nil {
+			return nil, fmt.Errorf("initialize filters: %w", err)
+		}
+		callback := func(ctx context.Context, message *sarama.ConsumerMessage, logger *log.Entry) error {
+			event, ok := consumer.Decoded(ctx).(*deployment.Event)
+			if !ok {
+				return outcome.Permanent(fmt.Errorf("message has not been decoded into a deployment event"))
 			}
 
 			logger = logger.WithFields(log.Fields{
@@ -159,44 +330,269 @@ func run() error {
 			} else {
 				logger.Tracef("Incoming message: %s", js)
 			}
-			retry, err = relayer.Process(event)
-			if err == nil {
-				logger.Infof("Successfully processed message")
-				metrics.Process(key, metrics.LabelValueProcessedOK, message.Offset+1)
-			} else {
-				if retry {
-					metrics.Process(key, metrics.LabelValueProcessedRetry, message.Offset)
-				} else {
-					metrics.Process(key, metrics.LabelValueProcessedError, message.Offset+1)
+			err = eventFilter.Check(event)
+			if err != nil {
+				err = outcome.Filtered(err)
+				processed(history, key, message, event, logger, err)
+				return err
+			}
+			if batcher, ok := sub.processor.(BatchProcessor); ok {
+				ack := consumer.Defer(ctx)
+				err = batcher.Enqueue(ctx, event, func(err error) {
+					processed(history, key, message, event, logger, err)
+					ack(err)
+				})
+				if err != nil {
+					processed(history, key, message, event, logger, err)
 				}
+				return err
 			}
-			return
+			err = sub.processor.Process(ctx, event)
+			processed(history, key, message, event, logger, err)
+			return err
 		}
 		metrics.Init(key)
-		kafkacfg, err := kafkaConfig(cfg, key, callback)
+		if sub.dryRun {
+			log.Warnf("Subsystem '%s' is in dry-run mode; payloads are logged and not sent", key)
+		}
+		subscriber := &consumer.Subscriber{
+			Callback:  callback,
+			Retry:     retryPolicy(sub.retry),
+			Subsystem: key,
+			Timeout:   sub.timeout,
+		}
+		if len(sub.deadLetterTopic) > 0 {
+			producer, err := deadLetterProducer(cfg, key, sub.deadLetterTopic)
+			if err != nil {
+				return nil, fmt.Errorf("initialize dead-letter producer: %w", err)
+			}
+			subscriber.DeadLetter = func(message *sarama.ConsumerMessage, cause error) error {
+				err := producer.Send(message, cause)
+				if err == nil {
+					metrics.DeadLetter(key)
+				}
+				return err
+			}
+			closers = append(closers, func(context.Context) error {
+				return producer.Close()
+			})
+		}
+		return subscriber, nil
+	}
+
+	// abort shuts down whatever has been started when setup fails.
+	abort := func(err error) error {
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+		defer cancel()
+		_ = shutdown(ctx, consumers, relays, closers)
+		return err
+	}
+
+	keys := make([]string, 0, len(subsystems))
+	for key := range subsystems {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	subscribers := make([]consumer.Subscriber, 0, len(keys))
+	groupSuffixes := make([]string, 0, len(keys))
+	for _, key := range keys {
+		sub := subsystems[key]
+		subscriber, err := setup(key, sub)
 		if err != nil {
-			return fmt.Errorf("initialize configuration: %w", err)
+			return abort(fmt.Errorf("setup subsystem '%s': %w", key, err))
 		}
-		_, err = consumer.New(*kafkacfg)
+		if cfg.Kafka.FanOut.Enabled {
+			subscribers = append(subscribers, *subscriber)
+			groupSuffixes = append(groupSuffixes, sub.groupSuffix)
+			continue
+		}
+		kafkacfg, err := kafkaConfig(cfg, sub.groupSuffix, *subscriber)
 		if err != nil {
-			return fmt.Errorf("initialize Kafka for subsystem %w", err)
+			return abort(fmt.Errorf("setup subsystem '%s': initialize configuration: %w", key, err))
 		}
-		return nil
+		c, err := consumer.New(*kafkacfg)
+		if err != nil {
+			return abort(fmt.Errorf("setup subsystem '%s': initialize Kafka for subsystem %w", key, err))
+		}
+		consumers[key] = c
+		history.Add(key, c)
+		addHealthChecks(checks, key, c.Status, cfg.Health.StuckThreshold)
+		log.Infof("Enabled subsystem '%s'", key)
 	}
 
-	for key, relayer := range subsystems {
-		err := setup(key, relayer)
+	if cfg.Kafka.FanOut.Enabled {
+		fanoutcfg, err := fanOutConfig(cfg, subscribers, groupSuffixes)
 		if err != nil {
-			return fmt.Errorf("setup subsystem '%s': %w", key, err)
+			return abort(fmt.Errorf("setup fan-out consumer: initialize configuration: %w", err))
+		}
+		f, err := consumer.NewFanOut(*fanoutcfg)
+		if err != nil {
+			return abort(fmt.Errorf("setup fan-out consumer: initialize Kafka %w", err))
+		}
+		consumers["fan-out"] = f
+		for _, key := range keys {
+			subscription := f.Subscription(key)
+			history.Add(key, subscription)
+			addHealthChecks(checks, key, subscription.Status, cfg.Health.StuckThreshold)
+			log.Infof("Enabled subsystem '%s' in fan-out mode", key)
 		}
-		log.Infof("Enabled subsystem '%s'", key)
 	}
 
+	if len(cfg.Admin.BindAddress) > 0 {
+		token, err := secret.Load(cfg.Admin.Token, cfg.Admin.TokenFile)
+		if err != nil {
+			return abort(fmt.Errorf("load admin API token: %w", err))
+		}
+		go func() {
+			err := http.ListenAndServe(cfg.Admin.BindAddress, history.Handler(token))
+			if err != nil {
+				log.Errorf("Serve admin API: %s", err)
+				os.Exit(2)
+			}
+		}()
+		log.Infof("Serving admin API on %s", cfg.Admin.BindAddress)
+	}
+
+	started.Store(true)
+
+	watchCtx, stopWatching := context.WithCancel(context.Background())
+	defer stopWatching()
+	go secret.Watch(watchCtx, cfg.Secrets.ReloadInterval)
+
 	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, os.Interrupt)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
 	sig := <-sigs
 
 	log.Infof("Received %s, shutting down.", sig)
 
-	return nil
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+
+	return shutdown(ctx, consumers, relays, closers)
+}
+
+// addHealthChecks reports a subsystem as ready while its consumer group has an active session,
+// and as not alive once a message has been retried for longer than the stuck threshold.
+// A zero threshold disables the liveness check.
+func addHealthChecks(checks *health.Registry, key string, status func() consumer.Status, stuckThreshold time.Duration) {
+	checks.AddReadiness(key, func() error {
+		if !status().Active {
+			return fmt.Errorf("consumer group has no active session")
+		}
+		return nil
+	})
+	if stuckThreshold <= 0 {
+		return
+	}
+	checks.AddLiveness(key, func() error {
+		since := status().RetryingSince
+		if !since.IsZero() && time.Since(since) > stuckThreshold {
+			return fmt.Errorf("message has been retried since %s", since.Format(time.RFC3339))
+		}
+		return nil
+	})
+}
+
+// newFilter compiles the filter rules of a subsystem.
+func newFilter(rules []config.Filter) (*filter.Filter, error) {
+	filterRules := make([]filter.Rule, 0, len(rules))
+	for _, r := range rules {
+		filterRules = append(filterRules, r.Rule())
+	}
+	return filter.New(filterRules)
+}
+
+// processed records the result of processing a message in metrics, and in the history of the subsystem.
+func processed(history *admin.Registry, key string, message *sarama.ConsumerMessage, event *deployment.Event, logger *log.Entry, err error) {
+	var status metrics.ProcessStatus
+	failed := false
+	offset := message.Offset + 1
+
+	switch outcome.Classify(err) {
+	case outcome.ClassOK:
+		logger.Infof("Successfully processed message")
+		status = metrics.LabelValueProcessedOK
+	case outcome.ClassSkipped:
+		status = metrics.LabelValueProcessedSkipped
+	case outcome.ClassFiltered:
+		status = metrics.LabelValueProcessedFiltered
+	case outcome.ClassPermanent:
+		status = metrics.LabelValueProcessedError
+		failed = true
+	case outcome.ClassRateLimited:
+		status = metrics.LabelValueProcessedRateLimited
+		failed = true
+		offset = message.Offset
+	default:
+		status = metrics.LabelValueProcessedRetry
+		failed = true
+		offset = message.Offset
+	}
+	metrics.Process(key, status, offset)
+
+	entry := admin.Entry{
+		Time:          time.Now(),
+		Partition:     message.Partition,
+		Offset:        message.Offset,
+		CorrelationID: event.GetCorrelationID(),
+		Status:        string(status),
+		Event:         event.Flatten(),
+	}
+	if failed {
+		entry.Error = err.Error()
+	}
+	var dryRun *relay.DryRunError
+	if errors.As(err, &dryRun) {
+		entry.Destination = dryRun.Payload.Destination()
+		entry.Payload = string(dryRun.Payload.Body)
+	}
+	history.Record(key, entry)
+}
+
+// shutdown closes all consumers in parallel, waiting for in-flight messages
+// to be processed and offsets to be committed, or until ctx expires.
+//
+// The relays are closed at the same time, so that batched events are written while the consumers
+// wait for them, instead of holding up shutdown until ctx expires.
+// Once the consumers are gone, the remaining resources are closed.
+func shutdown(ctx context.Context, consumers map[string]consumerGroup, relays, closers []closeFunc) error {
+	var mu sync.Mutex
+	var errs []error
+	wg := &sync.WaitGroup{}
+
+	for key, c := range consumers {
+		wg.Add(1)
+		go func(key string, c consumerGroup) {
+			defer wg.Done()
+			err := c.Close(ctx)
+			if err != nil {
+				mu.Lock()
+				errs = append(errs, fmt.Errorf("shut down consumer '%s': %w", key, err))
+				mu.Unlock()
+				return
+			}
+			log.Infof("Consumer '%s' shut down cleanly", key)
+		}(key, c)
+	}
+
+	for _, closer := range relays {
+		err := closer(ctx)
+		if err != nil {
+			mu.Lock()
+			errs = append(errs, err)
+			mu.Unlock()
+		}
+	}
+
+	wg.Wait()
+
+	for _, closer := range closers {
+		err := closer(ctx)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
 }
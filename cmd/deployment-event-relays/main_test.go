@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/navikt/deployment-event-relays/pkg/health"
+	"github.com/navikt/deployment-event-relays/pkg/kafka/consumer"
+	"github.com/stretchr/testify/assert"
+)
+
+// waitingConsumer is a consumer group that only finishes once its relay has been closed.
+type waitingConsumer struct {
+	relayClosed chan struct{}
+}
+
+func (c *waitingConsumer) Close(ctx context.Context) error {
+	select {
+	case <-c.relayClosed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func TestShutdownClosesRelaysBeforeWaitingForConsumers(t *testing.T) {
+	relayClosed := make(chan struct{})
+	order := make([]string, 0)
+
+	relays := []closeFunc{func(context.Context) error {
+		order = append(order, "relay")
+		close(relayClosed)
+		return nil
+	}}
+	closers := []closeFunc{func(context.Context) error {
+		order = append(order, "producer")
+		return nil
+	}}
+	consumers := map[string]consumerGroup{
+		"influxdb": &waitingConsumer{relayClosed: relayClosed},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	assert.NoError(t, shutdown(ctx, consumers, relays, closers))
+	assert.Equal(t, []string{"relay", "producer"}, order)
+}
+
+// check returns the status code and the result of the health check of the vera subsystem.
+func check(t *testing.T, handler http.Handler) (int, string) {
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+	response := health.Response{}
+	assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &response))
+	return recorder.Code, response.Checks["vera"]
+}
+
+func TestAddHealthChecks(t *testing.T) {
+	status := consumer.Status{}
+	checks := health.NewRegistry()
+	addHealthChecks(checks, "vera", func() consumer.Status { return status }, time.Minute)
+
+	code, result := check(t, checks.Readiness())
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "consumer group has no active session", result)
+
+	status.Active = true
+	code, result = check(t, checks.Readiness())
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, health.StatusOK, result)
+
+	// a message that has been retried for less than the threshold is not stuck
+	status.RetryingSince = time.Now().Add(-time.Second)
+	code, result = check(t, checks.Liveness())
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, health.StatusOK, result)
+
+	retryingSince := time.Now().Add(-2 * time.Minute)
+	status.RetryingSince = retryingSince
+	code, result = check(t, checks.Liveness())
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "message has been retried since "+retryingSince.Format(time.RFC3339), result)
+
+	// being stuck does not affect readiness
+	code, _ = check(t, checks.Readiness())
+	assert.Equal(t, http.StatusOK, code)
+}
+
+func TestAddHealthChecksWithoutStuckThreshold(t *testing.T) {
+	status := consumer.Status{Active: true, RetryingSince: time.Now().Add(-24 * time.Hour)}
+	checks := health.NewRegistry()
+	addHealthChecks(checks, "vera", func() consumer.Status { return status }, 0)
+
+	code, result := check(t, checks.Liveness())
+	assert.Equal(t, http.StatusOK, code)
+	assert.Empty(t, result)
+}
@@ -0,0 +1,434 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/navikt/deployment-event-relays/pkg/config"
+	"github.com/navikt/deployment-event-relays/pkg/deployment"
+	"github.com/navikt/deployment-event-relays/pkg/filter"
+	"github.com/navikt/deployment-event-relays/pkg/kafka/reader"
+	"github.com/navikt/deployment-event-relays/pkg/outcome"
+	"github.com/navikt/deployment-event-relays/pkg/relay"
+	sarama_metrics "github.com/rcrowley/go-metrics"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+)
+
+// replayCommand is the first argument that runs a replay instead of the relays.
+const replayCommand = "replay"
+
+// defaultIdleTimeout is how long a replay waits for the next message on a partition before giving up on it.
+// It is generous, as a slow fetch must not end a partition early.
+const defaultIdleTimeout = 5 * time.Minute
+
+// defaultReplayAttempts is the default number of attempts for each replayed event.
+// The retry policy of a relay often retries forever, which would stall a replay on a single event.
+const defaultReplayAttempts = 5
+
+// replayOptions selects the events to replay, and the relay to send them through.
+type replayOptions struct {
+	relay       string
+	partitions  []int32
+	startTime   string
+	startOffset int64
+	endTime     string
+	endOffset   int64
+	match       []string
+	maxAttempts int
+	idleTimeout time.Duration
+}
+
+func replayFlags(opts *replayOptions) *pflag.FlagSet {
+	flags := pflag.NewFlagSet(replayCommand, pflag.ContinueOnError)
+	flags.StringVar(&opts.relay, "relay", "", "Name of the subsystem to send events through, as used in metrics and logs")
+	flags.Int32SliceVar(&opts.partitions, "partitions", nil, "Comma-separated list of partitions to read. Defaults to all partitions")
+	flags.StringVar(&opts.startTime, "start-time", "", "Replay events produced at or after this time, in RFC 3339 format")
+	flags.Int64Var(&opts.startOffset, "start-offset", -1, "Replay events from this offset on each partition")
+	flags.StringVar(&opts.endTime, "end-time", "", "Replay events produced before this time, in RFC 3339 format")
+	flags.Int64Var(&opts.endOffset, "end-offset", -1, "Replay events before this offset on each partition")
+	flags.StringArrayVar(&opts.match, "match", nil, "Only replay events where a key of the flattened event has a value, as key=value or key!=value. May be repeated")
+	flags.IntVar(&opts.maxAttempts, "max-attempts", defaultReplayAttempts, "Give up on an event after this many attempts, and count it as failed. The backoff between attempts is that of the relay")
+	flags.DurationVar(&opts.idleTimeout, "idle-timeout", defaultIdleTimeout, "Give up on a partition when no message has arrived for this long, and report the remaining offsets as unread. Offsets can be missing after compaction. Zero waits until the end of the range is reached")
+	return flags
+}
+
+// rng converts the options into the range of messages to read.
+// Reading starts at the oldest message and stops at the newest one, unless limited by a time or an offset.
+func (opts *replayOptions) rng() (reader.Range, error) {
+	rng := reader.Range{
+		Partitions:  opts.partitions,
+		StartOffset: opts.startOffset,
+		EndOffset:   opts.endOffset,
+		IdleTimeout: opts.idleTimeout,
+	}
+	var err error
+
+	if len(opts.startTime) > 0 {
+		if opts.startOffset >= 0 {
+			return rng, fmt.Errorf("--start-time cannot be given together with --start-offset")
+		}
+		rng.StartTime, err = time.Parse(time.RFC3339, opts.startTime)
+		if err != nil {
+			return rng, fmt.Errorf("--start-time: %w", err)
+		}
+	}
+
+	if len(opts.endTime) > 0 {
+		if opts.endOffset >= 0 {
+			return rng, fmt.Errorf("--end-time cannot be given together with --end-offset")
+		}
+		rng.EndTime, err = time.Parse(time.RFC3339, opts.endTime)
+		if err != nil {
+			return rng, fmt.Errorf("--end-time: %w", err)
+		}
+	}
+
+	return rng, nil
+}
+
+// filters converts --match options into filter rules.
+func (opts *replayOptions) filters() ([]config.Filter, error) {
+	filters := make([]config.Filter, 0, len(opts.match))
+	for _, match := range opts.match {
+		key, value, ok := strings.Cut(match, "=")
+		if !ok || len(key) == 0 {
+			return nil, fmt.Errorf("--match %q: expected key=value or key!=value", match)
+		}
+		f := config.Filter{Key: key, Equals: value}
+		if strings.HasSuffix(key, "!") {
+			f.Key = strings.TrimSuffix(key, "!")
+			f.Not = true
+		}
+		filters = append(filters, f)
+	}
+	return filters, nil
+}
+
+// replay reads a range of events from the Kafka topic and sends them through a single relay.
+// No consumer group is used, so the progress of the running relays is not affected.
+func replay() error {
+	opts := &replayOptions{}
+	flags := replayFlags(opts)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s %s --relay <name> [options]\n\n", os.Args[0], replayCommand)
+		flags.PrintDefaults()
+	}
+
+	cfg, err := loadConfig(flags, os.Args[2:])
+	if errors.Is(err, pflag.ErrHelp) {
+		return nil
+	}
+	if err != nil || cfg.PrintConfig {
+		return err
+	}
+	if flags.NArg() > 0 {
+		return fmt.Errorf("unexpected argument: %s", flags.Arg(0))
+	}
+
+	rng, err := opts.rng()
+	if err != nil {
+		return err
+	}
+	matches, err := opts.filters()
+	if err != nil {
+		return err
+	}
+
+	specs, err := enabledRelays(cfg)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(specs))
+	var spec *relaySpec
+	for i := range specs {
+		names = append(names, specs[i].name)
+		if specs[i].name == opts.relay {
+			spec = &specs[i]
+		}
+	}
+	if spec == nil {
+		sort.Strings(names)
+		return fmt.Errorf("--relay must be one of the enabled subsystems: %s", strings.Join(names, ", "))
+	}
+
+	sub, err := spec.build(cfg.DryRun)
+	if err != nil {
+		return err
+	}
+	sub.filters = append(sub.filters, matches...)
+
+	sarama_metrics.UseNilMetrics = true
+	sarama.Logger = log.StandardLogger()
+
+	tlsConfig, err := tlsConfig(cfg)
+	if err != nil {
+		return err
+	}
+	r, err := reader.New(reader.Config{
+		Brokers:   cfg.Kafka.Brokers,
+		TlsConfig: tlsConfig,
+		Topic:     cfg.Kafka.Topic,
+	})
+	if err != nil {
+		return fmt.Errorf("initialize Kafka: %w", err)
+	}
+	defer r.Close()
+
+	rep, err := newReplayer(spec.name, sub, opts.maxAttempts, os.Stdout)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	if sub.dryRun {
+		log.Infof("Dry run: printing the payloads that '%s' would send", spec.name)
+	} else {
+		log.Infof("Replaying events through '%s'", spec.name)
+	}
+	unread, err := r.Read(ctx, rng, func(message *sarama.ConsumerMessage) error {
+		return rep.handle(ctx, message)
+	})
+	rep.unread.Add(unread)
+
+	closeCtx, closeCancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer closeCancel()
+	closeErr := rep.close(closeCtx)
+
+	log.Infof("Replay finished: %s", rep.summary())
+	if err != nil {
+		return fmt.Errorf("replay: %w", err)
+	}
+	return closeErr
+}
+
+// replayedEvent is a line of output in dry-run mode.
+type replayedEvent struct {
+	Partition   int32             `json:"partition"`
+	Offset      int64             `json:"offset"`
+	Event       *deployment.Event `json:"event"`
+	Destination string            `json:"destination"`
+	Payload     string            `json:"payload"`
+}
+
+// replayer sends replayed events through a subsystem, retrying them with the backoff of its retry policy
+// up to a maximum number of attempts. Events that still fail are counted and skipped,
+// as there is no consumer group to hold them back.
+// If the subsystem is in dry-run mode, the payloads are written to output instead.
+type replayer struct {
+	name        string
+	sub         subsystem
+	maxAttempts int
+	filter      *filter.Filter
+	output      io.Writer
+	pending     sync.WaitGroup
+
+	sent     atomic.Int64
+	skipped  atomic.Int64
+	filtered atomic.Int64
+	dropped  atomic.Int64
+	failed   atomic.Int64
+	unread   atomic.Int64
+}
+
+func newReplayer(name string, sub subsystem, maxAttempts int, output io.Writer) (*replayer, error) {
+	if maxAttempts < 1 {
+		return nil, fmt.Errorf("--max-attempts must be at least 1")
+	}
+	eventFilter, err := newFilter(sub.filters)
+	if err != nil {
+		return nil, fmt.Errorf("initialize filters: %w", err)
+	}
+	return &replayer{
+		name:        name,
+		sub:         sub,
+		maxAttempts: maxAttempts,
+		filter:      eventFilter,
+		output:      output,
+	}, nil
+}
+
+// handle replays a single message. Only cancellation of ctx stops the replay;
+// other errors are logged and counted.
+func (r *replayer) handle(ctx context.Context, message *sarama.ConsumerMessage) error {
+	logger := log.WithFields(log.Fields{
+		"subsystem": r.name,
+		"partition": message.Partition,
+		"offset":    message.Offset,
+	})
+
+	decoded, err := decodeMessage(message)
+	if err != nil {
+		logger.Warnf("Drop message: %s", err)
+		r.dropped.Add(1)
+		return nil
+	}
+	event := decoded.(*deployment.Event)
+	logger = logger.WithField("correlation_id", event.GetCorrelationID())
+
+	err = r.filter.Check(event)
+	if err != nil {
+		r.result(logger, outcome.Filtered(err))
+		return nil
+	}
+
+	if r.sub.dryRun {
+		return r.print(message, event, logger, r.sub.processor.Process(ctx, event))
+	}
+
+	if batcher, ok := r.sub.processor.(BatchProcessor); ok {
+		r.pending.Add(1)
+		err = batcher.Enqueue(ctx, event, func(err error) {
+			if !retriable(err) {
+				defer r.pending.Done()
+				r.result(logger, err)
+				return
+			}
+			// Retry in the background, so that the batcher is not held up.
+			go func() {
+				defer r.pending.Done()
+				r.result(logger, r.retry(ctx, event, logger, 1, err))
+			}()
+		})
+		if err != nil {
+			r.pending.Done()
+			r.result(logger, err)
+		}
+		return ctx.Err()
+	}
+
+	err = r.deliver(ctx, event, logger)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	r.result(logger, err)
+	return nil
+}
+
+// deliver processes an event, retrying transient errors until the maximum number of attempts is reached.
+func (r *replayer) deliver(ctx context.Context, event *deployment.Event, logger *log.Entry) error {
+	return r.retry(ctx, event, logger, 1, r.process(ctx, event))
+}
+
+// retry processes an event again after the given number of attempts, the last of which failed with err,
+// until it no longer fails with a retriable error or the maximum number of attempts is reached.
+func (r *replayer) retry(ctx context.Context, event *deployment.Event, logger *log.Entry, attempts int, err error) error {
+	policy := retryPolicy(r.sub.retry)
+	for ; retriable(err) && attempts < r.maxAttempts; attempts++ {
+		logger.Warnf("Replay message (attempt %d): %s", attempts, err)
+
+		delay := policy.Backoff(attempts)
+		if retryAfter := outcome.RetryAfter(err); retryAfter > delay {
+			delay = retryAfter
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		err = r.process(ctx, event)
+	}
+	return err
+}
+
+// retriable returns whether processing might succeed if an event is processed again.
+func retriable(err error) bool {
+	switch outcome.Classify(err) {
+	case outcome.ClassTransient, outcome.ClassRateLimited:
+		return true
+	}
+	return false
+}
+
+func (r *replayer) process(ctx context.Context, event *deployment.Event) error {
+	if r.sub.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.sub.timeout)
+		defer cancel()
+	}
+	return r.sub.processor.Process(ctx, event)
+}
+
+// print writes the payload built by a subsystem in dry-run mode as a line of JSON.
+// Events that the relay would not send are counted as usual.
+func (r *replayer) print(message *sarama.ConsumerMessage, event *deployment.Event, logger *log.Entry, err error) error {
+	var dryRun *relay.DryRunError
+	if !errors.As(err, &dryRun) {
+		r.result(logger, err)
+		return nil
+	}
+	err = json.NewEncoder(r.output).Encode(replayedEvent{
+		Partition:   message.Partition,
+		Offset:      message.Offset,
+		Event:       event,
+		Destination: dryRun.Payload.Destination(),
+		Payload:     string(dryRun.Payload.Body),
+	})
+	if err != nil {
+		return fmt.Errorf("print payload: %w", err)
+	}
+	r.sent.Add(1)
+	return nil
+}
+
+// result logs and counts the final result of replaying an event.
+func (r *replayer) result(logger *log.Entry, err error) {
+	switch outcome.Classify(err) {
+	case outcome.ClassOK:
+		logger.Infof("Successfully replayed message")
+		r.sent.Add(1)
+	case outcome.ClassSkipped:
+		logger.Infof("Skipped message: %s", err)
+		r.skipped.Add(1)
+	case outcome.ClassFiltered:
+		logger.Debugf("Filtered message: %s", err)
+		r.filtered.Add(1)
+	default:
+		logger.Errorf("Failed to replay message: %s", err)
+		r.failed.Add(1)
+	}
+}
+
+// close waits for events handed to a batching relay to be delivered, and releases the relay.
+// Pending events are waited for first, as failed batches are retried through the relay.
+func (r *replayer) close(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		r.pending.Wait()
+		close(done)
+	}()
+
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = fmt.Errorf("wait for pending events: %w", ctx.Err())
+	}
+	if r.sub.closer != nil {
+		err = errors.Join(err, r.sub.closer(ctx))
+	}
+	return err
+}
+
+func (r *replayer) summary() string {
+	action := "sent"
+	if r.sub.dryRun {
+		action = "printed"
+	}
+	return fmt.Sprintf("%d %s, %d skipped, %d filtered, %d dropped, %d failed, %d unread",
+		r.sent.Load(), action, r.skipped.Load(), r.filtered.Load(), r.dropped.Load(), r.failed.Load(), r.unread.Load())
+}
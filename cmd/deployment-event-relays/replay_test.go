@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/navikt/deployment-event-relays/pkg/config"
+	"github.com/navikt/deployment-event-relays/pkg/deployment"
+	"github.com/navikt/deployment-event-relays/pkg/kafka/reader"
+	"github.com/navikt/deployment-event-relays/pkg/outcome"
+	"github.com/navikt/deployment-event-relays/pkg/relay"
+	"github.com/spf13/pflag"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+// processor fails events for some applications, and records the applications of all events it delivers.
+type processor struct {
+	lock         sync.Mutex
+	errors       map[string]error
+	applications []string
+}
+
+func (p *processor) Process(ctx context.Context, event *deployment.Event) error {
+	payload, err := p.Build(event)
+	if err != nil {
+		return err
+	}
+	return p.Deliver(ctx, payload)
+}
+
+func (p *processor) Build(event *deployment.Event) (*relay.Payload, error) {
+	return &relay.Payload{
+		Method: "POST",
+		URL:    "https://vera.example.com/api?token=secret",
+		Body:   []byte(event.GetApplication()),
+	}, nil
+}
+
+func (p *processor) Deliver(_ context.Context, payload *relay.Payload) error {
+	application := string(payload.Body)
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.applications = append(p.applications, application)
+	return p.errors[application]
+}
+
+func eventMessage(t *testing.T, offset int64, event *deployment.Event) *sarama.ConsumerMessage {
+	any, err := anypb.New(event)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	value, err := proto.Marshal(any)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	return &sarama.ConsumerMessage{Offset: offset, Value: value}
+}
+
+func replaySubsystem(p *processor, filters ...config.Filter) subsystem {
+	retry := config.DefaultSubsystem().Retry
+	retry.InitialBackoff = time.Millisecond
+	retry.MaxBackoff = time.Millisecond
+	return subsystem{
+		processor: p,
+		retry:     retry,
+		timeout:   time.Second,
+		filters:   filters,
+	}
+}
+
+func TestReplayOptions(t *testing.T) {
+	opts := &replayOptions{}
+	flags := replayFlags(opts)
+	err := flags.Parse([]string{
+		"--relay", "vera",
+		"--partitions", "0,2",
+		"--start-time", "2021-03-04T05:00:00Z",
+		"--end-offset", "100",
+		"--match", "team=aura",
+		"--match", "environment!=development",
+	})
+	assert.NoError(t, err)
+
+	rng, err := opts.rng()
+	assert.NoError(t, err)
+	assert.Equal(t, reader.Range{
+		Partitions:  []int32{0, 2},
+		StartOffset: -1,
+		StartTime:   time.Date(2021, 3, 4, 5, 0, 0, 0, time.UTC),
+		EndOffset:   100,
+		IdleTimeout: defaultIdleTimeout,
+	}, rng)
+
+	filters, err := opts.filters()
+	assert.NoError(t, err)
+	assert.Equal(t, []config.Filter{
+		{Key: "team", Equals: "aura"},
+		{Key: "environment", Equals: "development", Not: true},
+	}, filters)
+
+	_, err = (&replayOptions{startTime: "yesterday", startOffset: -1, endOffset: -1}).rng()
+	assert.Error(t, err)
+	_, err = (&replayOptions{endTime: "2021-03-04T05:00:00Z", startOffset: -1, endOffset: 10}).rng()
+	assert.EqualError(t, err, "--end-time cannot be given together with --end-offset")
+	_, err = (&replayOptions{match: []string{"team"}}).filters()
+	assert.EqualError(t, err, `--match "team": expected key=value or key!=value`)
+}
+
+func TestReplayFlagsRejectUnknownFlags(t *testing.T) {
+	opts := &replayOptions{}
+	flags := replayFlags(opts)
+	regular := pflag.NewFlagSet("regular", pflag.ContinueOnError)
+	regular.String("kafka.topic", "", "")
+	regular.Bool("dry-run", false, "")
+	flags.AddFlagSet(regular)
+
+	assert.NoError(t, flags.Parse([]string{"--relay", "vera", "--dry-run", "--kafka.topic=events", "--end-offset", "-1"}))
+	assert.Equal(t, "vera", opts.relay)
+	assert.Equal(t, defaultReplayAttempts, opts.maxAttempts)
+	assert.EqualError(t, flags.Parse([]string{"--relay=vera", "--kafka.topik", "events"}), "unknown flag: --kafka.topik")
+}
+
+func TestReplayer(t *testing.T) {
+	p := &processor{
+		errors: map[string]error{
+			"rejected": outcome.Permanent(fmt.Errorf("bad request")),
+			"flaky":    fmt.Errorf("connection refused"),
+			"ignored":  outcome.Skipped(fmt.Errorf("not interesting")),
+		},
+	}
+	rep, err := newReplayer("vera", replaySubsystem(p, config.Filter{Key: "team", Equals: "aura"}), 2, nil)
+	assert.NoError(t, err)
+
+	messages := []*sarama.ConsumerMessage{
+		eventMessage(t, 0, &deployment.Event{Application: "first", Team: "aura"}),
+		eventMessage(t, 1, &deployment.Event{Application: "other-team", Team: "nais"}),
+		eventMessage(t, 2, &deployment.Event{Application: "rejected", Team: "aura"}),
+		{Offset: 3, Value: []byte("not a deployment event")},
+		eventMessage(t, 4, &deployment.Event{Application: "flaky", Team: "aura"}),
+		eventMessage(t, 5, &deployment.Event{Application: "ignored", Team: "aura"}),
+		eventMessage(t, 6, &deployment.Event{Application: "last", Team: "aura"}),
+	}
+	for _, message := range messages {
+		assert.NoError(t, rep.handle(context.Background(), message))
+	}
+	assert.NoError(t, rep.close(context.Background()))
+
+	assert.Equal(t, []string{"first", "rejected", "flaky", "flaky", "ignored", "last"}, p.applications)
+	assert.Equal(t, "2 sent, 1 skipped, 1 filtered, 1 dropped, 2 failed, 0 unread", rep.summary())
+}
+
+func TestReplayerCancel(t *testing.T) {
+	p := &processor{errors: map[string]error{"flaky": fmt.Errorf("connection refused")}}
+	rep, err := newReplayer("vera", replaySubsystem(p), 1000, nil)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	err = rep.handle(ctx, eventMessage(t, 0, &deployment.Event{Application: "flaky"}))
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, "0 sent, 0 skipped, 0 filtered, 0 dropped, 0 failed, 0 unread", rep.summary())
+}
+
+func TestReplayerGivesUp(t *testing.T) {
+	p := &processor{errors: map[string]error{"flaky": fmt.Errorf("connection refused")}}
+	sub := replaySubsystem(p)
+	// the retry policy of the relay retries forever
+	sub.retry.MaxAttempts = 0
+	rep, err := newReplayer("vera", sub, 3, nil)
+	assert.NoError(t, err)
+
+	assert.NoError(t, rep.handle(context.Background(), eventMessage(t, 0, &deployment.Event{Application: "flaky"})))
+	assert.NoError(t, rep.close(context.Background()))
+
+	assert.Equal(t, []string{"flaky", "flaky", "flaky"}, p.applications)
+	assert.Equal(t, "0 sent, 0 skipped, 0 filtered, 0 dropped, 1 failed, 0 unread", rep.summary())
+
+	_, err = newReplayer("vera", sub, 0, nil)
+	assert.EqualError(t, err, "--max-attempts must be at least 1")
+}
+
+// batchProcessor delivers enqueued events in the background, once each.
+type batchProcessor struct {
+	*processor
+}
+
+func (p *batchProcessor) Enqueue(ctx context.Context, event *deployment.Event, done func(err error)) error {
+	go func() {
+		done(p.Process(ctx, event))
+	}()
+	return nil
+}
+
+func TestReplayerRetriesBatches(t *testing.T) {
+	p := &processor{errors: map[string]error{
+		"flaky":    fmt.Errorf("connection refused"),
+		"rejected": outcome.Permanent(fmt.Errorf("bad request")),
+	}}
+	sub := replaySubsystem(p)
+	sub.processor = &batchProcessor{p}
+	rep, err := newReplayer("vera", sub, 2, nil)
+	assert.NoError(t, err)
+
+	assert.NoError(t, rep.handle(context.Background(), eventMessage(t, 0, &deployment.Event{Application: "flaky"})))
+	assert.NoError(t, rep.handle(context.Background(), eventMessage(t, 1, &deployment.Event{Application: "rejected"})))
+	assert.NoError(t, rep.close(context.Background()))
+
+	// only the transient failure is retried
+	assert.ElementsMatch(t, []string{"flaky", "flaky", "rejected"}, p.applications)
+	assert.Equal(t, "0 sent, 0 skipped, 0 filtered, 0 dropped, 2 failed, 0 unread", rep.summary())
+}
+
+func TestReplayerDryRun(t *testing.T) {
+	p := &processor{}
+	output := &bytes.Buffer{}
+	sub := replaySubsystem(p, config.Filter{Key: "team", Equals: "aura"})
+	sub.processor = relay.DryRun(p)
+	sub.dryRun = true
+	rep, err := newReplayer("vera", sub, 1, output)
+	assert.NoError(t, err)
+
+	assert.NoError(t, rep.handle(context.Background(), eventMessage(t, 7, &deployment.Event{Application: "myapplication", Team: "aura"})))
+	assert.NoError(t, rep.handle(context.Background(), eventMessage(t, 8, &deployment.Event{Application: "other-team", Team: "nais"})))
+	assert.NoError(t, rep.close(context.Background()))
+
+	assert.Empty(t, p.applications)
+	assert.Equal(t, "1 printed, 0 skipped, 1 filtered, 0 dropped, 0 failed, 0 unread", rep.summary())
+
+	lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+	if !assert.Len(t, lines, 1) {
+		return
+	}
+	printed := replayedEvent{}
+	assert.NoError(t, json.Unmarshal([]byte(lines[0]), &printed))
+	assert.Equal(t, int64(7), printed.Offset)
+	assert.Equal(t, "myapplication", printed.Event.GetApplication())
+	assert.Equal(t, "POST vera.example.com", printed.Destination)
+	assert.Equal(t, "myapplication", printed.Payload)
+}
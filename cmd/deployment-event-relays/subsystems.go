@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/navikt/deployment-event-relays/pkg/config"
+	"github.com/navikt/deployment-event-relays/pkg/relay"
+
+	// Relay types register themselves when imported.
+	_ "github.com/navikt/deployment-event-relays/pkg/influx"
+	_ "github.com/navikt/deployment-event-relays/pkg/nora"
+	_ "github.com/navikt/deployment-event-relays/pkg/null"
+	_ "github.com/navikt/deployment-event-relays/pkg/slack"
+	_ "github.com/navikt/deployment-event-relays/pkg/vera"
+	_ "github.com/navikt/deployment-event-relays/pkg/webhook"
+)
+
+// relaySpec is a relay enabled in the configuration, which has not been built yet.
+type relaySpec struct {
+	name        string
+	groupSuffix string
+	factory     relay.Factory
+	settings    config.Settings
+}
+
+// enabledRelays lists the relays enabled in the configuration, in the order they are built.
+//
+// Top-level relay sections are named after their relay type, or "<type>/<name>" for types with named instances.
+// Relay instances use their own name.
+func enabledRelays(cfg *config.Config) ([]relaySpec, error) {
+	specs := make([]relaySpec, 0)
+	used := make(map[string]bool)
+
+	// add registers a relay, making sure that each name is only used once.
+	add := func(factory relay.Factory, name, groupSuffix string, settings config.Settings) error {
+		if used[name] {
+			return fmt.Errorf("configure %s: subsystem name is already in use", name)
+		}
+		used[name] = true
+		if len(groupSuffix) == 0 {
+			groupSuffix = name
+		}
+		specs = append(specs, relaySpec{
+			name:        name,
+			groupSuffix: groupSuffix,
+			factory:     factory,
+			settings:    settings,
+		})
+		return nil
+	}
+
+	for _, factory := range relay.Factories() {
+		switch section := cfg.Sections[factory.Key].(type) {
+		case config.Settings:
+			if section.Enabled() {
+				if err := add(factory, factory.Type, "", section); err != nil {
+					return nil, err
+				}
+			}
+		case map[string]config.Settings:
+			names := make([]string, 0, len(section))
+			for name := range section {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				if err := add(factory, factory.Type+"/"+name, "", section[name]); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	for _, r := range cfg.Relays {
+		if len(r.Name) == 0 {
+			return nil, fmt.Errorf("configure relays: every relay instance must have a name")
+		}
+		factory, ok := relay.Lookup(r.Type)
+		settings := r.Settings()
+		if !ok || settings == nil {
+			return nil, fmt.Errorf("configure %s: relay type '%s' is not supported", r.Name, r.Type)
+		}
+		if err := add(factory, r.Name, r.GroupSuffix, settings); err != nil {
+			return nil, err
+		}
+	}
+
+	return specs, nil
+}
+
+// buildSubsystems creates the subsystems enabled in the configuration, keyed by the name
+// used in metrics and logs. Kafka consumers are not started.
+func buildSubsystems(cfg *config.Config) (map[string]subsystem, error) {
+	specs, err := enabledRelays(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if len(specs) == 0 {
+		return nil, fmt.Errorf("no subsystems enabled")
+	}
+
+	subsystems := make(map[string]subsystem, len(specs))
+	for _, spec := range specs {
+		sub, err := spec.build(cfg.DryRun)
+		if err != nil {
+			return nil, err
+		}
+		subsystems[spec.name] = sub
+	}
+
+	return subsystems, nil
+}
+
+// build creates the relay, and combines it with the settings used to consume events on its behalf.
+// If dryRun is set, the relay does not send anything, regardless of its own settings.
+func (spec relaySpec) build(dryRun bool) (subsystem, error) {
+	sub, err := newSubsystem(spec.factory, spec.name, spec.settings, dryRun)
+	if err != nil {
+		return subsystem{}, fmt.Errorf("configure %s: %w", spec.name, err)
+	}
+	sub.groupSuffix = spec.groupSuffix
+	return sub, nil
+}
+
+// newSubsystem builds a relay, and combines it with the settings used to consume events on its behalf.
+// In dry-run mode, the relay only builds the payload of each event.
+func newSubsystem(factory relay.Factory, name string, settings config.Settings, dryRun bool) (subsystem, error) {
+	r, err := factory.New(name, settings)
+	if err != nil {
+		return subsystem{}, err
+	}
+	common := settings.Common()
+	processor := r.Processor
+	dryRun = dryRun || common.DryRun
+	if dryRun {
+		builder, ok := r.Processor.(relay.Builder)
+		if !ok {
+			return subsystem{}, fmt.Errorf("relay type '%s' does not support dry-run", factory.Type)
+		}
+		processor = relay.DryRun(builder)
+	}
+	return subsystem{
+		processor:       processor,
+		dryRun:          dryRun,
+		deadLetterTopic: common.DeadLetterTopic,
+		retry:           common.Retry,
+		timeout:         common.Timeout,
+		filters:         common.Filters,
+		closer:          r.Closer,
+	}, nil
+}
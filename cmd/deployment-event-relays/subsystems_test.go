@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/navikt/deployment-event-relays/pkg/config"
+	"github.com/navikt/deployment-event-relays/pkg/deployment"
+	"github.com/navikt/deployment-event-relays/pkg/relay"
+	"github.com/stretchr/testify/assert"
+)
+
+// endpoint is a stand-in for a relay destination that records the paths it receives requests on.
+type endpoint struct {
+	*httptest.Server
+	lock  sync.Mutex
+	paths []string
+}
+
+func newEndpoint(t *testing.T, status int) *endpoint {
+	e := &endpoint{}
+	e.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		e.lock.Lock()
+		e.paths = append(e.paths, r.URL.Path)
+		e.lock.Unlock()
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(e.Close)
+	return e
+}
+
+// take returns the recorded paths and resets the endpoint.
+func (e *endpoint) take() []string {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	paths := e.paths
+	e.paths = nil
+	return paths
+}
+
+func TestBuildSubsystemsWiring(t *testing.T) {
+	endpoints := map[string]*endpoint{
+		"influxdb":          newEndpoint(t, http.StatusNoContent),
+		"nora":              newEndpoint(t, http.StatusOK),
+		"vera":              newEndpoint(t, http.StatusOK),
+		"slack":             newEndpoint(t, http.StatusOK),
+		"webhook/dashboard": newEndpoint(t, http.StatusOK),
+		"influxdb-dev":      newEndpoint(t, http.StatusNoContent),
+		"vera-dev":          newEndpoint(t, http.StatusOK),
+	}
+
+	cfg := config.DefaultConfig()
+	cfg.Sections = map[string]interface{}{
+		"influxdb": map[string]interface{}{
+			"url": endpoints["influxdb"].URL + "/write?db=deployments",
+		},
+		"nora": map[string]interface{}{
+			"url": endpoints["nora"].URL + "/api/events",
+		},
+		"vera": map[string]interface{}{
+			"url": endpoints["vera"].URL + "/api/v1/deploylog",
+		},
+		"null": map[string]interface{}{
+			"enabled": true,
+		},
+		"slack": map[string]interface{}{
+			"url": endpoints["slack"].URL + "/services/default",
+		},
+		"webhooks": map[string]interface{}{
+			"dashboard": map[string]interface{}{
+				"url":      endpoints["webhook/dashboard"].URL + "/hook",
+				"template": `{"application":{{ json .Fields.application }}}`,
+			},
+		},
+	}
+	cfg.Relays = []config.Relay{
+		{
+			Name: "influxdb-dev",
+			Type: "influxdb",
+			Sections: map[string]interface{}{
+				"influxdb": map[string]interface{}{
+					"url":     endpoints["influxdb-dev"].URL,
+					"version": 2,
+					"org":     "nais",
+					"bucket":  "deployments",
+					"token":   "token",
+				},
+			},
+		},
+		{
+			Name: "vera-dev",
+			Type: "vera",
+			Sections: map[string]interface{}{
+				"vera": map[string]interface{}{
+					"url": endpoints["vera-dev"].URL + "/api/v1/deploylog",
+				},
+			},
+		},
+	}
+	assert.NoError(t, relay.Decode(cfg))
+	config.ApplyDefaults(cfg)
+
+	subsystems, err := buildSubsystems(cfg)
+	assert.NoError(t, err)
+	assert.Len(t, subsystems, len(endpoints)+1)
+
+	expectedPaths := map[string]string{
+		"influxdb":          "/write",
+		"nora":              "/api/events",
+		"vera":              "/api/v1/deploylog",
+		"slack":             "/services/default",
+		"webhook/dashboard": "/hook",
+		"influxdb-dev":      "/api/v2/write",
+		"vera-dev":          "/api/v1/deploylog",
+	}
+
+	event := &deployment.Event{
+		Application:   "myapplication",
+		Team:          "aura",
+		Environment:   deployment.Environment_production,
+		RolloutStatus: deployment.RolloutStatus_complete,
+	}
+
+	for name, sub := range subsystems {
+		err := sub.processor.Process(context.Background(), event)
+		assert.NoError(t, err, name)
+
+		for target, e := range endpoints {
+			if target == name {
+				assert.Equal(t, []string{expectedPaths[name]}, e.take(), "subsystem %s must post to its own endpoint", name)
+			} else {
+				assert.Empty(t, e.take(), "subsystem %s must not post to the %s endpoint", name, target)
+			}
+		}
+	}
+
+	assert.Equal(t, "influxdb-dev", subsystems["influxdb-dev"].groupSuffix)
+	assert.Equal(t, "nora", subsystems["nora"].groupSuffix)
+}
+
+func TestBuildSubsystemsRejectsDuplicateNames(t *testing.T) {
+	cfg := config.DefaultConfig()
+	cfg.Sections = map[string]interface{}{
+		"vera": map[string]interface{}{"url": "http://vera"},
+	}
+	cfg.Relays = []config.Relay{
+		{Name: "vera", Type: "vera"},
+	}
+	assert.NoError(t, relay.Decode(cfg))
+	config.ApplyDefaults(cfg)
+
+	_, err := buildSubsystems(cfg)
+	assert.EqualError(t, err, "configure vera: subsystem name is already in use")
+}
+
+func TestBuildSubsystemsDryRun(t *testing.T) {
+	vera := newEndpoint(t, http.StatusOK)
+	nora := newEndpoint(t, http.StatusOK)
+
+	cfg := config.DefaultConfig()
+	cfg.Sections = map[string]interface{}{
+		"vera": map[string]interface{}{
+			"url":     vera.URL + "/api/v1/deploylog",
+			"dry-run": true,
+		},
+		"nora": map[string]interface{}{
+			"url": nora.URL + "/api/events",
+		},
+	}
+	assert.NoError(t, relay.Decode(cfg))
+	config.ApplyDefaults(cfg)
+
+	event := &deployment.Event{Application: "myapplication", Team: "aura"}
+
+	subsystems, err := buildSubsystems(cfg)
+	assert.NoError(t, err)
+	assert.True(t, subsystems["vera"].dryRun)
+	assert.False(t, subsystems["nora"].dryRun)
+
+	err = subsystems["vera"].processor.Process(context.Background(), event)
+	var dryRun *relay.DryRunError
+	if assert.ErrorAs(t, err, &dryRun) {
+		assert.Contains(t, string(dryRun.Payload.Body), `"application":"myapplication"`)
+	}
+	assert.Empty(t, vera.take())
+
+	assert.NoError(t, subsystems["nora"].processor.Process(context.Background(), event))
+	assert.Equal(t, []string{"/api/events"}, nora.take())
+
+	cfg.DryRun = true
+	subsystems, err = buildSubsystems(cfg)
+	assert.NoError(t, err)
+	err = subsystems["nora"].processor.Process(context.Background(), event)
+	assert.ErrorAs(t, err, &dryRun)
+	assert.Empty(t, nora.take())
+}
@@ -0,0 +1,235 @@
+// Package admin serves an HTTP API for inspecting subsystems and pausing or resuming them at runtime.
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/navikt/deployment-event-relays/pkg/kafka/consumer"
+	"github.com/navikt/deployment-event-relays/pkg/secret"
+	log "github.com/sirupsen/logrus"
+)
+
+// Control reports the state of a subsystem's consumer, and pauses or resumes its processing.
+// Pause returns an error if the subsystem cannot be paused.
+type Control interface {
+	Status() consumer.Status
+	Pause() error
+	Resume()
+}
+
+// Entry is an event handled by a subsystem, together with the result.
+type Entry struct {
+	Time          time.Time         `json:"time"`
+	Partition     int32             `json:"partition"`
+	Offset        int64             `json:"offset"`
+	CorrelationID string            `json:"correlation_id,omitempty"`
+	Status        string            `json:"status"`
+	Error         string            `json:"error,omitempty"`
+	Event         map[string]string `json:"event,omitempty"`
+	// Destination and Payload are set for events handled in dry-run mode, with the request that would have been sent.
+	Destination string `json:"destination,omitempty"`
+	Payload     string `json:"payload,omitempty"`
+}
+
+// Status is the state of a subsystem, as returned by the API.
+type Status struct {
+	Name          string     `json:"name"`
+	Active        bool       `json:"active"`
+	Paused        bool       `json:"paused"`
+	Pausable      bool       `json:"pausable"`
+	RetryingSince *time.Time `json:"retrying_since,omitempty"`
+}
+
+// Error is the body of unsuccessful responses.
+type Error struct {
+	Error string `json:"error"`
+}
+
+type subsystem struct {
+	control  Control
+	events   *history
+	errors   *history
+	payloads *history
+}
+
+// Registry holds the subsystems that can be controlled through the API, and the most recent events and errors of each.
+type Registry struct {
+	lock        sync.RWMutex
+	historySize int
+	subsystems  map[string]*subsystem
+}
+
+// NewRegistry creates a registry that keeps up to historySize events and errors per subsystem.
+func NewRegistry(historySize int) *Registry {
+	return &Registry{
+		historySize: historySize,
+		subsystems:  make(map[string]*subsystem),
+	}
+}
+
+// Add registers a subsystem under the given name.
+func (r *Registry) Add(name string, control Control) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.subsystems[name] = &subsystem{
+		control:  control,
+		events:   newHistory(r.historySize),
+		errors:   newHistory(r.historySize),
+		payloads: newHistory(r.historySize),
+	}
+}
+
+// Record keeps an entry in the history of a subsystem. Entries with an error are also kept in its error history,
+// and entries with a dry-run payload in its payload history.
+// Secrets are redacted from the error and payload before they are kept.
+// Entries for unknown subsystems are ignored.
+func (r *Registry) Record(name string, entry Entry) {
+	sub := r.get(name)
+	if sub == nil {
+		return
+	}
+	entry.Error = secret.Redact(entry.Error)
+	entry.Payload = secret.Redact(entry.Payload)
+	sub.events.add(entry)
+	if len(entry.Error) > 0 {
+		sub.errors.add(entry)
+	}
+	if len(entry.Payload) > 0 {
+		sub.payloads.add(entry)
+	}
+}
+
+func (r *Registry) get(name string) *subsystem {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.subsystems[name]
+}
+
+func (r *Registry) status(name string, sub *subsystem) Status {
+	status := sub.control.Status()
+	result := Status{
+		Name:     name,
+		Active:   status.Active,
+		Paused:   status.Paused,
+		Pausable: status.Pausable,
+	}
+	if !status.RetryingSince.IsZero() {
+		result.RetryingSince = &status.RetryingSince
+	}
+	return result
+}
+
+// Handler serves the API. If token is not empty, requests must carry it as a bearer token.
+//
+//	GET  /subsystems                 list all subsystems with their status
+//	GET  /subsystems/{name}          status of a single subsystem
+//	POST /subsystems/{name}/pause    stop fetching and processing events for a subsystem, if its status is pausable
+//	POST /subsystems/{name}/resume   continue processing events for a subsystem
+//	GET  /subsystems/{name}/events   most recent events handled by a subsystem, newest first
+//	GET  /subsystems/{name}/errors   most recent errors of a subsystem, newest first
+//	GET  /subsystems/{name}/payloads most recent payloads built in dry-run mode, newest first
+func (r *Registry) Handler(token *secret.Value) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /subsystems", func(w http.ResponseWriter, req *http.Request) {
+		r.lock.RLock()
+		names := make([]string, 0, len(r.subsystems))
+		for name := range r.subsystems {
+			names = append(names, name)
+		}
+		r.lock.RUnlock()
+		sort.Strings(names)
+
+		statuses := make([]Status, 0, len(names))
+		for _, name := range names {
+			statuses = append(statuses, r.status(name, r.get(name)))
+		}
+		respond(w, http.StatusOK, statuses)
+	})
+
+	mux.HandleFunc("GET /subsystems/{name}", r.subsystemHandler(func(name string, sub *subsystem) (interface{}, error) {
+		return r.status(name, sub), nil
+	}))
+
+	mux.HandleFunc("POST /subsystems/{name}/pause", r.subsystemHandler(func(name string, sub *subsystem) (interface{}, error) {
+		err := sub.control.Pause()
+		if err != nil {
+			return nil, err
+		}
+		log.Infof("Paused subsystem '%s'", name)
+		return r.status(name, sub), nil
+	}))
+
+	mux.HandleFunc("POST /subsystems/{name}/resume", r.subsystemHandler(func(name string, sub *subsystem) (interface{}, error) {
+		sub.control.Resume()
+		log.Infof("Resumed subsystem '%s'", name)
+		return r.status(name, sub), nil
+	}))
+
+	mux.HandleFunc("GET /subsystems/{name}/events", r.subsystemHandler(func(_ string, sub *subsystem) (interface{}, error) {
+		return sub.events.list(), nil
+	}))
+
+	mux.HandleFunc("GET /subsystems/{name}/errors", r.subsystemHandler(func(_ string, sub *subsystem) (interface{}, error) {
+		return sub.errors.list(), nil
+	}))
+
+	mux.HandleFunc("GET /subsystems/{name}/payloads", r.subsystemHandler(func(_ string, sub *subsystem) (interface{}, error) {
+		return sub.payloads.list(), nil
+	}))
+
+	mux.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
+		respond(w, http.StatusNotFound, Error{Error: "not found"})
+	})
+
+	return authenticate(token, mux)
+}
+
+// subsystemHandler looks up the subsystem named in the request path, and responds with the result of fn.
+// If fn fails, the request conflicts with the state of the subsystem, and the error is returned instead.
+func (r *Registry) subsystemHandler(fn func(name string, sub *subsystem) (interface{}, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		name := req.PathValue("name")
+		sub := r.get(name)
+		if sub == nil {
+			respond(w, http.StatusNotFound, Error{Error: fmt.Sprintf("subsystem '%s' does not exist", name)})
+			return
+		}
+		result, err := fn(name, sub)
+		if err != nil {
+			respond(w, http.StatusConflict, Error{Error: err.Error()})
+			return
+		}
+		respond(w, http.StatusOK, result)
+	}
+}
+
+// authenticate rejects requests without the expected bearer token. The token is read on every request,
+// so that it can be rotated while the program runs.
+func authenticate(token *secret.Value, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		expected := token.Reveal()
+		if len(expected) > 0 {
+			given, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(expected)) != 1 {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				respond(w, http.StatusUnauthorized, Error{Error: "a valid bearer token is required"})
+				return
+			}
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+func respond(w http.ResponseWriter, code int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,164 @@
+package admin_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/navikt/deployment-event-relays/pkg/admin"
+	"github.com/navikt/deployment-event-relays/pkg/kafka/consumer"
+	"github.com/navikt/deployment-event-relays/pkg/secret"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeControl struct {
+	status   consumer.Status
+	pauseErr error
+}
+
+func (c *fakeControl) Status() consumer.Status { return c.status }
+func (c *fakeControl) Resume()                 { c.status.Paused = false }
+
+func (c *fakeControl) Pause() error {
+	if c.pauseErr != nil {
+		return c.pauseErr
+	}
+	c.status.Paused = true
+	return nil
+}
+
+func request(t *testing.T, handler http.Handler, method, path, token string, body interface{}) int {
+	recorder := httptest.NewRecorder()
+	req := httptest.NewRequest(method, path, nil)
+	if len(token) > 0 {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, "application/json", recorder.Header().Get("Content-Type"))
+	if body != nil {
+		assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), body))
+	}
+	return recorder.Code
+}
+
+func TestSubsystems(t *testing.T) {
+	retryingSince := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+	registry := admin.NewRegistry(10)
+	vera := &fakeControl{status: consumer.Status{Active: true, Pausable: true}}
+	registry.Add("vera", vera)
+	registry.Add("influxdb", &fakeControl{status: consumer.Status{RetryingSince: retryingSince}})
+	handler := registry.Handler(nil)
+
+	statuses := make([]admin.Status, 0)
+	assert.Equal(t, http.StatusOK, request(t, handler, "GET", "/subsystems", "", &statuses))
+	assert.Equal(t, []admin.Status{
+		{Name: "influxdb", RetryingSince: &retryingSince},
+		{Name: "vera", Active: true, Pausable: true},
+	}, statuses)
+
+	status := admin.Status{}
+	assert.Equal(t, http.StatusOK, request(t, handler, "POST", "/subsystems/vera/pause", "", &status))
+	assert.Equal(t, admin.Status{Name: "vera", Active: true, Paused: true, Pausable: true}, status)
+	assert.True(t, vera.status.Paused)
+
+	assert.Equal(t, http.StatusOK, request(t, handler, "GET", "/subsystems/vera", "", &status))
+	assert.True(t, status.Paused)
+
+	assert.Equal(t, http.StatusOK, request(t, handler, "POST", "/subsystems/vera/resume", "", &status))
+	assert.False(t, status.Paused)
+	assert.False(t, vera.status.Paused)
+
+	errorBody := admin.Error{}
+	assert.Equal(t, http.StatusNotFound, request(t, handler, "POST", "/subsystems/nora/pause", "", &errorBody))
+	assert.Equal(t, "subsystem 'nora' does not exist", errorBody.Error)
+
+	assert.Equal(t, http.StatusNotFound, request(t, handler, "GET", "/subsystems/vera/pause", "", &errorBody))
+
+	registry.Add("slack", &fakeControl{pauseErr: consumer.ErrPauseUnsupported})
+	assert.Equal(t, http.StatusConflict, request(t, handler, "POST", "/subsystems/slack/pause", "", &errorBody))
+	assert.Equal(t, consumer.ErrPauseUnsupported.Error(), errorBody.Error)
+}
+
+func TestHistory(t *testing.T) {
+	registry := admin.NewRegistry(3)
+	registry.Add("vera", &fakeControl{})
+	handler := registry.Handler(nil)
+
+	for offset := int64(0); offset < 5; offset++ {
+		entry := admin.Entry{Offset: offset, Status: "ok"}
+		if offset%2 == 1 {
+			entry.Status = "retry"
+			entry.Error = fmt.Sprintf("error %d", offset)
+		}
+		registry.Record("vera", entry)
+	}
+	registry.Record("unknown", admin.Entry{Offset: 6})
+
+	offsets := func(entries []admin.Entry) []int64 {
+		result := make([]int64, 0, len(entries))
+		for _, entry := range entries {
+			result = append(result, entry.Offset)
+		}
+		return result
+	}
+
+	entries := make([]admin.Entry, 0)
+	assert.Equal(t, http.StatusOK, request(t, handler, "GET", "/subsystems/vera/events", "", &entries))
+	assert.Equal(t, []int64{4, 3, 2}, offsets(entries))
+
+	assert.Equal(t, http.StatusOK, request(t, handler, "GET", "/subsystems/vera/errors", "", &entries))
+	assert.Equal(t, []int64{3, 1}, offsets(entries))
+	assert.Equal(t, "error 3", entries[0].Error)
+}
+
+func TestPayloads(t *testing.T) {
+	registry := admin.NewRegistry(3)
+	registry.Add("vera", &fakeControl{})
+	handler := registry.Handler(nil)
+
+	registry.Record("vera", admin.Entry{Offset: 1, Status: "ok"})
+	registry.Record("vera", admin.Entry{Offset: 2, Status: "skipped", Destination: "POST vera.example.com", Payload: `{"application":"app"}`})
+
+	entries := make([]admin.Entry, 0)
+	assert.Equal(t, http.StatusOK, request(t, handler, "GET", "/subsystems/vera/payloads", "", &entries))
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, "POST vera.example.com", entries[0].Destination)
+		assert.Equal(t, `{"application":"app"}`, entries[0].Payload)
+	}
+
+	assert.Equal(t, http.StatusOK, request(t, handler, "GET", "/subsystems/vera/events", "", &entries))
+	assert.Len(t, entries, 2)
+}
+
+func TestRecordRedactsSecrets(t *testing.T) {
+	secret.Register("admin-test-secret")
+	registry := admin.NewRegistry(3)
+	registry.Add("webhook", &fakeControl{})
+	handler := registry.Handler(nil)
+
+	registry.Record("webhook", admin.Entry{
+		Offset:  1,
+		Status:  "skipped",
+		Error:   "dry run; token admin-test-secret",
+		Payload: `{"token":"admin-test-secret"}`,
+	})
+
+	entries := make([]admin.Entry, 0)
+	assert.Equal(t, http.StatusOK, request(t, handler, "GET", "/subsystems/webhook/payloads", "", &entries))
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, "dry run; token "+secret.Redacted, entries[0].Error)
+		assert.Equal(t, `{"token":"`+secret.Redacted+`"}`, entries[0].Payload)
+	}
+}
+
+func TestAuthentication(t *testing.T) {
+	registry := admin.NewRegistry(1)
+	handler := registry.Handler(secret.Static("s3cret"))
+
+	assert.Equal(t, http.StatusUnauthorized, request(t, handler, "GET", "/subsystems", "", nil))
+	assert.Equal(t, http.StatusUnauthorized, request(t, handler, "GET", "/subsystems", "wrong", nil))
+	assert.Equal(t, http.StatusOK, request(t, handler, "GET", "/subsystems", "s3cret", nil))
+}
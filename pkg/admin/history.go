@@ -0,0 +1,50 @@
+package admin
+
+import (
+	"sync"
+)
+
+// history keeps the most recent entries, up to a fixed number.
+type history struct {
+	lock    sync.Mutex
+	entries []Entry
+	next    int
+	full    bool
+}
+
+func newHistory(size int) *history {
+	return &history{
+		entries: make([]Entry, size),
+	}
+}
+
+func (h *history) add(entry Entry) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if len(h.entries) == 0 {
+		return
+	}
+	h.entries[h.next] = entry
+	h.next = (h.next + 1) % len(h.entries)
+	if h.next == 0 {
+		h.full = true
+	}
+}
+
+// list returns the entries, newest first.
+func (h *history) list() []Entry {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	count := h.next
+	if h.full {
+		count = len(h.entries)
+	}
+	result := make([]Entry, 0, count)
+	for i := 1; i <= count; i++ {
+		index := (h.next - i + len(h.entries)) % len(h.entries)
+		result = append(result, h.entries[index])
+	}
+	return result
+}
@@ -5,7 +5,9 @@ import (
 	"math/rand"
 	"os"
 	"strconv"
+	"time"
 
+	"github.com/navikt/deployment-event-relays/pkg/filter"
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 )
@@ -14,27 +16,100 @@ type Metrics struct {
 	BindAddress string `json:"bind-address"`
 }
 
+type Health struct {
+	StuckThreshold time.Duration `json:"stuck-threshold"`
+}
+
+// Admin configures the HTTP API for inspecting, pausing and resuming subsystems.
+// The API is disabled unless a bind address is given.
+type Admin struct {
+	BindAddress string `json:"bind-address"`
+	Token       string `json:"token" secret:"true"`
+	TokenFile   string `json:"token-file"`
+	HistorySize int    `json:"history-size"`
+}
+
+type Secrets struct {
+	ReloadInterval time.Duration `json:"reload-interval"`
+}
+
 type Log struct {
 	Format    string `json:"format"`
 	Verbosity string `json:"verbosity"`
 }
 
-type InfluxDB struct {
-	URL      string `json:"url"`
-	Username string `json:"username"`
-	Password string `json:"password"`
+type Retry struct {
+	MaxAttempts    int           `json:"max-attempts"`
+	InitialBackoff time.Duration `json:"initial-backoff"`
+	MaxBackoff     time.Duration `json:"max-backoff"`
+	Multiplier     float64       `json:"multiplier"`
+	Jitter         float64       `json:"jitter"`
+	Fallback       string        `json:"fallback"`
+}
+
+// Filter is a rule that events must match to be processed by a subsystem.
+// Exactly one of Equals, Regex or In must be set.
+type Filter struct {
+	Key    string   `json:"key"`
+	Equals string   `json:"equals"`
+	Regex  string   `json:"regex"`
+	In     []string `json:"in"`
+	Not    bool     `json:"not"`
+}
+
+// Rule converts the filter to a rule of the filter package.
+func (f Filter) Rule() filter.Rule {
+	return filter.Rule{
+		Key:    f.Key,
+		Equals: f.Equals,
+		Regex:  f.Regex,
+		In:     f.In,
+		Not:    f.Not,
+	}
+}
+
+// Subsystem holds the settings shared by all relay types.
+// Relay settings embed it with `json:",squash"`, so that these settings appear in the relay's own section.
+type Subsystem struct {
+	DeadLetterTopic string        `json:"dead-letter-topic"`
+	Retry           Retry         `json:"retry"`
+	Timeout         time.Duration `json:"timeout"`
+	Filters         []Filter      `json:"filters"`
+	// DryRun builds the payload of every event without sending it.
+	DryRun bool `json:"dry-run"`
+}
+
+// Common returns the shared settings. It makes every type that embeds Subsystem implement part of Settings.
+func (s Subsystem) Common() Subsystem {
+	return s
 }
 
-type Vera struct {
-	URL string `json:"url"`
+// Settings are the settings of a relay type. Relay types and their settings are registered in pkg/relay.
+type Settings interface {
+	// Enabled reports whether a top-level section enables its relay. Relay instances are always enabled.
+	Enabled() bool
+	// Validate reports errors in the settings that are specific to the relay type, prefixed with key.
+	Validate(v *Validator, key string)
+	// Common returns the settings shared by all relay types.
+	Common() Subsystem
 }
 
-type Nora struct {
-	URL string `json:"url"`
+// Relay is a named instance of a relay type, with its settings in a section named after the type.
+// The name is used as the subsystem in metrics and logs, and, unless GroupSuffix is set,
+// as the suffix of the Kafka consumer group ID.
+type Relay struct {
+	Name        string `json:"name"`
+	Type        string `json:"type"`
+	GroupSuffix string `json:"group-suffix"`
+	// Sections holds the settings section of the relay type, as read by Load.
+	// It is decoded into the Settings of the relay type by pkg/relay.
+	Sections map[string]interface{} `json:",remain"`
 }
 
-type Null struct {
-	Enabled bool `json:"enabled"`
+// Settings returns the decoded settings of the relay instance, or nil if they have not been decoded.
+func (r Relay) Settings() Settings {
+	settings, _ := r.Sections[r.Type].(Settings)
+	return settings
 }
 
 type KafkaTLS struct {
@@ -43,21 +118,45 @@ type KafkaTLS struct {
 	PrivateKeyPath  string `json:"private-key-path"`
 }
 
+// FanOut configures a single consumer group that decodes each event once and dispatches it to all subsystems.
+// The group suffix of each subsystem is ignored in this mode.
+//
+// When the shared group is first created, it continues from the lowest offset committed by the per-subsystem groups
+// of the enabled subsystems, so no events are lost when switching modes. Subsystems that were ahead of the others
+// relay some events again.
+type FanOut struct {
+	Enabled     bool   `json:"enabled"`
+	GroupSuffix string `json:"group-suffix"`
+	QueueSize   int    `json:"queue-size"`
+}
+
 type Kafka struct {
 	Brokers       []string `json:"brokers"`
 	TLS           KafkaTLS `json:"tls"`
 	Topic         string   `json:"topic"`
 	GroupIDPrefix string   `json:"group-id-prefix"`
+	FanOut        FanOut   `json:"fan-out"`
+	// Workers is the number of events processed concurrently for each partition and subsystem.
+	// Events for the same application are always processed in order.
+	Workers int `json:"workers"`
 }
 
 type Config struct {
-	Metrics  Metrics  `json:"metrics"`
-	Log      Log      `json:"log"`
-	InfluxDB InfluxDB `json:"influxdb"`
-	Nora     Nora     `json:"nora"`
-	Vera     Vera     `json:"vera"`
-	Null     Null     `json:"null"`
-	Kafka    Kafka    `json:"kafka"`
+	ConfigFile  string  `json:"config-file"`
+	PrintConfig bool    `json:"print-config"`
+	Metrics     Metrics `json:"metrics"`
+	Health      Health  `json:"health"`
+	Admin       Admin   `json:"admin"`
+	Secrets     Secrets `json:"secrets"`
+	Log         Log     `json:"log"`
+	// Sections holds the top-level sections of the relay types, such as "influxdb", as read by Load.
+	// They are decoded by pkg/relay into Settings, or a map of named Settings for types configured that way.
+	Sections        map[string]interface{} `json:",remain"`
+	Relays          []Relay                `json:"relays"`
+	Kafka           Kafka                  `json:"kafka"`
+	ShutdownTimeout time.Duration          `json:"shutdown-timeout"`
+	// DryRun builds the payload of every event without sending it, for all subsystems.
+	DryRun bool `json:"dry-run"`
 }
 
 func DefaultConfig() *Config {
@@ -69,34 +168,100 @@ func DefaultConfig() *Config {
 		Metrics: Metrics{
 			BindAddress: "127.0.0.1:8080",
 		},
+		Health: Health{
+			StuckThreshold: 15 * time.Minute,
+		},
+		Admin: Admin{
+			HistorySize: 50,
+		},
+		Secrets: Secrets{
+			ReloadInterval: time.Minute,
+		},
 		Kafka: Kafka{
 			GroupIDPrefix: defaultGroupIDPrefix(),
+			FanOut: FanOut{
+				GroupSuffix: "fan-out",
+				QueueSize:   100,
+			},
+			Workers: 1,
+		},
+		Sections:        make(map[string]interface{}),
+		ShutdownTimeout: time.Second * 20,
+	}
+}
+
+// DefaultSubsystem returns the default shared settings of a relay type.
+func DefaultSubsystem() Subsystem {
+	return Subsystem{
+		Retry: Retry{
+			MaxAttempts:    0,
+			InitialBackoff: time.Second,
+			MaxBackoff:     time.Second * 30,
+			Multiplier:     2,
+			Jitter:         0.2,
+			Fallback:       "block",
 		},
+		Timeout: time.Second * 10,
+	}
+}
+
+// ApplyDefaults fills in default values that depend on other settings, and are only known after the configuration has been loaded.
+func ApplyDefaults(cfg *Config) {
+	for i := range cfg.Relays {
+		relay := &cfg.Relays[i]
+		if len(relay.GroupSuffix) == 0 {
+			relay.GroupSuffix = relay.Name
+		}
 	}
 }
 
 func BindFlags(cfg *Config) {
-	pflag.StringSliceVar(&cfg.Kafka.Brokers, "kafka.brokers", cfg.Kafka.Brokers, "")
-	pflag.StringVar(&cfg.Kafka.Topic, "kafka.topic", cfg.Kafka.Topic, "")
-	pflag.StringVar(&cfg.Kafka.GroupIDPrefix, "kafka.group-id-prefix", cfg.Kafka.GroupIDPrefix, "")
-	pflag.StringVar(&cfg.Kafka.TLS.CAPath, "kafka.tls.ca-path", cfg.Kafka.TLS.CAPath, "")
-	pflag.StringVar(&cfg.Kafka.TLS.CertificatePath, "kafka.tls.certificate-path", cfg.Kafka.TLS.CAPath, "")
-	pflag.StringVar(&cfg.Kafka.TLS.PrivateKeyPath, "kafka.tls.private-key-path", cfg.Kafka.TLS.PrivateKeyPath, "")
+	pflag.StringVar(&cfg.ConfigFile, "config-file", cfg.ConfigFile, "Path to a YAML or JSON configuration file. Defaults to DER.yaml in the working directory or /etc, if present")
+	pflag.BoolVar(&cfg.PrintConfig, "print-config", cfg.PrintConfig, "Print the effective configuration, with secrets redacted, and exit")
+	pflag.BoolVar(&cfg.DryRun, "dry-run", cfg.DryRun, "Log the payload that every subsystem would send, instead of sending it")
 
-	pflag.StringVar(&cfg.Log.Format, "log.format", cfg.Log.Format, "")
-	pflag.StringVar(&cfg.Log.Verbosity, "log.verbosity", cfg.Log.Verbosity, "")
+	pflag.StringSliceVar(&cfg.Kafka.Brokers, "kafka.brokers", cfg.Kafka.Brokers, "Comma-separated list of Kafka brokers")
+	pflag.StringVar(&cfg.Kafka.Topic, "kafka.topic", cfg.Kafka.Topic, "Kafka topic with deployment events")
+	pflag.StringVar(&cfg.Kafka.GroupIDPrefix, "kafka.group-id-prefix", cfg.Kafka.GroupIDPrefix, "Prefix of the consumer group ID of each subsystem")
+	pflag.StringVar(&cfg.Kafka.TLS.CAPath, "kafka.tls.ca-path", cfg.Kafka.TLS.CAPath, "Path to the CA certificate of the Kafka brokers")
+	pflag.StringVar(&cfg.Kafka.TLS.CertificatePath, "kafka.tls.certificate-path", cfg.Kafka.TLS.CertificatePath, "Path to the Kafka client certificate")
+	pflag.StringVar(&cfg.Kafka.TLS.PrivateKeyPath, "kafka.tls.private-key-path", cfg.Kafka.TLS.PrivateKeyPath, "Path to the private key of the Kafka client certificate")
+	pflag.IntVar(&cfg.Kafka.Workers, "kafka.workers", cfg.Kafka.Workers, "Number of events processed concurrently for each partition and subsystem. Events for the same application and namespace are always processed in order")
+	pflag.BoolVar(&cfg.Kafka.FanOut.Enabled, "kafka.fan-out.enabled", cfg.Kafka.FanOut.Enabled, "Consume events with a single consumer group shared by all subsystems, instead of one group per subsystem. A new shared group continues from the lowest offset committed by the per-subsystem groups, so subsystems that were ahead relay some events again")
+	pflag.StringVar(&cfg.Kafka.FanOut.GroupSuffix, "kafka.fan-out.group-suffix", cfg.Kafka.FanOut.GroupSuffix, "Suffix of the consumer group ID shared by all subsystems in fan-out mode")
+	pflag.IntVar(&cfg.Kafka.FanOut.QueueSize, "kafka.fan-out.queue-size", cfg.Kafka.FanOut.QueueSize, "Number of events each subsystem may fall behind in fan-out mode before consumption is paused")
 
-	pflag.StringVar(&cfg.InfluxDB.URL, "influxdb.url", cfg.InfluxDB.URL, "")
-	pflag.StringVar(&cfg.InfluxDB.Username, "influxdb.username", cfg.InfluxDB.Username, "")
-	pflag.StringVar(&cfg.InfluxDB.Password, "influxdb.password", cfg.InfluxDB.Password, "")
+	pflag.StringVar(&cfg.Log.Format, "log.format", cfg.Log.Format, "Log format, either 'text' or 'json'")
+	pflag.StringVar(&cfg.Log.Verbosity, "log.verbosity", cfg.Log.Verbosity, "Log level: trace, debug, info, warning or error")
 
-	pflag.StringVar(&cfg.Vera.URL, "vera.url", cfg.Vera.URL, "")
+	pflag.StringVar(&cfg.Metrics.BindAddress, "metrics.bind-address", cfg.Metrics.BindAddress, "Address to serve metrics and health checks on")
+	pflag.DurationVar(&cfg.Health.StuckThreshold, "health.stuck-threshold", cfg.Health.StuckThreshold, "Report as not alive when a message has been retried for this long. Zero to disable")
 
-	pflag.StringVar(&cfg.Nora.URL, "nora.url", cfg.Nora.URL, "")
+	pflag.StringVar(&cfg.Admin.BindAddress, "admin.bind-address", cfg.Admin.BindAddress, "Address to serve the admin API on. Disabled if empty")
+	pflag.StringVar(&cfg.Admin.Token, "admin.token", cfg.Admin.Token, "Bearer token required by the admin API. No authentication if empty")
+	pflag.StringVar(&cfg.Admin.TokenFile, "admin.token-file", cfg.Admin.TokenFile, "Path to a file with the bearer token required by the admin API, used instead of --admin.token")
+	pflag.IntVar(&cfg.Admin.HistorySize, "admin.history-size", cfg.Admin.HistorySize, "Number of recent events and errors kept per subsystem for the admin API")
 
-	pflag.BoolVar(&cfg.Null.Enabled, "null.enabled", cfg.Null.Enabled, "")
+	pflag.DurationVar(&cfg.Secrets.ReloadInterval, "secrets.reload-interval", cfg.Secrets.ReloadInterval, "How often secrets are read again from their files")
+
+	pflag.DurationVar(&cfg.ShutdownTimeout, "shutdown-timeout", cfg.ShutdownTimeout, "Time allowed for in-flight events to finish on shutdown")
+}
+
+// BindSubsystemFlags binds the settings shared by all relay types, for the top-level section of a relay type.
+func BindSubsystemFlags(subsystem *Subsystem, prefix string) {
+	pflag.StringVar(&subsystem.DeadLetterTopic, prefix+".dead-letter-topic", subsystem.DeadLetterTopic, "Kafka topic for events that are rejected by "+prefix)
+	bindRetryFlags(&subsystem.Retry, prefix+".retry")
+	pflag.DurationVar(&subsystem.Timeout, prefix+".timeout", subsystem.Timeout, "Deadline for delivering a single event to "+prefix)
+	pflag.BoolVar(&subsystem.DryRun, prefix+".dry-run", subsystem.DryRun, "Log the payload that "+prefix+" would send, instead of sending it")
+}
 
-	pflag.StringVar(&cfg.Metrics.BindAddress, "metrics.bind-address", cfg.Metrics.BindAddress, "")
+func bindRetryFlags(retry *Retry, prefix string) {
+	pflag.IntVar(&retry.MaxAttempts, prefix+".max-attempts", retry.MaxAttempts, "Maximum number of attempts per event. Zero for unlimited")
+	pflag.DurationVar(&retry.InitialBackoff, prefix+".initial-backoff", retry.InitialBackoff, "Delay before the first retry")
+	pflag.DurationVar(&retry.MaxBackoff, prefix+".max-backoff", retry.MaxBackoff, "Maximum delay between retries")
+	pflag.Float64Var(&retry.Multiplier, prefix+".multiplier", retry.Multiplier, "Factor applied to the delay after each retry")
+	pflag.Float64Var(&retry.Jitter, prefix+".jitter", retry.Jitter, "Random fraction, between 0 and 1, by which each delay is varied")
+	pflag.StringVar(&retry.Fallback, prefix+".fallback", retry.Fallback, "What to do when retries are exhausted: block, drop or dead-letter")
 }
 
 func BindNAIS() {
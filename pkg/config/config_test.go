@@ -0,0 +1,80 @@
+package config_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/navikt/deployment-event-relays/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+// testSettings stands in for the settings of a relay type.
+type testSettings struct {
+	URL              string            `json:"url"`
+	Token            string            `json:"token" secret:"true"`
+	TokenFile        string            `json:"token-file"`
+	Headers          map[string]string `json:"headers" secret:"true"`
+	Tags             []string          `json:"tags"`
+	config.Subsystem `json:",squash"`
+}
+
+func (s *testSettings) Enabled() bool {
+	return len(s.URL) > 0
+}
+
+func (s *testSettings) Validate(v *config.Validator, key string) {
+	v.URL(key+".url", s.URL)
+	v.Secret(key+".token", s.Token, s.TokenFile)
+}
+
+func defaultTestSettings() *testSettings {
+	return &testSettings{
+		Tags:      []string{"application", "team"},
+		Subsystem: config.DefaultSubsystem(),
+	}
+}
+
+func TestDecode(t *testing.T) {
+	settings := defaultTestSettings()
+	err := config.Decode("test", map[string]interface{}{
+		"url":     "http://example.com",
+		"tags":    []interface{}{"cluster"},
+		"timeout": "3s",
+		"retry": map[string]interface{}{
+			"fallback": "drop",
+		},
+	}, settings)
+	assert.NoError(t, err)
+
+	assert.Equal(t, "http://example.com", settings.URL)
+	assert.Equal(t, []string{"cluster"}, settings.Tags)
+	assert.Equal(t, 3*time.Second, settings.Timeout)
+	assert.Equal(t, "drop", settings.Retry.Fallback)
+	assert.Equal(t, config.DefaultSubsystem().Retry.MaxBackoff, settings.Retry.MaxBackoff)
+
+	err = config.Decode("test", map[string]interface{}{
+		"bogus": true,
+		"retry": map[string]interface{}{
+			"fallbak": "drop",
+		},
+	}, defaultTestSettings())
+	assert.EqualError(t, err, "test.bogus: unknown key\ntest.retry.fallbak: unknown key")
+
+	err = config.Decode("test", map[string]interface{}{"timeout": "soon"}, defaultTestSettings())
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "test: error decoding 'timeout'")
+	}
+}
+
+func TestApplyDefaultsToRelays(t *testing.T) {
+	cfg := config.DefaultConfig()
+	cfg.Relays = []config.Relay{
+		{Name: "influxdb-dev", Type: "influxdb"},
+		{Name: "vera-dev", Type: "vera", GroupSuffix: "vera-development"},
+	}
+
+	config.ApplyDefaults(cfg)
+
+	assert.Equal(t, "influxdb-dev", cfg.Relays[0].GroupSuffix)
+	assert.Equal(t, "vera-development", cfg.Relays[1].GroupSuffix)
+}
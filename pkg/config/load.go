@@ -0,0 +1,105 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/mitchellh/mapstructure"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// Load reads the configuration file, environment variables and command-line flags into cfg,
+// in increasing order of precedence. Flags must be bound to pflag.CommandLine and parsed,
+// and conftools initialized beforehand.
+//
+// The configuration file is either given with --config-file, or DER.yaml in the working directory or /etc.
+// An explicitly given file must exist, and keys that are not part of the configuration are rejected.
+// Relay sections are read as they are, and must be decoded by pkg/relay.
+func Load(cfg *Config) error {
+	err := viper.BindPFlags(pflag.CommandLine)
+	if err != nil {
+		return err
+	}
+
+	path := viper.GetString("config-file")
+	if len(path) > 0 {
+		viper.SetConfigFile(path)
+	}
+
+	err = viper.ReadInConfig()
+	if err != nil {
+		var notFound viper.ConfigFileNotFoundError
+		if len(path) > 0 || !errors.As(err, &notFound) {
+			return fmt.Errorf("read configuration file: %w", err)
+		}
+	}
+
+	err = Decode("", viper.AllSettings(), cfg)
+	if err != nil {
+		return fmt.Errorf("parse configuration: %w", err)
+	}
+
+	return nil
+}
+
+// Decode decodes settings as read by Load into output, such as the settings of a relay type.
+// Key is the dotted path of the settings in the configuration, and prefixes each error.
+//
+// Durations and lists may be given as strings, and unknown keys are rejected.
+// All errors are returned together, like those of Validate.
+// Lists and maps that are given replace any default values in output, instead of being merged with them.
+func Decode(key string, input interface{}, output interface{}) error {
+	metadata := &mapstructure.Metadata{}
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		DecodeHook: mapstructure.ComposeDecodeHookFunc(
+			mapstructure.StringToTimeDurationHookFunc(),
+			mapstructure.StringToSliceHookFunc(","),
+		),
+		Metadata:         metadata,
+		ZeroFields:       true,
+		WeaklyTypedInput: true,
+		TagName:          "json",
+		Result:           output,
+	})
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	err = decoder.Decode(input)
+	var decodeErr *mapstructure.Error
+	if errors.As(err, &decodeErr) {
+		for _, message := range decodeErr.Errors {
+			errs = append(errs, keyError(key, message))
+		}
+	} else if err != nil {
+		errs = append(errs, keyError(key, err.Error()))
+	}
+	sort.Strings(metadata.Unused)
+	for _, unused := range metadata.Unused {
+		errs = append(errs, UnknownKey(JoinKey(key, unused)))
+	}
+	return errors.Join(errs...)
+}
+
+// UnknownKey returns the error for a key that is not part of the configuration.
+func UnknownKey(key string) error {
+	return fmt.Errorf("%s: unknown key", key)
+}
+
+// JoinKey returns the dotted path of a setting within the settings at key.
+func JoinKey(key, name string) string {
+	if len(key) == 0 {
+		return name
+	}
+	return key + "." + name
+}
+
+func keyError(key, message string) error {
+	if len(key) == 0 {
+		return errors.New(message)
+	}
+	return fmt.Errorf("%s: %s", key, message)
+}
@@ -0,0 +1,115 @@
+package config
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/navikt/deployment-event-relays/pkg/secret"
+	"gopkg.in/yaml.v3"
+)
+
+// Redacted replaces the value of settings tagged as secret when the configuration is printed.
+const Redacted = secret.Redacted
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// Print writes the configuration to w as YAML, in the same format as the configuration file.
+// Fields tagged with `secret:"true"` are replaced by Redacted; for maps, only the values are redacted.
+func Print(w io.Writer, cfg *Config) error {
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+	err := encoder.Encode(node(reflect.ValueOf(*cfg), false))
+	if err != nil {
+		return err
+	}
+	return encoder.Close()
+}
+
+func scalar(value string, tag string) *yaml.Node {
+	return &yaml.Node{Kind: yaml.ScalarNode, Tag: tag, Value: value}
+}
+
+// node converts a configuration value into a YAML node, keeping the field order of structs.
+func node(v reflect.Value, redact bool) *yaml.Node {
+	if v.Type() == durationType {
+		return scalar(time.Duration(v.Int()).String(), "!!str")
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return scalar("", "!!null")
+		}
+		return node(v.Elem(), redact)
+
+	case reflect.Struct:
+		n := &yaml.Node{Kind: yaml.MappingNode}
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Type().Field(i)
+			tag := strings.Split(field.Tag.Get("json"), ",")
+			if tag[0] == "-" {
+				continue
+			}
+			child := node(v.Field(i), redact || field.Tag.Get("secret") == "true")
+			// Embedded settings and relay sections are printed as part of the surrounding struct,
+			// as they are given in the configuration file.
+			if len(tag[0]) == 0 && child.Kind == yaml.MappingNode {
+				n.Content = append(n.Content, child.Content...)
+				continue
+			}
+			if len(tag[0]) == 0 {
+				continue
+			}
+			n.Content = append(n.Content, scalar(tag[0], "!!str"), child)
+		}
+		return n
+
+	case reflect.Map:
+		n := &yaml.Node{Kind: yaml.MappingNode}
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool {
+			return keys[i].String() < keys[j].String()
+		})
+		for _, key := range keys {
+			n.Content = append(n.Content, scalar(key.String(), "!!str"), node(v.MapIndex(key), redact))
+		}
+		return n
+
+	case reflect.Slice:
+		n := &yaml.Node{Kind: yaml.SequenceNode, Style: yaml.FlowStyle}
+		for i := 0; i < v.Len(); i++ {
+			item := node(v.Index(i), redact)
+			if item.Kind != yaml.ScalarNode {
+				n.Style = 0
+			}
+			n.Content = append(n.Content, item)
+		}
+		return n
+
+	case reflect.String:
+		if redact && v.Len() > 0 {
+			return scalar(Redacted, "!!str")
+		}
+		return scalar(v.String(), "!!str")
+
+	case reflect.Bool:
+		return scalar(strconv.FormatBool(v.Bool()), "!!bool")
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return scalar(strconv.FormatInt(v.Int(), 10), "!!int")
+
+	case reflect.Float32, reflect.Float64:
+		value := strconv.FormatFloat(v.Float(), 'g', -1, 64)
+		if !strings.ContainsAny(value, ".eIN") {
+			value += ".0"
+		}
+		return scalar(value, "!!float")
+	}
+
+	return scalar(fmt.Sprint(v.Interface()), "!!str")
+}
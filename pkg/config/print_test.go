@@ -0,0 +1,35 @@
+package config_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/navikt/deployment-event-relays/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrintRedactsSecrets(t *testing.T) {
+	cfg := validConfig()
+	settings := cfg.Sections["test"].(*testSettings)
+	settings.URL = "https://example.com"
+	settings.Token = "test-token"
+	cfg.Relays = []config.Relay{
+		testRelay("relay", &testSettings{
+			URL:     "https://relay.example.com",
+			Headers: map[string]string{"authorization": "Bearer relay-token"},
+		}),
+	}
+	config.ApplyDefaults(cfg)
+
+	buf := &bytes.Buffer{}
+	err := config.Print(buf, cfg)
+	assert.NoError(t, err)
+
+	output := buf.String()
+	assert.NotContains(t, output, "test-token")
+	assert.NotContains(t, output, "relay-token")
+	assert.Contains(t, output, "\ntest:\n  url: https://example.com\n  token: '"+config.Redacted+"'\n")
+	assert.Contains(t, output, "      authorization: '"+config.Redacted+"'\n")
+	assert.Contains(t, output, "\n  retry:\n    max-attempts: 0\n    initial-backoff: 1s\n")
+	assert.Contains(t, output, "\n  - name: relay\n    type: test\n    group-suffix: relay\n    test:\n      url: https://relay.example.com\n")
+}
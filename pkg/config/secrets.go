@@ -0,0 +1,38 @@
+package config
+
+import (
+	"reflect"
+
+	"github.com/navikt/deployment-event-relays/pkg/secret"
+)
+
+// RegisterSecrets marks the values of all settings tagged with `secret:"true"` as secret,
+// so that they are redacted from logs. Secrets read from files are registered when they are loaded.
+func RegisterSecrets(cfg *Config) {
+	registerSecrets(reflect.ValueOf(*cfg), false)
+}
+
+func registerSecrets(v reflect.Value, redact bool) {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if !v.IsNil() {
+			registerSecrets(v.Elem(), redact)
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			registerSecrets(v.Field(i), redact || v.Type().Field(i).Tag.Get("secret") == "true")
+		}
+	case reflect.Map:
+		for _, key := range v.MapKeys() {
+			registerSecrets(v.MapIndex(key), redact)
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			registerSecrets(v.Index(i), redact)
+		}
+	case reflect.String:
+		if redact {
+			secret.Register(v.String())
+		}
+	}
+}
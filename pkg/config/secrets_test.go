@@ -0,0 +1,27 @@
+package config_test
+
+import (
+	"testing"
+
+	"github.com/navikt/deployment-event-relays/pkg/config"
+	"github.com/navikt/deployment-event-relays/pkg/secret"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegisterSecrets(t *testing.T) {
+	cfg := validConfig()
+	settings := cfg.Sections["test"].(*testSettings)
+	settings.URL = "https://registered-url.example.com"
+	settings.Token = "registered-token"
+	cfg.Relays = []config.Relay{
+		testRelay("relay", &testSettings{
+			Headers: map[string]string{"authorization": "Bearer registered-header"},
+		}),
+	}
+
+	config.RegisterSecrets(cfg)
+
+	assert.Equal(t, "https://registered-url.example.com", secret.Redact("https://registered-url.example.com"))
+	assert.Equal(t, secret.Redacted, secret.Redact("registered-token"))
+	assert.Equal(t, "authorization: "+secret.Redacted, secret.Redact("authorization: Bearer registered-header"))
+}
@@ -0,0 +1,189 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/navikt/deployment-event-relays/pkg/filter"
+)
+
+// Validator collects configuration errors, each prefixed with the key of the offending setting.
+type Validator struct {
+	errs []error
+}
+
+func (v *Validator) Errorf(key, format string, args ...interface{}) {
+	v.errs = append(v.errs, fmt.Errorf("%s: %s", key, fmt.Sprintf(format, args...)))
+}
+
+// Validate checks the configuration for errors that would otherwise only surface when an event is processed.
+// All errors are returned together. Relay sections must have been decoded by pkg/relay.
+func Validate(cfg *Config) error {
+	v := &Validator{}
+
+	if len(cfg.Kafka.Brokers) == 0 {
+		v.Errorf("kafka.brokers", "at least one broker is required")
+	}
+	if len(cfg.Kafka.Topic) == 0 {
+		v.Errorf("kafka.topic", "topic is required")
+	}
+	if cfg.Kafka.Workers < 1 {
+		v.Errorf("kafka.workers", "at least one worker is required")
+	}
+	if cfg.Kafka.FanOut.Enabled {
+		if len(cfg.Kafka.FanOut.GroupSuffix) == 0 {
+			v.Errorf("kafka.fan-out.group-suffix", "group suffix is required")
+		}
+		if cfg.Kafka.FanOut.QueueSize <= 0 {
+			v.Errorf("kafka.fan-out.queue-size", "must be greater than zero")
+		}
+	}
+	v.Secret("admin.token", cfg.Admin.Token, cfg.Admin.TokenFile)
+	if cfg.Admin.HistorySize < 0 {
+		v.Errorf("admin.history-size", "must be zero or greater")
+	}
+	if cfg.Health.StuckThreshold < 0 {
+		v.Errorf("health.stuck-threshold", "must be zero or greater")
+	}
+	if cfg.Secrets.ReloadInterval <= 0 {
+		v.Errorf("secrets.reload-interval", "must be greater than zero")
+	}
+	if cfg.ShutdownTimeout <= 0 {
+		v.Errorf("shutdown-timeout", "must be greater than zero")
+	}
+
+	keys := make([]string, 0, len(cfg.Sections))
+	for key := range cfg.Sections {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		switch section := cfg.Sections[key].(type) {
+		case Settings:
+			if section.Enabled() {
+				v.settings(key, section)
+			}
+		case map[string]Settings:
+			for name, settings := range section {
+				v.settings(key+"."+name, settings)
+			}
+		default:
+			v.Errorf(key, "settings have not been decoded")
+		}
+	}
+
+	names := make(map[string]bool)
+	for i, relay := range cfg.Relays {
+		key := fmt.Sprintf("relays[%d]", i)
+		if len(relay.Name) == 0 {
+			v.Errorf(key+".name", "name is required")
+		} else if names[relay.Name] {
+			v.Errorf(key+".name", "name '%s' is used by more than one relay", relay.Name)
+		}
+		names[relay.Name] = true
+
+		settings := relay.Settings()
+		if settings == nil {
+			v.Errorf(key+".type", "relay type '%s' is not supported", relay.Type)
+			continue
+		}
+		v.settings(key+"."+relay.Type, settings)
+	}
+
+	return errors.Join(v.errs...)
+}
+
+func (v *Validator) settings(key string, settings Settings) {
+	settings.Validate(v, key)
+	v.subsystem(key, settings.Common())
+}
+
+// subsystem validates the settings shared by all relay types.
+func (v *Validator) subsystem(key string, subsystem Subsystem) {
+	v.retry(key+".retry", subsystem.Retry)
+	if subsystem.Retry.Fallback == "dead-letter" && len(subsystem.DeadLetterTopic) == 0 {
+		v.Errorf(key+".dead-letter-topic", "topic is required when the retry fallback is 'dead-letter'")
+	}
+	v.filters(key+".filters", subsystem.Filters)
+}
+
+func (v *Validator) retry(key string, retry Retry) {
+	if retry.MaxAttempts < 0 {
+		v.Errorf(key+".max-attempts", "must be zero or greater")
+	}
+	if retry.InitialBackoff <= 0 {
+		v.Errorf(key+".initial-backoff", "must be greater than zero")
+	}
+	if retry.MaxBackoff < retry.InitialBackoff {
+		v.Errorf(key+".max-backoff", "must be greater than or equal to the initial backoff")
+	}
+	if retry.Multiplier < 1 {
+		v.Errorf(key+".multiplier", "must be greater than or equal to 1")
+	}
+	if retry.Jitter < 0 || retry.Jitter > 1 {
+		v.Errorf(key+".jitter", "must be between 0 and 1")
+	}
+	switch retry.Fallback {
+	case "block", "drop", "dead-letter":
+	default:
+		v.Errorf(key+".fallback", "fallback must be one of block, drop or dead-letter")
+	}
+}
+
+// filters checks the filters of a subsystem by compiling them, reporting each problem under the key of the filter.
+func (v *Validator) filters(key string, filters []Filter) {
+	rules := make([]filter.Rule, 0, len(filters))
+	for _, f := range filters {
+		rules = append(rules, f.Rule())
+	}
+	_, err := filter.New(rules)
+	if err == nil {
+		return
+	}
+	errs := []error{err}
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		errs = joined.Unwrap()
+	}
+	for _, err := range errs {
+		var ruleErr *filter.RuleError
+		if !errors.As(err, &ruleErr) {
+			v.Errorf(key, "%s", err)
+			continue
+		}
+		ruleKey := fmt.Sprintf("%s[%d]", key, ruleErr.Index)
+		if len(ruleErr.Field) > 0 {
+			ruleKey += "." + ruleErr.Field
+		}
+		v.Errorf(ruleKey, "%s", ruleErr.Err)
+	}
+}
+
+// Secret checks that a credential is given either directly or as a file, but not both.
+func (v *Validator) Secret(key string, value, path string) {
+	if len(value) > 0 && len(path) > 0 {
+		v.Errorf(key, "cannot be given together with %s-file", key[strings.LastIndex(key, ".")+1:])
+	}
+}
+
+// URL checks that a setting is an absolute HTTP or HTTPS URL.
+// The URL itself is left out of the error message, as it may contain secrets.
+func (v *Validator) URL(key string, value string) {
+	if len(value) == 0 {
+		v.Errorf(key, "URL is required")
+		return
+	}
+	u, err := url.Parse(value)
+	if err != nil {
+		v.Errorf(key, "URL cannot be parsed")
+		return
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		v.Errorf(key, "URL must use http or https")
+	}
+	if len(u.Host) == 0 {
+		v.Errorf(key, "URL must include a host")
+	}
+}
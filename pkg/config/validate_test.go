@@ -0,0 +1,155 @@
+package config_test
+
+import (
+	"testing"
+
+	"github.com/navikt/deployment-event-relays/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func validConfig() *config.Config {
+	cfg := config.DefaultConfig()
+	cfg.Kafka.Brokers = []string{"localhost:9092"}
+	cfg.Kafka.Topic = "deployment-events"
+	cfg.Sections["test"] = defaultTestSettings()
+	return cfg
+}
+
+func testRelay(name string, settings *testSettings) config.Relay {
+	return config.Relay{
+		Name:     name,
+		Type:     "test",
+		Sections: map[string]interface{}{"test": settings},
+	}
+}
+
+func TestValidateDefaults(t *testing.T) {
+	cfg := validConfig()
+	config.ApplyDefaults(cfg)
+	assert.NoError(t, config.Validate(cfg))
+}
+
+func TestValidate(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		modify   func(cfg *config.Config)
+		expected []string
+	}{
+		{
+			name: "missing kafka settings",
+			modify: func(cfg *config.Config) {
+				cfg.Kafka.Brokers = nil
+				cfg.Kafka.Topic = ""
+				cfg.Kafka.Workers = 0
+			},
+			expected: []string{
+				"kafka.brokers: at least one broker is required",
+				"kafka.topic: topic is required",
+				"kafka.workers: at least one worker is required",
+			},
+		},
+		{
+			name: "bad fan-out settings",
+			modify: func(cfg *config.Config) {
+				cfg.Kafka.FanOut.Enabled = true
+				cfg.Kafka.FanOut.GroupSuffix = ""
+				cfg.Kafka.FanOut.QueueSize = 0
+			},
+			expected: []string{
+				"kafka.fan-out.group-suffix: group suffix is required",
+				"kafka.fan-out.queue-size: must be greater than zero",
+			},
+		},
+		{
+			name: "bad admin settings",
+			modify: func(cfg *config.Config) {
+				cfg.Admin.Token = "token"
+				cfg.Admin.TokenFile = "/var/run/secrets/admin-token"
+				cfg.Admin.HistorySize = -1
+			},
+			expected: []string{
+				"admin.token: cannot be given together with token-file",
+				"admin.history-size: must be zero or greater",
+			},
+		},
+		{
+			name: "bad url",
+			modify: func(cfg *config.Config) {
+				cfg.Sections["test"].(*testSettings).URL = "example.com/api"
+				cfg.Relays = []config.Relay{
+					testRelay("ftp", &testSettings{URL: "ftp://example.com", Subsystem: config.DefaultSubsystem()}),
+				}
+			},
+			expected: []string{
+				"test.url: URL must use http or https",
+				"test.url: URL must include a host",
+				"relays[0].test.url: URL must use http or https",
+			},
+		},
+		{
+			name: "secret given twice",
+			modify: func(cfg *config.Config) {
+				settings := cfg.Sections["test"].(*testSettings)
+				settings.URL = "https://example.com"
+				settings.Token = "token"
+				settings.TokenFile = "/var/run/secrets/token"
+			},
+			expected: []string{
+				"test.token: cannot be given together with token-file",
+			},
+		},
+		{
+			name: "relay names",
+			modify: func(cfg *config.Config) {
+				relay := testRelay("test", &testSettings{URL: "http://example.com", Subsystem: config.DefaultSubsystem()})
+				cfg.Relays = []config.Relay{relay, relay, {Type: "carrier-pigeon"}}
+			},
+			expected: []string{
+				"relays[1].name: name 'test' is used by more than one relay",
+				"relays[2].name: name is required",
+				"relays[2].type: relay type 'carrier-pigeon' is not supported",
+			},
+		},
+		{
+			name: "retry and filters",
+			modify: func(cfg *config.Config) {
+				settings := cfg.Sections["test"].(*testSettings)
+				settings.URL = "https://example.com"
+				settings.Retry.Fallback = "dead-letter"
+				settings.Filters = []config.Filter{
+					{Key: "team", Equals: "aura", Regex: "aura"},
+					{Key: "team", Regex: "("},
+				}
+			},
+			expected: []string{
+				"test.dead-letter-topic: topic is required when the retry fallback is 'dead-letter'",
+				"test.filters[0]: exactly one of equals, regex or in is required",
+				"test.filters[1].regex: error parsing regexp: missing closing ): `(`",
+			},
+		},
+		{
+			name: "named instances",
+			modify: func(cfg *config.Config) {
+				cfg.Sections["tests"] = map[string]config.Settings{
+					"dashboard": &testSettings{Subsystem: config.DefaultSubsystem()},
+				}
+			},
+			expected: []string{
+				"tests.dashboard.url: URL is required",
+			},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := validConfig()
+			test.modify(cfg)
+			config.ApplyDefaults(cfg)
+			err := config.Validate(cfg)
+			if !assert.Error(t, err) {
+				return
+			}
+			for _, expected := range test.expected {
+				assert.Contains(t, err.Error(), expected)
+			}
+		})
+	}
+}
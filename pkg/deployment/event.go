@@ -42,3 +42,9 @@ func (m *Event) Flatten() map[string]string {
 func (m *Event) GetTimestampAsTime() time.Time {
 	return time.Unix(m.GetTimestamp().GetSeconds(), int64(m.GetTimestamp().GetNanos()))
 }
+
+// OrderingKey identifies the application that the event applies to.
+// Events with the same key must be relayed in the order they were produced.
+func (m *Event) OrderingKey() string {
+	return m.GetNamespace() + "/" + m.GetApplication()
+}
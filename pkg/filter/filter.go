@@ -0,0 +1,140 @@
+package filter
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/navikt/deployment-event-relays/pkg/deployment"
+)
+
+// Rule matches a single key of the flattened deployment event, as returned by Event.Flatten().
+// Exactly one of Equals, Regex or In must be set. Keys that are missing from the event have an empty value.
+type Rule struct {
+	Key string
+	// Equals matches the exact value.
+	Equals string
+	// Regex matches values containing a match of the regular expression. Use ^ and $ to match the whole value.
+	Regex string
+	// In matches any of the listed values.
+	In []string
+	// Not inverts the rule.
+	Not bool
+}
+
+func (r Rule) String() string {
+	var condition string
+	switch {
+	case len(r.Equals) > 0:
+		condition = fmt.Sprintf("%s equals %q", r.Key, r.Equals)
+	case len(r.Regex) > 0:
+		condition = fmt.Sprintf("%s matches %q", r.Key, r.Regex)
+	default:
+		condition = fmt.Sprintf("%s in [%s]", r.Key, strings.Join(r.In, ", "))
+	}
+	if r.Not {
+		return "not " + condition
+	}
+	return condition
+}
+
+type rule struct {
+	Rule
+	regex *regexp.Regexp
+}
+
+func (r rule) match(fields map[string]string) bool {
+	value := fields[r.Key]
+	var matched bool
+	switch {
+	case len(r.Equals) > 0:
+		matched = value == r.Equals
+	case r.regex != nil:
+		matched = r.regex.MatchString(value)
+	default:
+		for _, candidate := range r.In {
+			if value == candidate {
+				matched = true
+				break
+			}
+		}
+	}
+	return matched != r.Not
+}
+
+// Filter accepts events that match all of its rules. A nil or empty filter accepts all events.
+type Filter struct {
+	rules []rule
+}
+
+// RuleError is a problem with one of the rules passed to New.
+type RuleError struct {
+	// Index is the position of the rule, starting at zero.
+	Index int
+	// Field is the setting of the rule that is wrong, or empty if the problem is with the rule as a whole.
+	Field string
+	Err   error
+}
+
+func (e *RuleError) Error() string {
+	return fmt.Sprintf("rule %d: %s", e.Index+1, e.Err)
+}
+
+func (e *RuleError) Unwrap() error {
+	return e.Err
+}
+
+// New validates and compiles a set of rules.
+// Every problem is reported as a *RuleError, joined together with errors.Join.
+func New(rules []Rule) (*Filter, error) {
+	f := &Filter{
+		rules: make([]rule, 0, len(rules)),
+	}
+	var errs []error
+	for i, r := range rules {
+		if len(r.Key) == 0 {
+			errs = append(errs, &RuleError{Index: i, Field: "key", Err: fmt.Errorf("key is required")})
+		}
+		operators := 0
+		if len(r.Equals) > 0 {
+			operators++
+		}
+		if len(r.Regex) > 0 {
+			operators++
+		}
+		if len(r.In) > 0 {
+			operators++
+		}
+		if operators != 1 {
+			errs = append(errs, &RuleError{Index: i, Err: fmt.Errorf("exactly one of equals, regex or in is required")})
+		}
+		compiled := rule{Rule: r}
+		if len(r.Regex) > 0 {
+			regex, err := regexp.Compile(r.Regex)
+			if err != nil {
+				errs = append(errs, &RuleError{Index: i, Field: "regex", Err: err})
+			}
+			compiled.regex = regex
+		}
+		f.rules = append(f.rules, compiled)
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return f, nil
+}
+
+// Check returns nil if the event matches all rules, or an error naming the first rule that does not match.
+func (f *Filter) Check(event *deployment.Event) error {
+	if f == nil || len(f.rules) == 0 {
+		return nil
+	}
+	fields := event.Flatten()
+	for _, r := range f.rules {
+		if !r.match(fields) {
+			return fmt.Errorf("event does not match filter: %s", r)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package filter_test
+
+import (
+	"testing"
+
+	"github.com/navikt/deployment-event-relays/pkg/deployment"
+	"github.com/navikt/deployment-event-relays/pkg/filter"
+	"github.com/stretchr/testify/assert"
+)
+
+var event = &deployment.Event{
+	Application:   "app",
+	Team:          "aura",
+	Cluster:       "prod-gcp",
+	Environment:   deployment.Environment_production,
+	RolloutStatus: deployment.RolloutStatus_complete,
+}
+
+func TestFilterRules(t *testing.T) {
+	tests := []struct {
+		name  string
+		rule  filter.Rule
+		match bool
+	}{
+		{"equals", filter.Rule{Key: "team", Equals: "aura"}, true},
+		{"equals mismatch", filter.Rule{Key: "team", Equals: "other"}, false},
+		{"not equals", filter.Rule{Key: "team", Equals: "aura", Not: true}, false},
+		{"regex", filter.Rule{Key: "cluster", Regex: "^prod-"}, true},
+		{"regex mismatch", filter.Rule{Key: "cluster", Regex: "^dev-"}, false},
+		{"not regex", filter.Rule{Key: "cluster", Regex: "^dev-", Not: true}, true},
+		{"in", filter.Rule{Key: "application", In: []string{"foo", "app"}}, true},
+		{"in mismatch", filter.Rule{Key: "application", In: []string{"foo", "bar"}}, false},
+		{"missing key", filter.Rule{Key: "namespace", In: []string{""}}, true},
+		{"missing key not empty", filter.Rule{Key: "namespace", Regex: ".", Not: true}, true},
+	}
+
+	for _, test := range tests {
+		f, err := filter.New([]filter.Rule{test.rule})
+		assert.NoError(t, err, test.name)
+		err = f.Check(event)
+		if test.match {
+			assert.NoError(t, err, test.name)
+		} else {
+			assert.Error(t, err, test.name)
+		}
+	}
+}
+
+func TestFilterAllRulesMustMatch(t *testing.T) {
+	f, err := filter.New([]filter.Rule{
+		{Key: "environment", Equals: "production"},
+		{Key: "rollout_status", Equals: "initialized"},
+	})
+	assert.NoError(t, err)
+	assert.EqualError(t, f.Check(event), `event does not match filter: rollout_status equals "initialized"`)
+}
+
+func TestEmptyFilter(t *testing.T) {
+	var f *filter.Filter
+	assert.NoError(t, f.Check(event))
+
+	f, err := filter.New(nil)
+	assert.NoError(t, err)
+	assert.NoError(t, f.Check(event))
+}
+
+func TestInvalidRules(t *testing.T) {
+	for _, rule := range []filter.Rule{
+		{Equals: "foo"},
+		{Key: "team"},
+		{Key: "team", Equals: "foo", Regex: "bar"},
+		{Key: "team", Regex: "("},
+	} {
+		_, err := filter.New([]filter.Rule{rule})
+		assert.Error(t, err, rule.String())
+	}
+}
+
+func TestInvalidRulesReportEveryRule(t *testing.T) {
+	_, err := filter.New([]filter.Rule{
+		{Key: "team", Equals: "aura"},
+		{Equals: "foo", In: []string{"bar"}},
+		{Key: "team", Regex: "("},
+	})
+	assert.EqualError(t, err, "rule 2: key is required\n"+
+		"rule 2: exactly one of equals, regex or in is required\n"+
+		"rule 3: error parsing regexp: missing closing ): `(`")
+
+	var ruleErr *filter.RuleError
+	if assert.ErrorAs(t, err, &ruleErr) {
+		assert.Equal(t, 1, ruleErr.Index)
+		assert.Equal(t, "key", ruleErr.Field)
+	}
+}
@@ -0,0 +1,91 @@
+package health
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+)
+
+const (
+	StatusOK      = "ok"
+	StatusFailing = "failing"
+)
+
+// Check returns nil if a component is healthy, or an error describing the problem.
+type Check func() error
+
+// Response is the JSON body returned by the health endpoints.
+type Response struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+// Registry holds named liveness and readiness checks, and serves their results over HTTP.
+type Registry struct {
+	lock      sync.RWMutex
+	liveness  map[string]Check
+	readiness map[string]Check
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		liveness:  make(map[string]Check),
+		readiness: make(map[string]Check),
+	}
+}
+
+// AddLiveness registers a check that fails if the component is stuck and the process should be restarted.
+func (r *Registry) AddLiveness(name string, check Check) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.liveness[name] = check
+}
+
+// AddReadiness registers a check that fails if the component is not yet, or no longer, doing its work.
+func (r *Registry) AddReadiness(name string, check Check) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.readiness[name] = check
+}
+
+// Liveness serves the result of all liveness checks.
+func (r *Registry) Liveness() http.Handler {
+	return r.handler(r.liveness)
+}
+
+// Readiness serves the result of all readiness checks.
+func (r *Registry) Readiness() http.Handler {
+	return r.handler(r.readiness)
+}
+
+// evaluate runs the given checks. The status is failing if any of the checks fail.
+func evaluate(checks map[string]Check) Response {
+	response := Response{
+		Status: StatusOK,
+		Checks: make(map[string]string, len(checks)),
+	}
+	for name, check := range checks {
+		err := check()
+		if err != nil {
+			response.Status = StatusFailing
+			response.Checks[name] = err.Error()
+			continue
+		}
+		response.Checks[name] = StatusOK
+	}
+	return response
+}
+
+func (r *Registry) handler(checks map[string]Check) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		r.lock.RLock()
+		response := evaluate(checks)
+		r.lock.RUnlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		if response.Status != StatusOK {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		_ = json.NewEncoder(w).Encode(response)
+	})
+}
@@ -0,0 +1,59 @@
+package health_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/navikt/deployment-event-relays/pkg/health"
+	"github.com/stretchr/testify/assert"
+)
+
+func get(t *testing.T, handler http.Handler) (int, health.Response) {
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+	response := health.Response{}
+	assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &response))
+	return recorder.Code, response
+}
+
+func TestRegistry(t *testing.T) {
+	registry := health.NewRegistry()
+
+	code, response := get(t, registry.Readiness())
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, health.StatusOK, response.Status)
+
+	failing := true
+	registry.AddReadiness("vera", func() error {
+		if failing {
+			return fmt.Errorf("consumer group has no active session")
+		}
+		return nil
+	})
+	registry.AddReadiness("nora", func() error { return nil })
+
+	code, response = get(t, registry.Readiness())
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, health.Response{
+		Status: health.StatusFailing,
+		Checks: map[string]string{
+			"vera": "consumer group has no active session",
+			"nora": health.StatusOK,
+		},
+	}, response)
+
+	failing = false
+	code, response = get(t, registry.Readiness())
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, health.StatusOK, response.Status)
+
+	// Liveness checks are separate from readiness checks.
+	registry.AddLiveness("vera", func() error { return fmt.Errorf("stuck") })
+	code, _ = get(t, registry.Liveness())
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	code, _ = get(t, registry.Readiness())
+	assert.Equal(t, http.StatusOK, code)
+}
@@ -0,0 +1,88 @@
+package httpclient
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/navikt/deployment-event-relays/pkg/metrics"
+)
+
+// Kinds of transport errors, used as metric labels.
+const (
+	ErrorTimeout    = "timeout"
+	ErrorCanceled   = "canceled"
+	ErrorDNS        = "dns"
+	ErrorConnection = "connection"
+	ErrorOther      = "other"
+)
+
+// New returns an HTTP client that records the duration and status code of every request,
+// as well as transport errors, labeled with the subsystem and the target host.
+func New(subsystem string) *http.Client {
+	return &http.Client{
+		Transport: &transport{
+			subsystem: subsystem,
+			next:      http.DefaultTransport,
+		},
+	}
+}
+
+// OrDefault returns the given client, or http.DefaultClient if it is nil.
+func OrDefault(client *http.Client) *http.Client {
+	if client == nil {
+		return http.DefaultClient
+	}
+	return client
+}
+
+// RedactError strips the request URL from errors returned by an HTTP client, as it may contain secrets.
+func RedactError(err error) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return urlErr.Err
+	}
+	return err
+}
+
+type transport struct {
+	subsystem string
+	next      http.RoundTripper
+}
+
+// RoundTrip measures the time until response headers are received.
+// Only the host of the request URL is recorded, as the rest of the URL may contain secrets.
+func (t *transport) RoundTrip(request *http.Request) (*http.Response, error) {
+	started := time.Now()
+	response, err := t.next.RoundTrip(request)
+	if err != nil {
+		metrics.HTTPTransportError(t.subsystem, request.URL.Host, errorKind(err))
+		return nil, err
+	}
+	metrics.HTTPRequest(t.subsystem, request.URL.Host, response.StatusCode, time.Since(started))
+	return response, nil
+}
+
+// errorKind classifies a transport error.
+func errorKind(err error) string {
+	var netErr net.Error
+	var dnsErr *net.DNSError
+	var opErr *net.OpError
+	switch {
+	case errors.Is(err, context.Canceled):
+		return ErrorCanceled
+	case errors.Is(err, context.DeadlineExceeded):
+		return ErrorTimeout
+	case errors.As(err, &dnsErr):
+		return ErrorDNS
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return ErrorTimeout
+	case errors.As(err, &opErr):
+		return ErrorConnection
+	default:
+		return ErrorOther
+	}
+}
@@ -0,0 +1,92 @@
+package httpclient_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/navikt/deployment-event-relays/pkg/httpclient"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+// sampleCount returns the total number of observations in the metric family with the given labels.
+func sampleCount(t *testing.T, name string, labels map[string]string) uint64 {
+	families, err := prometheus.DefaultGatherer.Gather()
+	assert.NoError(t, err)
+
+	var count uint64
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+	metric:
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if value, ok := labels[label.GetName()]; ok && value != label.GetValue() {
+					continue metric
+				}
+			}
+			switch {
+			case metric.GetHistogram() != nil:
+				count += metric.GetHistogram().GetSampleCount()
+			case metric.GetCounter() != nil:
+				count += uint64(metric.GetCounter().GetValue())
+			}
+		}
+	}
+	return count
+}
+
+func TestClientRecordsResponses(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	host := server.Listener.Addr().String()
+
+	client := httpclient.New("test-responses")
+	for _, path := range []string{"/", "/", "/missing"} {
+		response, err := client.Get(server.URL + path)
+		assert.NoError(t, err)
+		response.Body.Close()
+	}
+
+	const name = "deployment_event_relays_http_request_duration_seconds"
+	assert.Equal(t, uint64(2), sampleCount(t, name, map[string]string{"subsystem": "test-responses", "host": host, "code": "200"}))
+	assert.Equal(t, uint64(1), sampleCount(t, name, map[string]string{"subsystem": "test-responses", "host": host, "code": "404"}))
+}
+
+func TestClientRecordsTransportErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+	}))
+	defer server.Close()
+	host := server.Listener.Addr().String()
+
+	client := httpclient.New("test-errors")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	request, _ := http.NewRequestWithContext(ctx, "GET", server.URL, nil)
+	_, err := client.Do(request)
+	assert.Error(t, err)
+
+	server.Close()
+	_, err = client.Get(server.URL)
+	assert.Error(t, err)
+
+	const name = "deployment_event_relays_http_transport_errors"
+	assert.Equal(t, uint64(1), sampleCount(t, name, map[string]string{"subsystem": "test-errors", "host": host, "error": httpclient.ErrorTimeout}))
+	assert.Equal(t, uint64(1), sampleCount(t, name, map[string]string{"subsystem": "test-errors", "host": host, "error": httpclient.ErrorConnection}))
+}
+
+func TestOrDefault(t *testing.T) {
+	assert.Equal(t, http.DefaultClient, httpclient.OrDefault(nil))
+	client := &http.Client{}
+	assert.Equal(t, client, httpclient.OrDefault(client))
+}
@@ -0,0 +1,223 @@
+package influx
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/navikt/deployment-event-relays/pkg/deployment"
+	"github.com/navikt/deployment-event-relays/pkg/outcome"
+	"github.com/navikt/deployment-event-relays/pkg/relay"
+	log "github.com/sirupsen/logrus"
+)
+
+var ErrBatcherClosed = fmt.Errorf("batcher is closed")
+
+type BatchConfig struct {
+	// MaxLines flushes the batch when it contains this many lines.
+	MaxLines int
+	// MaxBytes flushes the batch before it grows beyond this size.
+	MaxBytes int
+	// FlushInterval flushes the batch at least this often.
+	FlushInterval time.Duration
+	// Timeout bounds each write request.
+	Timeout time.Duration
+}
+
+// entry is a single line waiting to be written, together with the function that reports its result.
+type entry struct {
+	payload []byte
+	done    func(err error)
+}
+
+// Batcher accumulates lines from several events and writes them to InfluxDB in a single request.
+//
+// Each batch is written once, and the result is reported individually for every event in the batch.
+// Events that fail with a transient error are left to the caller to retry, according to its retry policy.
+// If the batch is rejected, its lines are written one at a time, so that only the offending events are rejected.
+type Batcher struct {
+	relay  *Relay
+	config BatchConfig
+	queue  chan entry
+	done   chan struct{}
+	ctx    context.Context
+	cancel context.CancelFunc
+	lock   sync.RWMutex
+	closed bool
+}
+
+func NewBatcher(relay *Relay, config BatchConfig) (*Batcher, error) {
+	if config.MaxLines < 1 {
+		return nil, fmt.Errorf("batch size must be at least one line")
+	}
+	if config.FlushInterval <= 0 {
+		return nil, fmt.Errorf("flush interval must be greater than zero")
+	}
+
+	b := &Batcher{
+		relay:  relay,
+		config: config,
+		queue:  make(chan entry, config.MaxLines),
+		done:   make(chan struct{}),
+	}
+	b.ctx, b.cancel = context.WithCancel(context.Background())
+	go b.run()
+	return b, nil
+}
+
+// Enqueue adds an event to the current batch, and calls done with the result once the batch has been written.
+// Blocks if the queue is full, until there is room or ctx is cancelled.
+func (b *Batcher) Enqueue(ctx context.Context, event *deployment.Event, done func(err error)) error {
+	payload, err := b.relay.marshal(event)
+	if err != nil {
+		return err
+	}
+	return b.enqueue(ctx, payload, done)
+}
+
+func (b *Batcher) enqueue(ctx context.Context, payload []byte, done func(err error)) error {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	if b.closed {
+		return outcome.Transient(ErrBatcherClosed)
+	}
+
+	select {
+	case b.queue <- entry{payload: payload, done: done}:
+		return nil
+	case <-ctx.Done():
+		return outcome.Transient(ctx.Err())
+	}
+}
+
+// Process adds an event to the current batch, and waits until it has been written.
+func (b *Batcher) Process(ctx context.Context, event *deployment.Event) error {
+	payload, err := b.Build(event)
+	if err != nil {
+		return err
+	}
+	return b.Deliver(ctx, payload)
+}
+
+// Build encodes an event as a write request with a single line.
+func (b *Batcher) Build(event *deployment.Event) (*relay.Payload, error) {
+	return b.relay.Build(event)
+}
+
+// Deliver adds the lines of a payload to the current batch, and waits until it has been written.
+func (b *Batcher) Deliver(ctx context.Context, payload *relay.Payload) error {
+	result := make(chan error, 1)
+	err := b.enqueue(ctx, payload.Body, func(err error) {
+		result <- err
+	})
+	if err != nil {
+		return err
+	}
+	select {
+	case err = <-result:
+		return err
+	case <-ctx.Done():
+		return outcome.Transient(ctx.Err())
+	}
+}
+
+// Close writes any remaining lines and stops the batcher.
+// If ctx expires first, pending writes are aborted and their events reported as failed.
+func (b *Batcher) Close(ctx context.Context) error {
+	b.lock.Lock()
+	if !b.closed {
+		b.closed = true
+		close(b.queue)
+	}
+	b.lock.Unlock()
+
+	select {
+	case <-b.done:
+		return nil
+	case <-ctx.Done():
+		b.cancel()
+		<-b.done
+		return ctx.Err()
+	}
+}
+
+func (b *Batcher) run() {
+	defer close(b.done)
+
+	ticker := time.NewTicker(b.config.FlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]entry, 0, b.config.MaxLines)
+	size := 0
+
+	flush := func() {
+		if len(batch) > 0 {
+			b.flush(batch, size)
+		}
+		batch = make([]entry, 0, b.config.MaxLines)
+		size = 0
+	}
+
+	for {
+		select {
+		case e, ok := <-b.queue:
+			if !ok {
+				flush()
+				return
+			}
+			if b.config.MaxBytes > 0 && size+len(e.payload) > b.config.MaxBytes {
+				flush()
+			}
+			batch = append(batch, e)
+			size += len(e.payload)
+			if len(batch) >= b.config.MaxLines {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// flush writes a batch, and reports the result to every entry in the batch.
+// A rejected batch is split into single lines, so that valid lines are still written.
+func (b *Batcher) flush(batch []entry, size int) {
+	payload := make([]byte, 0, size)
+	for _, e := range batch {
+		payload = append(payload, e.payload...)
+	}
+
+	logger := log.WithField("batch_size", len(batch))
+
+	err := b.write(payload)
+	switch outcome.Classify(err) {
+	case outcome.ClassOK:
+		logger.Debugf("Wrote batch of %d lines to InfluxDB", len(batch))
+	case outcome.ClassPermanent:
+		if len(batch) > 1 {
+			logger.Warnf("Write batch to InfluxDB: %s; writing lines one at a time", err)
+			for _, e := range batch {
+				e.done(b.write(e.payload))
+			}
+			return
+		}
+	default:
+		logger.Errorf("Write batch to InfluxDB: %s", err)
+	}
+
+	for _, e := range batch {
+		e.done(err)
+	}
+}
+
+func (b *Batcher) write(payload []byte) error {
+	ctx := b.ctx
+	if b.config.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, b.config.Timeout)
+		defer cancel()
+	}
+	return b.relay.write(ctx, payload, log.Fields{})
+}
@@ -0,0 +1,219 @@
+package influx_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/navikt/deployment-event-relays/pkg/deployment"
+	"github.com/navikt/deployment-event-relays/pkg/influx"
+	"github.com/navikt/deployment-event-relays/pkg/outcome"
+	"github.com/stretchr/testify/assert"
+)
+
+type influxServer struct {
+	lock     sync.Mutex
+	requests []string
+	status   int
+}
+
+func (s *influxServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.requests = append(s.requests, string(body))
+	w.WriteHeader(s.status)
+}
+
+func (s *influxServer) lines() []int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	result := make([]int, len(s.requests))
+	for i, body := range s.requests {
+		result[i] = strings.Count(body, "\n")
+	}
+	return result
+}
+
+func TestBatcherFlushesOnSize(t *testing.T) {
+	handler := &influxServer{status: http.StatusNoContent}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	batcher, err := influx.NewBatcher(&influx.Relay{URL: server.URL}, influx.BatchConfig{
+		MaxLines:      3,
+		FlushInterval: time.Hour,
+	})
+	assert.NoError(t, err)
+
+	results := make(chan error, 7)
+	for i := 0; i < 7; i++ {
+		err = batcher.Enqueue(context.Background(), &deployment.Event{}, func(err error) {
+			results <- err
+		})
+		assert.NoError(t, err)
+	}
+
+	for i := 0; i < 6; i++ {
+		assert.NoError(t, <-results)
+	}
+	assert.Equal(t, []int{3, 3}, handler.lines())
+
+	// closing flushes the remainder
+	assert.NoError(t, batcher.Close(context.Background()))
+	assert.NoError(t, <-results)
+	assert.Equal(t, []int{3, 3, 1}, handler.lines())
+
+	err = batcher.Enqueue(context.Background(), &deployment.Event{}, func(error) {})
+	assert.ErrorIs(t, err, influx.ErrBatcherClosed)
+}
+
+func TestBatcherFlushesOnInterval(t *testing.T) {
+	handler := &influxServer{status: http.StatusNoContent}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	batcher, err := influx.NewBatcher(&influx.Relay{URL: server.URL}, influx.BatchConfig{
+		MaxLines:      100,
+		FlushInterval: time.Millisecond * 10,
+	})
+	assert.NoError(t, err)
+	defer batcher.Close(context.Background())
+
+	assert.NoError(t, batcher.Process(context.Background(), &deployment.Event{}))
+	assert.Equal(t, []int{1}, handler.lines())
+}
+
+func TestBatcherFlushesOnBytes(t *testing.T) {
+	handler := &influxServer{status: http.StatusNoContent}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	line, _ := influx.NewLine(&deployment.Event{}).Marshal()
+
+	batcher, err := influx.NewBatcher(&influx.Relay{URL: server.URL}, influx.BatchConfig{
+		MaxLines:      100,
+		MaxBytes:      len(line) * 2,
+		FlushInterval: time.Hour,
+	})
+	assert.NoError(t, err)
+
+	for i := 0; i < 5; i++ {
+		assert.NoError(t, batcher.Enqueue(context.Background(), &deployment.Event{}, func(error) {}))
+	}
+	assert.NoError(t, batcher.Close(context.Background()))
+	assert.Equal(t, []int{2, 2, 1}, handler.lines())
+}
+
+func TestBatcherPermanentError(t *testing.T) {
+	handler := &influxServer{status: http.StatusBadRequest}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	batcher, err := influx.NewBatcher(&influx.Relay{URL: server.URL}, influx.BatchConfig{
+		MaxLines:      1,
+		FlushInterval: time.Hour,
+	})
+	assert.NoError(t, err)
+	defer batcher.Close(context.Background())
+
+	err = batcher.Process(context.Background(), &deployment.Event{})
+	assert.Equal(t, outcome.ClassPermanent, outcome.Classify(err))
+}
+
+func TestBatcherRejectedLines(t *testing.T) {
+	var lock sync.Mutex
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		lock.Lock()
+		requests++
+		lock.Unlock()
+		if strings.Contains(string(body), "invalid") {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	batcher, err := influx.NewBatcher(&influx.Relay{URL: server.URL}, influx.BatchConfig{
+		MaxLines:      3,
+		FlushInterval: time.Hour,
+	})
+	assert.NoError(t, err)
+
+	results := make(map[string]chan error)
+	for _, application := range []string{"first", "invalid", "last"} {
+		result := make(chan error, 1)
+		results[application] = result
+		err = batcher.Enqueue(context.Background(), &deployment.Event{Application: application}, func(err error) {
+			result <- err
+		})
+		assert.NoError(t, err)
+	}
+
+	// only the offending line is rejected, once the batch has been split
+	assert.NoError(t, <-results["first"])
+	assert.Equal(t, outcome.ClassPermanent, outcome.Classify(<-results["invalid"]))
+	assert.NoError(t, <-results["last"])
+	assert.Equal(t, 4, requests)
+
+	assert.NoError(t, batcher.Close(context.Background()))
+}
+
+func TestBatcherTransientError(t *testing.T) {
+	handler := &influxServer{status: http.StatusServiceUnavailable}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	batcher, err := influx.NewBatcher(&influx.Relay{URL: server.URL}, influx.BatchConfig{
+		MaxLines:      2,
+		FlushInterval: time.Hour,
+	})
+	assert.NoError(t, err)
+
+	results := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		assert.NoError(t, batcher.Enqueue(context.Background(), &deployment.Event{}, func(err error) {
+			results <- err
+		}))
+	}
+
+	// the batch is written once, and retrying is left to the caller
+	assert.Equal(t, outcome.ClassTransient, outcome.Classify(<-results))
+	assert.Equal(t, outcome.ClassTransient, outcome.Classify(<-results))
+	assert.Equal(t, []int{2}, handler.lines())
+
+	assert.NoError(t, batcher.Close(context.Background()))
+}
+
+func TestBatcherCloseAbortsWrite(t *testing.T) {
+	unblock := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-unblock
+	}))
+	defer server.Close()
+	defer close(unblock)
+
+	batcher, err := influx.NewBatcher(&influx.Relay{URL: server.URL}, influx.BatchConfig{
+		MaxLines:      1,
+		FlushInterval: time.Hour,
+	})
+	assert.NoError(t, err)
+
+	results := make(chan error, 1)
+	assert.NoError(t, batcher.Enqueue(context.Background(), &deployment.Event{}, func(err error) {
+		results <- err
+	}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	assert.ErrorIs(t, batcher.Close(ctx), context.DeadlineExceeded)
+	assert.Equal(t, outcome.ClassTransient, outcome.Classify(<-results))
+}
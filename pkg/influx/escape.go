@@ -0,0 +1,52 @@
+package influx
+
+import (
+	"strings"
+)
+
+// Escaping rules for the InfluxDB line protocol.
+//
+// https://docs.influxdata.com/influxdb/v2/reference/syntax/line-protocol/#special-characters
+//
+// Backslashes are always escaped, so that a value ending in a backslash cannot escape the following delimiter.
+// The line protocol has no way to represent line breaks, so they are written as a literal "\n" or "\r".
+var (
+	measurementEscaper = strings.NewReplacer(
+		`\`, `\\`,
+		`,`, `\,`,
+		` `, `\ `,
+		"\n", `\n`,
+		"\r", `\r`,
+	)
+
+	tagEscaper = strings.NewReplacer(
+		`\`, `\\`,
+		`,`, `\,`,
+		`=`, `\=`,
+		` `, `\ `,
+		"\n", `\n`,
+		"\r", `\r`,
+	)
+
+	fieldStringEscaper = strings.NewReplacer(
+		`\`, `\\`,
+		`"`, `\"`,
+		"\n", `\n`,
+		"\r", `\r`,
+	)
+)
+
+// escapeMeasurement escapes a measurement name.
+func escapeMeasurement(s string) string {
+	return measurementEscaper.Replace(s)
+}
+
+// escapeKey escapes a tag key, tag value or field key.
+func escapeKey(s string) string {
+	return tagEscaper.Replace(s)
+}
+
+// quoteFieldString escapes a string field value and surrounds it with double quotes.
+func quoteFieldString(s string) string {
+	return `"` + fieldStringEscaper.Replace(s) + `"`
+}
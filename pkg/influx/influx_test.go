@@ -56,7 +56,8 @@ var eventLineTests = []eventLineTest{
 }
 
 func TestEventLineData(t *testing.T) {
-	for _, test := range eventLineTests {
+	for i := range eventLineTests {
+		test := &eventLineTests[i]
 		line := influx.NewLine(&test.event)
 		data, err := line.Marshal()
 		assert.Equal(t, test.err, err)
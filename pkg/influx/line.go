@@ -4,14 +4,35 @@ import (
 	"bytes"
 	"fmt"
 	"github.com/navikt/deployment-event-relays/pkg/deployment"
+	"math"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 )
 
+// Precision is the resolution of timestamps written to InfluxDB.
+type Precision string
+
 const (
-	measurementName = "nais.deployment"
+	PrecisionNanoseconds  Precision = "ns"
+	PrecisionMicroseconds Precision = "us"
+	PrecisionMilliseconds Precision = "ms"
+	PrecisionSeconds      Precision = "s"
 )
 
+// ParsePrecision validates a precision string. An empty string yields nanosecond precision.
+func ParsePrecision(s string) (Precision, error) {
+	switch p := Precision(s); p {
+	case "":
+		return PrecisionNanoseconds, nil
+	case PrecisionNanoseconds, PrecisionMicroseconds, PrecisionMilliseconds, PrecisionSeconds:
+		return p, nil
+	default:
+		return "", fmt.Errorf("precision '%s' is not recognized", s)
+	}
+}
+
 // Line represents a single data entry in the InfluxDB line protocol.
 //
 // https://docs.influxdata.com/influxdb/v1.7/write_protocols/line_protocol_reference/
@@ -20,40 +41,16 @@ type Line struct {
 	Measurement string
 	Tags        TagField
 	Fields      TagField
+	Integers    map[string]int64
+	Floats      map[string]float64
 	Timestamp   time.Time
 }
 
-// NewLine collects data from a deployment event and copies it to a InfluxDB line data structure.
+// NewLine collects data from a deployment event and copies it to a InfluxDB line data structure,
+// using the default mapping.
 // Tags will be indexed, but fields will be subject to a table scan if queried.
 func NewLine(event *deployment.Event) Line {
-
-	tags := TagField(event.Flatten())
-
-	return Line{
-		Measurement: measurementName,
-		Timestamp:   event.GetTimestampAsTime(),
-		Tags: tags.Selection([]string{
-			"application",
-			"cluster",
-			"environment",
-			"namespace",
-			"platform_type",
-			"rollout_status",
-			"team",
-		}),
-		Fields: tags.Selection([]string{
-			"correlation_id",
-			"deployer_email",
-			"deployer_ident",
-			"deployer_name",
-			"image_hash",
-			"image_name",
-			"image_tag",
-			"skya_environment",
-			"source",
-			"version",
-		}),
-	}
+	return DefaultMapping().line(event, nil)
 }
 
 // Marshal encodes the data using the InfluxDB line syntax.
@@ -61,53 +58,131 @@ func NewLine(event *deployment.Event) Line {
 // If any error occured, the byte slice will be nil, and an error returned.
 //
 // Field and tag keys will be sorted before serialization.
+// Tags with an empty key or value are omitted, as they are not allowed by the line protocol.
 //
 // String fields must be quoted, but tag values are better left unquoted
-// as the quotes will appear in the actual data.
+// as the quotes will appear in the actual data. Special characters are escaped
+// according to where they appear in the line; see escape.go.
 //
 // The InfluxDB line format is as follows:
 //
 // <measurement>[,<tag_key>=<tag_value>[,<tag_key>=<tag_value>]] <field_key>=<field_value>[,<field_key>=<field_value>] [<timestamp>]
 //
 func (line Line) Marshal() ([]byte, error) {
+	return line.MarshalPrecision(PrecisionNanoseconds)
+}
+
+// MarshalPrecision encodes the data like Marshal, with the timestamp written in the given precision.
+func (line Line) MarshalPrecision(precision Precision) ([]byte, error) {
 	if len(line.Measurement) == 0 {
 		return nil, fmt.Errorf("InfluxDB line format requires a measurement name")
 	}
 
-	if len(line.Fields) == 0 {
-		return nil, fmt.Errorf("InfluxDB line format requires at least one field in a measurement")
+	if strings.HasPrefix(line.Measurement, "#") {
+		return nil, fmt.Errorf("InfluxDB measurement name cannot start with a hash sign")
+	}
+
+	keys, err := line.fieldKeys()
+	if err != nil {
+		return nil, err
 	}
 
 	buf := bytes.NewBuffer([]byte{})
 	writer := errorWriter{w: buf}
 
 	// <measurement>
-	writer.WriteString(line.Measurement)
+	writer.WriteString(escapeMeasurement(line.Measurement))
 
 	// [,<tag_key>=<tag_value>[,<tag_key>=<tag_value>]]
 	for _, key := range line.Tags.Sorted() {
-		writer.WriteString(fmt.Sprintf(",%s=%s", key, line.Tags[key]))
+		if len(key) == 0 || len(line.Tags[key]) == 0 {
+			continue
+		}
+		writer.WriteString(fmt.Sprintf(",%s=%s", escapeKey(key), escapeKey(line.Tags[key])))
 	}
 
 	// DELIMITER
 	writer.WriteString(" ")
 
 	// <field_key>=<field_value>[,<field_key>=<field_value>]
-	keys := line.Fields.Sorted()
-	writer.WriteString(fmt.Sprintf("%s=%s", keys[0], strconv.Quote(line.Fields[keys[0]])))
-	for _, key := range keys[1:] {
-		writer.WriteString(fmt.Sprintf(",%s=%s", key, strconv.Quote(line.Fields[key])))
+	for i, key := range keys {
+		if i > 0 {
+			writer.WriteString(",")
+		}
+		writer.WriteString(fmt.Sprintf("%s=%s", escapeKey(key), line.fieldValue(key)))
 	}
 
 	// DELIMITER
 	writer.WriteString(" ")
 
 	// [<timestamp>]
-	// Unix nanosecond timestamp. Specify alternative precisions with the InfluxDB API.
+	// Unix timestamp in the given precision, which must match the precision given to the InfluxDB API.
 	t := line.Timestamp.Truncate(time.Second)
-	writer.WriteString(strconv.FormatInt(t.UnixNano(), 10))
+	switch precision {
+	case PrecisionSeconds:
+		writer.WriteString(strconv.FormatInt(t.Unix(), 10))
+	case PrecisionMilliseconds:
+		writer.WriteString(strconv.FormatInt(t.UnixMilli(), 10))
+	case PrecisionMicroseconds:
+		writer.WriteString(strconv.FormatInt(t.UnixMicro(), 10))
+	default:
+		writer.WriteString(strconv.FormatInt(t.UnixNano(), 10))
+	}
 
 	writer.WriteString("\n")
 
 	return writer.Result()
 }
+
+// fieldKeys returns the sorted keys of all string and numeric fields.
+// A key may only be used once across field types.
+func (line Line) fieldKeys() ([]string, error) {
+	keys := make(sort.StringSlice, 0, len(line.Fields)+len(line.Integers)+len(line.Floats))
+	seen := make(map[string]bool)
+	add := func(key string) error {
+		if len(key) == 0 {
+			return fmt.Errorf("InfluxDB field keys cannot be empty")
+		}
+		if seen[key] {
+			return fmt.Errorf("InfluxDB field key '%s' is used more than once", key)
+		}
+		seen[key] = true
+		keys = append(keys, key)
+		return nil
+	}
+	for key := range line.Fields {
+		if err := add(key); err != nil {
+			return nil, err
+		}
+	}
+	for key := range line.Integers {
+		if err := add(key); err != nil {
+			return nil, err
+		}
+	}
+	for key, value := range line.Floats {
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			return nil, fmt.Errorf("InfluxDB field '%s' is not a finite number", key)
+		}
+		if err := add(key); err != nil {
+			return nil, err
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("InfluxDB line format requires at least one field in a measurement")
+	}
+	keys.Sort()
+	return keys, nil
+}
+
+// fieldValue formats a field value according to its type.
+// Integers are suffixed with an "i", floats are written without an exponent, and strings are quoted.
+func (line Line) fieldValue(key string) string {
+	if value, ok := line.Integers[key]; ok {
+		return strconv.FormatInt(value, 10) + "i"
+	}
+	if value, ok := line.Floats[key]; ok {
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	}
+	return quoteFieldString(line.Fields[key])
+}
@@ -0,0 +1,287 @@
+package influx_test
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/navikt/deployment-event-relays/pkg/influx"
+	"github.com/stretchr/testify/assert"
+)
+
+// parsedLine is the result of parsing a single line of line protocol.
+type parsedLine struct {
+	measurement string
+	tags        map[string]string
+	fields      map[string]string
+	timestamp   int64
+}
+
+// parseLine is a strict parser for the subset of the InfluxDB line protocol produced by Line.Marshal,
+// i.e. lines with string fields and a timestamp. It follows the escaping rules of the specification:
+//
+// https://docs.influxdata.com/influxdb/v2/reference/syntax/line-protocol/
+func parseLine(data string) (*parsedLine, error) {
+	if !strings.HasSuffix(data, "\n") {
+		return nil, fmt.Errorf("line must end with a newline")
+	}
+	data = strings.TrimSuffix(data, "\n")
+	if strings.ContainsAny(data, "\r\n") {
+		return nil, fmt.Errorf("line contains line breaks")
+	}
+	if strings.HasPrefix(data, "#") {
+		return nil, fmt.Errorf("line is a comment")
+	}
+
+	pos := 0
+
+	// scan reads an identifier until an unescaped delimiter, unescaping the given special characters.
+	scan := func(delimiters, specials string) string {
+		var sb strings.Builder
+		for pos < len(data) {
+			c := data[pos]
+			if c == '\\' && pos+1 < len(data) && (data[pos+1] == '\\' || strings.IndexByte(specials, data[pos+1]) >= 0) {
+				sb.WriteByte(data[pos+1])
+				pos += 2
+				continue
+			}
+			if strings.IndexByte(delimiters, c) >= 0 {
+				break
+			}
+			sb.WriteByte(c)
+			pos++
+		}
+		return sb.String()
+	}
+
+	expect := func(c byte) error {
+		if pos >= len(data) || data[pos] != c {
+			return fmt.Errorf("expected %q at position %d", c, pos)
+		}
+		pos++
+		return nil
+	}
+
+	line := &parsedLine{
+		tags:   make(map[string]string),
+		fields: make(map[string]string),
+	}
+
+	line.measurement = scan(", ", ", ")
+	if len(line.measurement) == 0 {
+		return nil, fmt.Errorf("empty measurement")
+	}
+
+	for pos < len(data) && data[pos] == ',' {
+		pos++
+		key := scan("=, ", ",= ")
+		if err := expect('='); err != nil {
+			return nil, err
+		}
+		value := scan("=, ", ",= ")
+		if len(key) == 0 || len(value) == 0 {
+			return nil, fmt.Errorf("empty tag key or value")
+		}
+		line.tags[key] = value
+	}
+
+	if err := expect(' '); err != nil {
+		return nil, err
+	}
+
+	for {
+		key := scan("=, ", ",= ")
+		if len(key) == 0 {
+			return nil, fmt.Errorf("empty field key")
+		}
+		if err := expect('='); err != nil {
+			return nil, err
+		}
+		if err := expect('"'); err != nil {
+			return nil, err
+		}
+		var sb strings.Builder
+		for {
+			if pos >= len(data) {
+				return nil, fmt.Errorf("unterminated string field")
+			}
+			c := data[pos]
+			if c == '\\' && pos+1 < len(data) && (data[pos+1] == '\\' || data[pos+1] == '"') {
+				sb.WriteByte(data[pos+1])
+				pos += 2
+				continue
+			}
+			if c == '"' {
+				pos++
+				break
+			}
+			sb.WriteByte(c)
+			pos++
+		}
+		line.fields[key] = sb.String()
+		if pos < len(data) && data[pos] == ',' {
+			pos++
+			continue
+		}
+		break
+	}
+
+	if err := expect(' '); err != nil {
+		return nil, err
+	}
+
+	timestamp, err := strconv.ParseInt(data[pos:], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timestamp: %w", err)
+	}
+	line.timestamp = timestamp
+
+	return line, nil
+}
+
+// lineBreaks are not representable in the line protocol, and are written as escape sequences instead.
+var lineBreaks = strings.NewReplacer("\n", `\n`, "\r", `\r`)
+
+func TestMarshalEscaping(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		line influx.Line
+		data string
+	}{
+		{
+			name: "plain",
+			line: influx.Line{
+				Measurement: "nais.deployment",
+				Tags:        influx.TagField{"team": "aura"},
+				Fields:      influx.TagField{"version": "1.2.3"},
+			},
+			data: `nais.deployment,team=aura version="1.2.3" 0`,
+		},
+		{
+			name: "measurement",
+			line: influx.Line{
+				Measurement: `my measurement,with=specials\`,
+				Fields:      influx.TagField{"f": "v"},
+			},
+			data: `my\ measurement\,with=specials\\ f="v" 0`,
+		},
+		{
+			name: "tag keys and values",
+			line: influx.Line{
+				Measurement: "m",
+				Tags: influx.TagField{
+					"tag key":  "value with spaces",
+					"tag,key":  "a,b",
+					"tag=key":  "a=b",
+					`tag\key`:  `trailing\`,
+					"empty":    "",
+					"unicode":  "blåbær",
+					"quotes":   `"quoted"`,
+					"newlines": "a\nb\rc",
+				},
+				Fields: influx.TagField{"f": "v"},
+			},
+			data: `m,newlines=a\nb\rc,quotes="quoted",tag\ key=value\ with\ spaces,tag\,key=a\,b,tag\=key=a\=b,tag\\key=trailing\\,unicode=blåbær f="v" 0`,
+		},
+		{
+			name: "field keys and values",
+			line: influx.Line{
+				Measurement: "m",
+				Fields: influx.TagField{
+					"field key": `say "hello"`,
+					"path":      `C:\Windows\`,
+					"unicode":   "blåbær \u00e6 \u2603",
+					"control":   "a\tb",
+					"newline":   "a\nb",
+					"empty":     "",
+				},
+			},
+			data: "m control=\"a\tb\",empty=\"\",field\\ key=\"say \\\"hello\\\"\",newline=\"a\\nb\",path=\"C:\\\\Windows\\\\\",unicode=\"blåbær æ ☃\" 0",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			test.line.Timestamp = time.Unix(0, 0)
+			data, err := test.line.Marshal()
+			assert.NoError(t, err)
+			assert.Equal(t, test.data+"\n", string(data))
+
+			parsed, err := parseLine(string(data))
+			assert.NoError(t, err)
+			assert.Equal(t, lineBreaks.Replace(test.line.Measurement), parsed.measurement)
+		})
+	}
+}
+
+func TestMarshalErrors(t *testing.T) {
+	for _, line := range []influx.Line{
+		{Fields: influx.TagField{"f": "v"}},
+		{Measurement: "#comment", Fields: influx.TagField{"f": "v"}},
+		{Measurement: "m"},
+		{Measurement: "m", Fields: influx.TagField{"": "v"}},
+	} {
+		_, err := line.Marshal()
+		assert.Error(t, err)
+	}
+}
+
+func FuzzMarshal(f *testing.F) {
+	f.Add("nais.deployment", "team", "aura", "version", "1.2.3")
+	f.Add("with space", "a,b", "c=d", `e"f`, `g\h`)
+	f.Add(`trailing\`, `\`, `\\`, `\"`, "\n")
+
+	f.Fuzz(func(t *testing.T, measurement, tagKey, tagValue, fieldKey, fieldValue string) {
+		for _, s := range []string{measurement, tagKey, tagValue, fieldKey, fieldValue} {
+			if !utf8.ValidString(s) {
+				t.Skip()
+			}
+		}
+
+		line := influx.Line{
+			Measurement: measurement,
+			Tags:        influx.TagField{tagKey: tagValue},
+			Fields:      influx.TagField{fieldKey: fieldValue},
+			Timestamp:   time.Unix(1600000000, 0),
+		}
+
+		data, err := line.Marshal()
+		if len(measurement) == 0 || strings.HasPrefix(measurement, "#") || len(fieldKey) == 0 {
+			assert.Error(t, err)
+			return
+		}
+		assert.NoError(t, err)
+
+		parsed, err := parseLine(string(data))
+		if !assert.NoError(t, err, "%q", data) {
+			return
+		}
+
+		assert.Equal(t, lineBreaks.Replace(measurement), parsed.measurement)
+		assert.Equal(t, map[string]string{lineBreaks.Replace(fieldKey): lineBreaks.Replace(fieldValue)}, parsed.fields)
+		if len(tagKey) > 0 && len(tagValue) > 0 {
+			assert.Equal(t, map[string]string{lineBreaks.Replace(tagKey): lineBreaks.Replace(tagValue)}, parsed.tags)
+		} else {
+			assert.Empty(t, parsed.tags)
+		}
+		assert.Equal(t, int64(1600000000000000000), parsed.timestamp)
+	})
+}
+
+func TestMarshalNumericFields(t *testing.T) {
+	line := influx.Line{
+		Measurement: "m",
+		Fields:      influx.TagField{"b": "x"},
+		Integers:    map[string]int64{"a": -3, "c": 1},
+		Floats:      map[string]float64{"d": 0.25, "e": 1e21},
+		Timestamp:   time.Unix(1, 0),
+	}
+	data, err := line.Marshal()
+	assert.NoError(t, err)
+	assert.Equal(t, `m a=-3i,b="x",c=1i,d=0.25,e=1000000000000000000000 1000000000`+"\n", string(data))
+
+	line.Integers["b"] = 1
+	_, err = line.Marshal()
+	assert.Error(t, err)
+}
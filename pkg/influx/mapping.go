@@ -0,0 +1,228 @@
+package influx
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/navikt/deployment-event-relays/pkg/deployment"
+)
+
+const (
+	// DefaultMeasurement is the measurement written when no other name is configured.
+	DefaultMeasurement = "nais.deployment"
+
+	// maxRollouts bounds the number of rollouts tracked while waiting for them to complete.
+	maxRollouts = 10000
+)
+
+// Mapping decides how the flattened data of a deployment event is written to InfluxDB.
+//
+// Keys from Event.Flatten() listed in Tags become tags, and those listed in Fields become string fields.
+// Keys that are listed in neither are left out.
+type Mapping struct {
+	Measurement string   `json:"measurement"`
+	Tags        []string `json:"tags"`
+	Fields      []string `json:"fields"`
+	// StaticTags are added to every line, after the tags taken from the event.
+	StaticTags map[string]string `json:"static-tags"`
+	// CountField, if set, is an integer field with the value 1, so that deployments can be summed.
+	CountField string `json:"count-field"`
+	// RolloutDurationField, if set, is a float field with the number of seconds between the
+	// first and the completed event of a rollout, as identified by the correlation ID.
+	// It is only written for completed rollouts whose first event was seen by this process,
+	// among the most recent rollouts it has seen.
+	RolloutDurationField string `json:"rollout-duration-field"`
+}
+
+// DefaultMapping returns the mapping used before the mapping was made configurable.
+func DefaultMapping() Mapping {
+	return Mapping{
+		Measurement: DefaultMeasurement,
+		Tags: []string{
+			"application",
+			"cluster",
+			"environment",
+			"namespace",
+			"platform_type",
+			"rollout_status",
+			"team",
+		},
+		Fields: []string{
+			"correlation_id",
+			"deployer_email",
+			"deployer_ident",
+			"deployer_name",
+			"image_hash",
+			"image_name",
+			"image_tag",
+			"skya_environment",
+			"source",
+			"version",
+		},
+	}
+}
+
+// Validate checks that the mapping produces valid lines, and that no key is written twice.
+func (m Mapping) Validate() error {
+	if len(m.Measurement) == 0 {
+		return fmt.Errorf("measurement name is required")
+	}
+	if strings.HasPrefix(m.Measurement, "#") {
+		return fmt.Errorf("measurement name cannot start with a hash sign")
+	}
+
+	tags := make(map[string]bool)
+	for _, key := range m.Tags {
+		if len(key) == 0 {
+			return fmt.Errorf("tag keys cannot be empty")
+		}
+		tags[key] = true
+	}
+	for key, value := range m.StaticTags {
+		if len(key) == 0 || len(value) == 0 {
+			return fmt.Errorf("static tag '%s' must have both a key and a value", key)
+		}
+		if tags[key] {
+			return fmt.Errorf("static tag '%s' is also mapped from the event", key)
+		}
+	}
+
+	fields := make(map[string]bool)
+	for _, key := range append(append([]string{}, m.Fields...), m.CountField, m.RolloutDurationField) {
+		if len(key) == 0 {
+			continue
+		}
+		if fields[key] {
+			return fmt.Errorf("field '%s' is mapped more than once", key)
+		}
+		fields[key] = true
+	}
+	for _, key := range m.Fields {
+		if len(key) == 0 {
+			return fmt.Errorf("field keys cannot be empty")
+		}
+	}
+	if len(fields) == 0 {
+		return fmt.Errorf("at least one field is required")
+	}
+
+	return nil
+}
+
+// Mapper turns deployment events into lines according to a mapping.
+// It is safe for concurrent use.
+type Mapper struct {
+	mapping  Mapping
+	rollouts *rolloutTimer
+}
+
+func NewMapper(mapping Mapping) (*Mapper, error) {
+	err := mapping.Validate()
+	if err != nil {
+		return nil, err
+	}
+	m := &Mapper{
+		mapping: mapping,
+	}
+	if len(mapping.RolloutDurationField) > 0 {
+		m.rollouts = newRolloutTimer(maxRollouts)
+	}
+	return m, nil
+}
+
+// Line maps a single deployment event.
+func (m *Mapper) Line(event *deployment.Event) Line {
+	return m.mapping.line(event, m.rollouts)
+}
+
+func (m Mapping) line(event *deployment.Event, rollouts *rolloutTimer) Line {
+	data := TagField(event.Flatten())
+
+	tags := data.Selection(m.Tags)
+	for key, value := range m.StaticTags {
+		tags[key] = value
+	}
+
+	line := Line{
+		Measurement: m.Measurement,
+		Timestamp:   event.GetTimestampAsTime(),
+		Tags:        tags,
+		Fields:      data.Selection(m.Fields),
+	}
+
+	if len(m.CountField) > 0 {
+		line.Integers = map[string]int64{
+			m.CountField: 1,
+		}
+	}
+
+	if rollouts != nil {
+		duration, ok := rollouts.observe(event)
+		if ok {
+			line.Floats = map[string]float64{
+				m.RolloutDurationField: duration.Seconds(),
+			}
+		}
+	}
+
+	return line
+}
+
+// rolloutTimer remembers when each rollout started, so that its duration can be reported when it completes.
+// The oldest rollouts are forgotten when more than max have been seen.
+//
+// Completed rollouts are not forgotten right away, as the line for the completed event may be built again
+// if its delivery is retried or replayed, or if it is only built for a dry run.
+type rolloutTimer struct {
+	lock    sync.Mutex
+	max     int
+	started map[string]time.Time
+	order   []string
+}
+
+func newRolloutTimer(max int) *rolloutTimer {
+	return &rolloutTimer{
+		max:     max,
+		started: make(map[string]time.Time),
+	}
+}
+
+// observe records the start of a rollout, and returns its duration once the rollout is complete.
+// Completed events do not change the recorded start, so observing one again yields the same duration.
+func (t *rolloutTimer) observe(event *deployment.Event) (time.Duration, bool) {
+	id := event.GetCorrelationID()
+	if len(id) == 0 {
+		return 0, false
+	}
+	timestamp := event.GetTimestampAsTime()
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	started, ok := t.started[id]
+
+	if event.GetRolloutStatus() == deployment.RolloutStatus_complete {
+		if !ok || timestamp.Before(started) {
+			return 0, false
+		}
+		return timestamp.Sub(started), true
+	}
+
+	if ok {
+		if timestamp.Before(started) {
+			t.started[id] = timestamp
+		}
+		return 0, false
+	}
+
+	t.started[id] = timestamp
+	t.order = append(t.order, id)
+	for len(t.started) > t.max && len(t.order) > 0 {
+		delete(t.started, t.order[0])
+		t.order = t.order[1:]
+	}
+
+	return 0, false
+}
@@ -0,0 +1,95 @@
+package influx_test
+
+import (
+	"testing"
+
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/navikt/deployment-event-relays/pkg/deployment"
+	"github.com/navikt/deployment-event-relays/pkg/influx"
+	"github.com/stretchr/testify/assert"
+)
+
+// The default mapping must reproduce the output from before the mapping was configurable.
+func TestDefaultMapping(t *testing.T) {
+	mapper, err := influx.NewMapper(influx.DefaultMapping())
+	assert.NoError(t, err)
+
+	for i := range eventLineTests {
+		test := &eventLineTests[i]
+		data, err := mapper.Line(&test.event).Marshal()
+		assert.NoError(t, err)
+		assert.Equal(t, test.data, string(data))
+	}
+}
+
+func TestCustomMapping(t *testing.T) {
+	mapper, err := influx.NewMapper(influx.Mapping{
+		Measurement: "deployments",
+		Tags:        []string{"team", "application"},
+		Fields:      []string{"version"},
+		StaticTags: map[string]string{
+			"region": "europe north",
+		},
+		CountField: "count",
+	})
+	assert.NoError(t, err)
+
+	data, err := mapper.Line(&deployment.Event{
+		Application: "app",
+		Team:        "tea",
+		Version:     "1.2.3",
+		Namespace:   "ignored",
+		Timestamp:   &timestamp.Timestamp{Seconds: 123456789},
+	}).Marshal()
+
+	assert.NoError(t, err)
+	assert.Equal(t, `deployments,application=app,region=europe\ north,team=tea count=1i,version="1.2.3" 123456789000000000`+"\n", string(data))
+}
+
+func TestRolloutDuration(t *testing.T) {
+	mapper, err := influx.NewMapper(influx.Mapping{
+		Measurement:          "deployments",
+		Tags:                 []string{"rollout_status"},
+		CountField:           "count",
+		RolloutDurationField: "rollout_duration",
+	})
+	assert.NoError(t, err)
+
+	marshal := func(status deployment.RolloutStatus, seconds int64) string {
+		data, err := mapper.Line(&deployment.Event{
+			CorrelationID: "id",
+			RolloutStatus: status,
+			Timestamp:     &timestamp.Timestamp{Seconds: seconds},
+		}).Marshal()
+		assert.NoError(t, err)
+		return string(data)
+	}
+
+	assert.Equal(t, "deployments,rollout_status=initialized count=1i 100000000000\n", marshal(deployment.RolloutStatus_initialized, 100))
+	assert.Equal(t, "deployments,rollout_status=complete count=1i,rollout_duration=90 190000000000\n", marshal(deployment.RolloutStatus_complete, 190))
+
+	// Building the completed line again, as when its delivery is retried, yields the same duration.
+	assert.Equal(t, "deployments,rollout_status=complete count=1i,rollout_duration=90 190000000000\n", marshal(deployment.RolloutStatus_complete, 190))
+}
+
+func TestMappingValidate(t *testing.T) {
+	valid := influx.DefaultMapping()
+	assert.NoError(t, valid.Validate())
+
+	tests := map[string]func(m *influx.Mapping){
+		"no measurement":      func(m *influx.Mapping) { m.Measurement = "" },
+		"comment measurement": func(m *influx.Mapping) { m.Measurement = "#foo" },
+		"empty tag":           func(m *influx.Mapping) { m.Tags = append(m.Tags, "") },
+		"empty field":         func(m *influx.Mapping) { m.Fields = append(m.Fields, "") },
+		"no fields":           func(m *influx.Mapping) { m.Fields = nil },
+		"duplicate field":     func(m *influx.Mapping) { m.CountField = "version" },
+		"static tag conflict": func(m *influx.Mapping) { m.StaticTags = map[string]string{"team": "foo"} },
+		"empty static tag":    func(m *influx.Mapping) { m.StaticTags = map[string]string{"foo": ""} },
+	}
+
+	for name, modify := range tests {
+		mapping := influx.DefaultMapping()
+		modify(&mapping)
+		assert.Error(t, mapping.Validate(), name)
+	}
+}
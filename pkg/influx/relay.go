@@ -1,56 +1,234 @@
 package influx
 
 import (
-	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"strings"
 
 	"github.com/navikt/deployment-event-relays/pkg/deployment"
+	"github.com/navikt/deployment-event-relays/pkg/httpclient"
+	"github.com/navikt/deployment-event-relays/pkg/outcome"
+	"github.com/navikt/deployment-event-relays/pkg/relay"
+	"github.com/navikt/deployment-event-relays/pkg/secret"
 	log "github.com/sirupsen/logrus"
 )
 
+const (
+	// Version1 writes to an InfluxDB 1.x compatible endpoint, given verbatim in URL, using basic authentication.
+	Version1 = 1
+	// Version2 writes to the InfluxDB 2.x /api/v2/write endpoint using token authentication.
+	Version2 = 2
+)
+
 type Relay struct {
-	URL      string
+	// Version selects the InfluxDB API. Zero means Version1.
+	Version int
+	URL     string
+
+	// Credentials for InfluxDB 1.x.
 	Username string
-	Password string
+	Password *secret.Value
+
+	// Destination and credentials for InfluxDB 2.x.
+	Org    string
+	Bucket string
+	Token  *secret.Value
+
+	// Precision of the timestamps written. Empty means nanoseconds.
+	Precision Precision
+
+	// Mapper decides which data is written. Nil means the default mapping.
+	Mapper *Mapper
+
+	// Client performs the HTTP requests. Nil means http.DefaultClient.
+	Client *http.Client
 }
 
-func (r *Relay) Process(event *deployment.Event) (retry bool, err error) {
+// Validate checks that the relay has the settings required by its API version.
+func (r *Relay) Validate() error {
+	_, err := ParsePrecision(string(r.Precision))
+	if err != nil {
+		return err
+	}
+	switch r.Version {
+	case 0, Version1:
+		return nil
+	case Version2:
+		if len(r.Org) == 0 {
+			return fmt.Errorf("InfluxDB 2.x requires an organization")
+		}
+		if len(r.Bucket) == 0 {
+			return fmt.Errorf("InfluxDB 2.x requires a bucket")
+		}
+		return nil
+	default:
+		return fmt.Errorf("InfluxDB API version %d is not supported", r.Version)
+	}
+}
+
+func (r *Relay) Process(ctx context.Context, event *deployment.Event) error {
+	payload, err := r.Build(event)
+	if err != nil {
+		return err
+	}
+
+	return r.deliver(ctx, payload, log.Fields{
+		"correlation_id": event.GetCorrelationID(),
+	})
+}
+
+// Build encodes an event as a write request with a single line.
+func (r *Relay) Build(event *deployment.Event) (*relay.Payload, error) {
+	body, err := r.marshal(event)
+	if err != nil {
+		return nil, err
+	}
+	return r.payload(body), nil
+}
+
+// Deliver writes a payload to InfluxDB.
+func (r *Relay) Deliver(ctx context.Context, payload *relay.Payload) error {
+	return r.deliver(ctx, payload, log.Fields{})
+}
+
+// marshal encodes an event as line protocol, with timestamps in the precision expected by the relay.
+func (r *Relay) marshal(event *deployment.Event) ([]byte, error) {
 	line := NewLine(event)
-	payload, err := line.Marshal()
+	if r.Mapper != nil {
+		line = r.Mapper.Line(event)
+	}
+	payload, err := line.MarshalPrecision(r.precision())
 	if err != nil {
-		return false, fmt.Errorf("marshal InfluxDB payload: %s", err)
+		return nil, outcome.Permanent(fmt.Errorf("marshal InfluxDB payload: %s", err))
 	}
+	return payload, nil
+}
 
-	body := bytes.NewReader(payload)
-	request, err := http.NewRequest("POST", r.URL, body)
+func (r *Relay) precision() Precision {
+	if len(r.Precision) == 0 {
+		return PrecisionNanoseconds
+	}
+	return r.Precision
+}
+
+// payload creates a write request with one or more lines of data, for the configured API version.
+func (r *Relay) payload(body []byte) *relay.Payload {
+	if r.Version != Version2 {
+		return &relay.Payload{
+			Method: "POST",
+			URL:    r.URL,
+			Body:   body,
+		}
+	}
+
+	query := url.Values{}
+	query.Set("org", r.Org)
+	query.Set("bucket", r.Bucket)
+	query.Set("precision", string(r.precision()))
+	return &relay.Payload{
+		Method:      "POST",
+		URL:         strings.TrimSuffix(r.URL, "/") + "/api/v2/write?" + query.Encode(),
+		ContentType: "text/plain; charset=utf-8",
+		Body:        body,
+	}
+}
+
+// request builds the HTTP request for a payload, with the credentials of the configured API version.
+func (r *Relay) request(ctx context.Context, payload *relay.Payload) (*http.Request, error) {
+	request, err := payload.Request(ctx)
 	if err != nil {
-		return true, fmt.Errorf("unable to create new HTTP request object: %s", err)
+		return nil, err
+	}
+	if r.Version != Version2 {
+		if password := r.Password.Reveal(); len(r.Username) > 0 && len(password) > 0 {
+			request.SetBasicAuth(r.Username, password)
+		}
+		return request, nil
 	}
+	if token := r.Token.Reveal(); len(token) > 0 {
+		request.Header.Set("Authorization", "Token "+token)
+	}
+	return request, nil
+}
+
+// write posts one or more lines of data to InfluxDB.
+func (r *Relay) write(ctx context.Context, body []byte, fields log.Fields) error {
+	return r.deliver(ctx, r.payload(body), fields)
+}
 
-	if len(r.Username) > 0 && len(r.Password) > 0 {
-		request.SetBasicAuth(r.Username, r.Password)
+func (r *Relay) deliver(ctx context.Context, payload *relay.Payload, fields log.Fields) error {
+	request, err := r.request(ctx, payload)
+	if err != nil {
+		return outcome.Transient(fmt.Errorf("unable to create new HTTP request object: %s", err))
 	}
 
-	response, err := http.DefaultClient.Do(request)
+	response, err := httpclient.OrDefault(r.Client).Do(request)
 	if err != nil {
-		return true, fmt.Errorf("post to InfluxDB: %s", err)
+		return outcome.Transient(fmt.Errorf("post to InfluxDB: %w", httpclient.RedactError(err)))
 	}
 	bodyLoad, _ := ioutil.ReadAll(response.Body)
 
 	defer response.Body.Close()
 
-	if response.StatusCode > 299 {
-		raw, _ := line.Marshal()
-		log.WithFields(log.Fields{
-			"raw_payload":    string(raw),
-			"error_response": bodyLoad,
-			"correlation_id": event.GetCorrelationID(),
-		}).Debugf("NOTE: raw payload and output included here for %s", event.GetCorrelationID())
+	err = classify(response, bodyLoad)
+	if err != nil {
+		log.WithFields(fields).WithFields(log.Fields{
+			"raw_payload":    string(payload.Body),
+			"error_response": string(bodyLoad),
+		}).Debugf("NOTE: raw payload and output included here")
+	}
+
+	return err
+}
 
-		return true, fmt.Errorf("POST %s: %s", r.URL, response.Status)
+// apiError is the error body returned by both InfluxDB 1.x ("error") and 2.x ("code", "message" and "line").
+type apiError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Line    int    `json:"line"`
+	Error   string `json:"error"`
+}
+
+func (e apiError) String() string {
+	message := e.Message
+	if len(message) == 0 {
+		message = e.Error
+	}
+	if len(e.Code) > 0 {
+		message = e.Code + ": " + message
+	}
+	if e.Line > 0 {
+		message = fmt.Sprintf("%s (line %d)", message, e.Line)
+	}
+	return message
+}
+
+// classify maps an InfluxDB write response to an outcome.
+//
+// Malformed or oversized payloads are rejected permanently, as retrying them will never succeed.
+// Authentication failures and missing buckets are treated as transient, since they
+// are caused by configuration that can be fixed without losing data.
+func classify(response *http.Response, body []byte) error {
+	err := outcome.HTTPStatus(response)
+	if err == nil {
+		return nil
 	}
 
-	return false, nil
+	var parsed apiError
+	if json.Unmarshal(body, &parsed) == nil && len(parsed.String()) > 0 {
+		err = fmt.Errorf("%w: %s", err, parsed)
+	}
+
+	switch response.StatusCode {
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge, http.StatusUnprocessableEntity:
+		return outcome.Permanent(err)
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound:
+		return outcome.Transient(err)
+	default:
+		return err
+	}
 }
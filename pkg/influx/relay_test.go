@@ -0,0 +1,188 @@
+package influx_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/navikt/deployment-event-relays/pkg/deployment"
+	"github.com/navikt/deployment-event-relays/pkg/influx"
+	"github.com/navikt/deployment-event-relays/pkg/outcome"
+	"github.com/navikt/deployment-event-relays/pkg/secret"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRelayVersion1(t *testing.T) {
+	var request *http.Request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		request = r
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	relay := &influx.Relay{
+		URL:      server.URL + "/write?db=default",
+		Username: "user",
+		Password: secret.Static("pass"),
+	}
+	err := relay.Process(context.Background(), &deployment.Event{})
+	assert.NoError(t, err)
+
+	assert.Equal(t, "/write", request.URL.Path)
+	assert.Equal(t, "default", request.URL.Query().Get("db"))
+	username, password, ok := request.BasicAuth()
+	assert.True(t, ok)
+	assert.Equal(t, "user", username)
+	assert.Equal(t, "pass", password)
+}
+
+func TestRelayVersion2(t *testing.T) {
+	var request *http.Request
+	var body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		request = r
+		data, _ := ioutil.ReadAll(r.Body)
+		body = string(data)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	relay := &influx.Relay{
+		Version:   influx.Version2,
+		URL:       server.URL + "/",
+		Org:       "nais",
+		Bucket:    "deployments",
+		Token:     secret.Static("secret"),
+		Precision: influx.PrecisionSeconds,
+	}
+	assert.NoError(t, relay.Validate())
+
+	err := relay.Process(context.Background(), &deployment.Event{
+		Timestamp: &timestamp.Timestamp{Seconds: 123456789},
+	})
+	assert.NoError(t, err)
+
+	assert.Equal(t, "/api/v2/write", request.URL.Path)
+	assert.Equal(t, "nais", request.URL.Query().Get("org"))
+	assert.Equal(t, "deployments", request.URL.Query().Get("bucket"))
+	assert.Equal(t, "s", request.URL.Query().Get("precision"))
+	assert.Equal(t, "Token secret", request.Header.Get("Authorization"))
+	assert.True(t, strings.HasSuffix(body, " 123456789\n"), body)
+}
+
+func TestRelayBuild(t *testing.T) {
+	relay := &influx.Relay{
+		Version:   influx.Version2,
+		URL:       "https://influx.example.com",
+		Org:       "nais",
+		Bucket:    "deployments",
+		Token:     secret.Static("secret"),
+		Precision: influx.PrecisionSeconds,
+	}
+
+	payload, err := relay.Build(&deployment.Event{
+		Timestamp: &timestamp.Timestamp{Seconds: 123456789},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "POST", payload.Method)
+	assert.Equal(t, "https://influx.example.com/api/v2/write?bucket=deployments&org=nais&precision=s", payload.URL)
+	assert.Equal(t, "text/plain; charset=utf-8", payload.ContentType)
+	assert.True(t, strings.HasSuffix(string(payload.Body), " 123456789\n"), string(payload.Body))
+}
+
+func TestRelayValidate(t *testing.T) {
+	assert.NoError(t, (&influx.Relay{}).Validate())
+	assert.Error(t, (&influx.Relay{Version: 3}).Validate())
+	assert.Error(t, (&influx.Relay{Version: influx.Version2, Bucket: "b"}).Validate())
+	assert.Error(t, (&influx.Relay{Version: influx.Version2, Org: "o"}).Validate())
+	assert.Error(t, (&influx.Relay{Precision: "m"}).Validate())
+}
+
+func TestRelayErrorClassification(t *testing.T) {
+	tests := []struct {
+		status  int
+		body    string
+		class   outcome.Class
+		message string
+	}{
+		{
+			status:  http.StatusBadRequest,
+			body:    `{"code":"invalid","message":"unable to parse 'nais.deployment': missing fields","line":1}`,
+			class:   outcome.ClassPermanent,
+			message: "invalid: unable to parse 'nais.deployment': missing fields (line 1)",
+		},
+		{
+			status:  http.StatusUnprocessableEntity,
+			body:    `{"code":"unprocessable entity","message":"failure writing points to database: partial write: field type conflict"}`,
+			class:   outcome.ClassPermanent,
+			message: "field type conflict",
+		},
+		{
+			status:  http.StatusRequestEntityTooLarge,
+			body:    `{"code":"request too large","message":"unable to read data: points batch is too large"}`,
+			class:   outcome.ClassPermanent,
+			message: "points batch is too large",
+		},
+		{
+			status:  http.StatusBadRequest,
+			body:    `{"error":"unable to parse 'nais.deployment': invalid field format"}`,
+			class:   outcome.ClassPermanent,
+			message: "invalid field format",
+		},
+		{
+			status:  http.StatusUnauthorized,
+			body:    `{"code":"unauthorized","message":"unauthorized access"}`,
+			class:   outcome.ClassTransient,
+			message: "unauthorized: unauthorized access",
+		},
+		{
+			status:  http.StatusNotFound,
+			body:    `{"code":"not found","message":"bucket \"deployments\" not found"}`,
+			class:   outcome.ClassTransient,
+			message: "not found",
+		},
+		{
+			status: http.StatusTooManyRequests,
+			class:  outcome.ClassRateLimited,
+		},
+		{
+			status: http.StatusServiceUnavailable,
+			body:   "not json",
+			class:  outcome.ClassTransient,
+		},
+	}
+
+	for _, test := range tests {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(test.status)
+			w.Write([]byte(test.body))
+		}))
+
+		relay := &influx.Relay{
+			Version: influx.Version2,
+			URL:     server.URL,
+			Org:     "nais",
+			Bucket:  "deployments",
+		}
+		err := relay.Process(context.Background(), &deployment.Event{})
+		server.Close()
+
+		assert.Equal(t, test.class, outcome.Classify(err), "status %d", test.status)
+		assert.Contains(t, err.Error(), test.message)
+	}
+}
+
+func TestRelayErrorsDoNotLeakURL(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.Close()
+
+	relay := &influx.Relay{URL: server.URL + "/write?db=default&u=user&p=secret"}
+	err := relay.Process(context.Background(), &deployment.Event{})
+	assert.Equal(t, outcome.ClassTransient, outcome.Classify(err))
+	assert.NotContains(t, err.Error(), "secret")
+}
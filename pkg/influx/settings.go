@@ -0,0 +1,172 @@
+package influx
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/navikt/deployment-event-relays/pkg/config"
+	"github.com/navikt/deployment-event-relays/pkg/httpclient"
+	"github.com/navikt/deployment-event-relays/pkg/relay"
+	"github.com/navikt/deployment-event-relays/pkg/secret"
+	"github.com/spf13/pflag"
+)
+
+const RelayType = "influxdb"
+
+type BatchSettings struct {
+	MaxLines      int           `json:"max-lines"`
+	MaxBytes      int           `json:"max-bytes"`
+	FlushInterval time.Duration `json:"flush-interval"`
+}
+
+// Settings configure an InfluxDB relay.
+type Settings struct {
+	URL              string        `json:"url"`
+	Version          int           `json:"version"`
+	Username         string        `json:"username"`
+	Password         string        `json:"password" secret:"true"`
+	PasswordFile     string        `json:"password-file"`
+	Org              string        `json:"org"`
+	Bucket           string        `json:"bucket"`
+	Token            string        `json:"token" secret:"true"`
+	TokenFile        string        `json:"token-file"`
+	Precision        string        `json:"precision"`
+	Batch            BatchSettings `json:"batch"`
+	Mapping          Mapping       `json:"mapping"`
+	config.Subsystem `json:",squash"`
+}
+
+func init() {
+	relay.Register(relay.Factory{
+		Type:      RelayType,
+		Key:       RelayType,
+		Defaults:  func() config.Settings { return DefaultSettings() },
+		BindFlags: func(settings config.Settings, prefix string) { settings.(*Settings).bindFlags(prefix) },
+		New: func(name string, settings config.Settings) (relay.Relay, error) {
+			return New(name, *settings.(*Settings))
+		},
+	})
+}
+
+func DefaultSettings() *Settings {
+	return &Settings{
+		Version:   Version1,
+		Precision: string(PrecisionNanoseconds),
+		Batch: BatchSettings{
+			MaxLines:      0,
+			MaxBytes:      1024 * 1024,
+			FlushInterval: time.Second,
+		},
+		Mapping:   DefaultMapping(),
+		Subsystem: config.DefaultSubsystem(),
+	}
+}
+
+func (s *Settings) bindFlags(prefix string) {
+	pflag.StringVar(&s.URL, prefix+".url", s.URL, "InfluxDB write endpoint (1.x), or base URL (2.x). Enables the influxdb subsystem")
+	pflag.IntVar(&s.Version, prefix+".version", s.Version, "InfluxDB API version, either 1 or 2")
+	pflag.StringVar(&s.Username, prefix+".username", s.Username, "InfluxDB 1.x username")
+	pflag.StringVar(&s.Password, prefix+".password", s.Password, "InfluxDB 1.x password")
+	pflag.StringVar(&s.PasswordFile, prefix+".password-file", s.PasswordFile, "Path to a file with the InfluxDB 1.x password, used instead of --"+prefix+".password")
+	pflag.StringVar(&s.Org, prefix+".org", s.Org, "InfluxDB 2.x organization")
+	pflag.StringVar(&s.Bucket, prefix+".bucket", s.Bucket, "InfluxDB 2.x bucket")
+	pflag.StringVar(&s.Token, prefix+".token", s.Token, "InfluxDB 2.x API token")
+	pflag.StringVar(&s.TokenFile, prefix+".token-file", s.TokenFile, "Path to a file with the InfluxDB 2.x API token, used instead of --"+prefix+".token")
+	pflag.StringVar(&s.Precision, prefix+".precision", s.Precision, "Timestamp precision: ns, us, ms or s")
+	pflag.IntVar(&s.Batch.MaxLines, prefix+".batch.max-lines", s.Batch.MaxLines, "Write events in batches of up to this many lines. Zero disables batching")
+	pflag.IntVar(&s.Batch.MaxBytes, prefix+".batch.max-bytes", s.Batch.MaxBytes, "Maximum size of a batch in bytes")
+	pflag.DurationVar(&s.Batch.FlushInterval, prefix+".batch.flush-interval", s.Batch.FlushInterval, "Write incomplete batches after this long")
+	pflag.StringVar(&s.Mapping.Measurement, prefix+".mapping.measurement", s.Mapping.Measurement, "InfluxDB measurement name")
+	pflag.StringSliceVar(&s.Mapping.Tags, prefix+".mapping.tags", s.Mapping.Tags, "Event keys written as tags")
+	pflag.StringSliceVar(&s.Mapping.Fields, prefix+".mapping.fields", s.Mapping.Fields, "Event keys written as string fields")
+	pflag.StringToStringVar(&s.Mapping.StaticTags, prefix+".mapping.static-tags", s.Mapping.StaticTags, "Tags added to every line, as key=value pairs")
+	pflag.StringVar(&s.Mapping.CountField, prefix+".mapping.count-field", s.Mapping.CountField, "Name of an integer field with the value 1. Empty to disable")
+	pflag.StringVar(&s.Mapping.RolloutDurationField, prefix+".mapping.rollout-duration-field", s.Mapping.RolloutDurationField, "Name of a field with the rollout duration in seconds. Empty to disable")
+	config.BindSubsystemFlags(&s.Subsystem, prefix)
+}
+
+func (s *Settings) Enabled() bool {
+	return len(s.URL) > 0
+}
+
+func (s *Settings) Validate(v *config.Validator, key string) {
+	v.URL(key+".url", s.URL)
+	v.Secret(key+".password", s.Password, s.PasswordFile)
+	v.Secret(key+".token", s.Token, s.TokenFile)
+	switch s.Version {
+	case Version1:
+		if len(s.Username) > 0 && len(s.Password) == 0 && len(s.PasswordFile) == 0 {
+			v.Errorf(key+".password", "password is required when a username is given")
+		}
+	case Version2:
+		if len(s.Org) == 0 {
+			v.Errorf(key+".org", "organization is required for InfluxDB 2.x")
+		}
+		if len(s.Bucket) == 0 {
+			v.Errorf(key+".bucket", "bucket is required for InfluxDB 2.x")
+		}
+		if len(s.Token) == 0 && len(s.TokenFile) == 0 {
+			v.Errorf(key+".token", "token is required for InfluxDB 2.x")
+		}
+	default:
+		v.Errorf(key+".version", "version must be 1 or 2")
+	}
+	if _, err := ParsePrecision(s.Precision); err != nil {
+		v.Errorf(key+".precision", "precision must be one of ns, us, ms or s")
+	}
+	if s.Batch.MaxLines < 0 {
+		v.Errorf(key+".batch.max-lines", "must be zero or greater")
+	}
+	if s.Batch.MaxLines > 0 && s.Batch.FlushInterval <= 0 {
+		v.Errorf(key+".batch.flush-interval", "must be greater than zero when batching is enabled")
+	}
+	if err := s.Mapping.Validate(); err != nil {
+		v.Errorf(key+".mapping", "%s", err)
+	}
+}
+
+// New builds an InfluxDB relay, which writes events in batches if batching is enabled.
+func New(name string, s Settings) (relay.Relay, error) {
+	mapper, err := NewMapper(s.Mapping)
+	if err != nil {
+		return relay.Relay{}, fmt.Errorf("configure mapping: %w", err)
+	}
+	password, err := secret.Load(s.Password, s.PasswordFile)
+	if err != nil {
+		return relay.Relay{}, fmt.Errorf("load password: %w", err)
+	}
+	token, err := secret.Load(s.Token, s.TokenFile)
+	if err != nil {
+		return relay.Relay{}, fmt.Errorf("load token: %w", err)
+	}
+	r := &Relay{
+		Version:   s.Version,
+		URL:       s.URL,
+		Username:  s.Username,
+		Password:  password,
+		Org:       s.Org,
+		Bucket:    s.Bucket,
+		Token:     token,
+		Precision: Precision(s.Precision),
+		Mapper:    mapper,
+		Client:    httpclient.New(name),
+	}
+	if err := r.Validate(); err != nil {
+		return relay.Relay{}, err
+	}
+
+	if s.Batch.MaxLines <= 0 {
+		return relay.Relay{Processor: r}, nil
+	}
+
+	batcher, err := NewBatcher(r, BatchConfig{
+		MaxLines:      s.Batch.MaxLines,
+		MaxBytes:      s.Batch.MaxBytes,
+		FlushInterval: s.Batch.FlushInterval,
+		Timeout:       s.Timeout,
+	})
+	if err != nil {
+		return relay.Relay{}, fmt.Errorf("configure batching: %w", err)
+	}
+	return relay.Relay{Processor: batcher, Closer: batcher.Close}, nil
+}
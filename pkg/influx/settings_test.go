@@ -0,0 +1,32 @@
+package influx_test
+
+import (
+	"testing"
+
+	"github.com/navikt/deployment-event-relays/pkg/config"
+	"github.com/navikt/deployment-event-relays/pkg/influx"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSettingsValidate(t *testing.T) {
+	settings := influx.DefaultSettings()
+	settings.URL = "http://influxdb"
+	settings.Version = influx.Version2
+	settings.Org = "nais"
+	settings.Precision = "h"
+
+	cfg := config.DefaultConfig()
+	cfg.Kafka.Brokers = []string{"localhost:9092"}
+	cfg.Kafka.Topic = "deployment-events"
+	cfg.Sections[influx.RelayType] = settings
+
+	err := config.Validate(cfg)
+	assert.EqualError(t, err, "influxdb.bucket: bucket is required for InfluxDB 2.x\n"+
+		"influxdb.token: token is required for InfluxDB 2.x\n"+
+		"influxdb.precision: precision must be one of ns, us, ms or s")
+
+	settings.Bucket = "deployments"
+	settings.TokenFile = "/var/run/secrets/influxdb/token"
+	settings.Precision = "s"
+	assert.NoError(t, config.Validate(cfg))
+}
@@ -3,117 +3,201 @@ package consumer
 import (
 	"context"
 	"crypto/tls"
-	"os"
+	"sync"
 	"time"
 
 	"github.com/Shopify/sarama"
+	"github.com/navikt/deployment-event-relays/pkg/metrics"
 	log "github.com/sirupsen/logrus"
 )
 
-type Callback func(message *sarama.ConsumerMessage, logger *log.Entry) (retry bool, err error)
+// Callback processes a single message. The context carries the processing deadline,
+// and is cancelled if the message must be abandoned because of a rebalance or shutdown.
+//
+// Errors are classified using the outcome package to decide whether the message is retried.
+type Callback func(ctx context.Context, message *sarama.ConsumerMessage, logger *log.Entry) error
 
+// Decoder parses a message once, before it is processed.
+// Messages that cannot be decoded are dropped. Without a decoder, messages are passed on as they are.
+type Decoder func(message *sarama.ConsumerMessage) (interface{}, error)
+
+type decodedKey struct{}
+
+// Decoded returns the value decoded from the message passed to the callback, or nil if the
+// message has not been decoded by the consumer.
+func Decoded(ctx context.Context) interface{} {
+	return ctx.Value(decodedKey{})
+}
+
+// DeadLetterFunc receives messages that have been permanently rejected.
+// If it returns an error, delivery is retried until it succeeds.
+type DeadLetterFunc func(message *sarama.ConsumerMessage, cause error) error
+
+// Consumer consumes the topic in a consumer group of its own, on behalf of a single subsystem.
 type Consumer struct {
-	callback      Callback
-	cancel        context.CancelFunc
-	consumer      sarama.ConsumerGroup
-	ctx           context.Context
-	groupID       string
-	logger        *log.Logger
-	retryInterval time.Duration
-	topic         string
+	*group
+	*handler
+	decode  Decoder
+	key     KeyFunc
+	workers int
+	// fetchLock makes sure that fetching is paused or resumed together with processing.
+	fetchLock sync.Mutex
+}
+
+// Status describes the state of a consumer, for use in health checks.
+type Status struct {
+	// Active is true while the consumer group has a session.
+	Active bool
+	// Paused is true while processing has been paused.
+	Paused bool
+	// Pausable is false if the subsystem cannot be paused on its own, because it shares a fan-out consumer group.
+	Pausable bool
+	// RetryingSince is when the oldest message that is currently being retried first failed.
+	// It is zero if no message is being retried.
+	RetryingSince time.Time
 }
 
 type Config struct {
 	Brokers           []string
 	Callback          Callback
+	DeadLetter        DeadLetterFunc
+	Decode            Decoder
 	GroupID           string
+	Key               KeyFunc
 	MaxProcessingTime time.Duration
 	Logger            *log.Logger
-	RetryInterval     time.Duration
+	Retry             RetryPolicy
+	Subsystem         string
+	Timeout           time.Duration
 	TlsConfig         *tls.Config
 	Topic             string
+	// Workers is the number of messages processed concurrently for each partition.
+	// Messages with the same ordering key are always processed in order.
+	Workers int
 }
 
-// Setup is run at the beginning of a new session, before ConsumeClaim
-func (c *Consumer) Setup(_ sarama.ConsumerGroupSession) error {
-	return nil
+// Status returns the current state of the consumer.
+func (c *Consumer) Status() Status {
+	return c.status(c.active.Load(), true)
 }
 
-// Cleanup is run at the end of a session, once all ConsumeClaim goroutines have exited
-func (c *Consumer) Cleanup(_ sarama.ConsumerGroupSession) error {
+// Pause stops fetching and processing messages until Resume is called.
+// The consumer group keeps its partitions while paused, and messages that were already fetched are held back.
+func (c *Consumer) Pause() error {
+	c.fetchLock.Lock()
+	defer c.fetchLock.Unlock()
+	c.handler.Pause()
+	c.consumer.PauseAll()
 	return nil
 }
 
+// Resume continues fetching and processing messages after Pause.
+func (c *Consumer) Resume() {
+	c.fetchLock.Lock()
+	defer c.fetchLock.Unlock()
+	c.consumer.ResumeAll()
+	c.handler.Resume()
+}
+
+// pauseClaim stops fetching from a newly claimed partition if the consumer is paused,
+// as partitions claimed after a rebalance are not paused by Pause.
+func (c *Consumer) pauseClaim(claim sarama.ConsumerGroupClaim) {
+	c.fetchLock.Lock()
+	defer c.fetchLock.Unlock()
+	if c.paused() {
+		c.consumer.Pause(map[string][]int32{claim.Topic(): {claim.Partition()}})
+	}
+}
+
 // ConsumeClaim must start a consumer loop of ConsumerGroupClaim's Messages().
+//
+// Messages are handed to a pool of workers, so that messages with different ordering keys
+// are processed concurrently. Offsets are only marked once all messages before them are complete.
+//
+// The loop exits as soon as the session context is cancelled, either because of a
+// rebalance or because the consumer is closing. On rebalance, the message being processed
+// is abandoned. On shutdown, it is allowed to finish until the shutdown deadline,
+// and so are any messages still waiting to be acknowledged.
+// A message waiting for retry is left unmarked so that it is picked up again by the next session.
 func (c *Consumer) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
-	var retry = true
-	var err error
-
-	for message := range claim.Messages() {
-		for retry {
-			logger := c.logger.WithFields(log.Fields{
-				"kafka_offset": message.Offset,
-			})
-			retry, err = c.callback(message, logger)
-			if err != nil {
-				logger.Errorf("Consume Kafka message: %s", err)
-				if retry {
-					time.Sleep(c.retryInterval)
+	ctx := session.Context()
+	processCtx, cancel := c.processContext(ctx)
+	defer cancel()
+
+	defer metrics.ForgetPartition(c.subsystem, claim.Partition())
+
+	c.pauseClaim(claim)
+
+	// The workers are stopped only once in-flight messages are done, as deferred messages
+	// that fail are queued on them again.
+	workers := newPool(c.workers)
+	defer workers.close()
+
+	tracker := newOffsetTracker()
+	defer tracker.wait(processCtx)
+
+	if claim.InitialOffset() >= 0 {
+		metrics.PartitionOffset(c.subsystem, claim.Partition(), claim.InitialOffset())
+	}
+	go watchHighWaterMark(ctx, claim, c.subsystem)
+
+	for {
+		select {
+		case message, ok := <-claim.Messages():
+			if !ok || ctx.Err() != nil {
+				return nil
+			}
+			metrics.HighWaterMark(c.subsystem, claim.Partition(), claim.HighWaterMarkOffset())
+			tracker.add(message.Offset)
+			d := newDelivery(message, c.decode, c.key, c.group.logger)
+			d.complete = func() {
+				offset, ok := tracker.complete(message.Offset)
+				if ok {
+					session.MarkOffset(message.Topic, message.Partition, offset+1, "")
+					metrics.PartitionOffset(c.subsystem, message.Partition, offset+1)
 				}
 			}
+			abandon := func() {
+				tracker.abandon(message.Offset)
+			}
+			requeue := func(task func()) bool {
+				return workers.submit(ctx, d.key, task)
+			}
+			if !workers.submit(ctx, d.key, func() { c.handle(ctx, processCtx, d, d.complete, abandon, requeue) }) {
+				abandon()
+				return nil
+			}
+		case <-ctx.Done():
+			return nil
 		}
-		retry, err = true, nil
-		session.MarkMessage(message, "")
 	}
-	return nil
 }
 
 func New(cfg Config) (*Consumer, error) {
-	config := sarama.NewConfig()
-	config.Net.TLS.Enable = true
-	config.Net.TLS.Config = cfg.TlsConfig
-	config.Version = sarama.V2_6_0_0
-	config.Consumer.Offsets.Initial = sarama.OffsetOldest
-	config.Consumer.MaxProcessingTime = cfg.MaxProcessingTime
-	config.ClientID, _ = os.Hostname()
-
-	consumer, err := sarama.NewConsumerGroup(cfg.Brokers, cfg.GroupID, config)
+	h, err := newHandler(Subscriber{
+		Callback:   cfg.Callback,
+		DeadLetter: cfg.DeadLetter,
+		Retry:      cfg.Retry,
+		Subsystem:  cfg.Subsystem,
+		Timeout:    cfg.Timeout,
+	}, cfg.Logger)
 	if err != nil {
 		return nil, err
 	}
 
-	c := &Consumer{
-		callback:      cfg.Callback,
-		consumer:      consumer,
-		groupID:       cfg.GroupID,
-		logger:        cfg.Logger,
-		retryInterval: cfg.RetryInterval,
-		topic:         cfg.Topic,
+	g, err := newGroup(cfg.Brokers, cfg.GroupID, cfg.Topic, sarama.OffsetOldest, cfg.TlsConfig, cfg.MaxProcessingTime, cfg.Logger)
+	if err != nil {
+		return nil, err
 	}
 
-	c.ctx, c.cancel = context.WithCancel(context.Background())
-
-	go func() {
-		for err := range c.consumer.Errors() {
-			c.logger.Errorf("Consumer encountered error: %s", err)
-		}
-	}()
-
-	go func() {
-		for {
-			c.logger.Infof("(re-)starting consumer on topic %s", cfg.Topic)
-			err := c.consumer.Consume(c.ctx, []string{cfg.Topic}, c)
-			if err != nil {
-				c.logger.Errorf("Error setting up consumer: %s", err)
-			}
-			// check if context was cancelled, signaling that the consumer should stop
-			if c.ctx.Err() != nil {
-				c.logger.Errorf("Consumer context error: %s", c.ctx.Err())
-				c.ctx, c.cancel = context.WithCancel(context.Background())
-			}
-			time.Sleep(10 * time.Second)
-		}
-	}()
+	c := &Consumer{
+		group:   g,
+		handler: h,
+		decode:  cfg.Decode,
+		key:     cfg.Key,
+		workers: cfg.Workers,
+	}
+	g.start(c)
 
 	return c, nil
 }
@@ -0,0 +1,618 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/navikt/deployment-event-relays/pkg/outcome"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeSession struct {
+	ctx    context.Context
+	lock   sync.Mutex
+	marked map[int32]int64
+}
+
+func newFakeSession(ctx context.Context) *fakeSession {
+	return &fakeSession{ctx: ctx, marked: make(map[int32]int64)}
+}
+
+func (s *fakeSession) Claims() map[string][]int32 { return nil }
+func (s *fakeSession) MemberID() string           { return "" }
+func (s *fakeSession) GenerationID() int32        { return 0 }
+func (s *fakeSession) Commit()                    {}
+func (s *fakeSession) Context() context.Context   { return s.ctx }
+func (s *fakeSession) ResetOffset(topic string, partition int32, offset int64, metadata string) {
+}
+func (s *fakeSession) MarkMessage(msg *sarama.ConsumerMessage, metadata string) {
+	s.MarkOffset(msg.Topic, msg.Partition, msg.Offset+1, metadata)
+}
+func (s *fakeSession) MarkOffset(topic string, partition int32, offset int64, metadata string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if offset > s.marked[partition] {
+		s.marked[partition] = offset
+	}
+}
+func (s *fakeSession) offset(partition int32) int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.marked[partition]
+}
+
+type fakeClaim struct {
+	partition int32
+	messages  chan *sarama.ConsumerMessage
+}
+
+func newFakeClaim(partition int32, offsets ...int64) *fakeClaim {
+	claim := &fakeClaim{
+		partition: partition,
+		messages:  make(chan *sarama.ConsumerMessage, len(offsets)),
+	}
+	for _, offset := range offsets {
+		claim.messages <- &sarama.ConsumerMessage{Topic: "topic", Partition: partition, Offset: offset}
+	}
+	close(claim.messages)
+	return claim
+}
+
+func (c *fakeClaim) Topic() string                            { return "topic" }
+func (c *fakeClaim) Partition() int32                         { return c.partition }
+func (c *fakeClaim) InitialOffset() int64                     { return 0 }
+func (c *fakeClaim) HighWaterMarkOffset() int64               { return 0 }
+func (c *fakeClaim) Messages() <-chan *sarama.ConsumerMessage { return c.messages }
+
+// fakeConsumerGroup runs a single session with one claim, which is never closed by the broker.
+type fakeConsumerGroup struct {
+	session  *fakeSession
+	messages chan *sarama.ConsumerMessage
+	closed   bool
+	lock     sync.Mutex
+	paused   map[int32]bool
+}
+
+func newFakeConsumerGroup(offsets ...int64) *fakeConsumerGroup {
+	messages := make(chan *sarama.ConsumerMessage, len(offsets))
+	for _, offset := range offsets {
+		messages <- &sarama.ConsumerMessage{Topic: "topic", Offset: offset}
+	}
+	return &fakeConsumerGroup{messages: messages, paused: make(map[int32]bool)}
+}
+
+func (g *fakeConsumerGroup) Consume(ctx context.Context, topics []string, handler sarama.ConsumerGroupHandler) error {
+	g.session = newFakeSession(ctx)
+	err := handler.Setup(g.session)
+	if err != nil {
+		return err
+	}
+	err = handler.ConsumeClaim(g.session, &fakeClaim{messages: g.messages})
+	<-ctx.Done()
+	return errors.Join(err, handler.Cleanup(g.session))
+}
+
+func (g *fakeConsumerGroup) Errors() <-chan error {
+	errs := make(chan error)
+	close(errs)
+	return errs
+}
+
+func (g *fakeConsumerGroup) Pause(partitions map[string][]int32) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	for _, partition := range partitions["topic"] {
+		g.paused[partition] = true
+	}
+}
+
+func (g *fakeConsumerGroup) Resume(partitions map[string][]int32) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	for _, partition := range partitions["topic"] {
+		delete(g.paused, partition)
+	}
+}
+
+// PauseAll pauses the only partition of the fake group.
+func (g *fakeConsumerGroup) PauseAll() {
+	g.Pause(map[string][]int32{"topic": {0}})
+}
+
+func (g *fakeConsumerGroup) ResumeAll() {
+	g.Resume(map[string][]int32{"topic": {0}})
+}
+
+func (g *fakeConsumerGroup) isPaused(partition int32) bool {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return g.paused[partition]
+}
+
+func (g *fakeConsumerGroup) Close() error {
+	g.closed = true
+	return nil
+}
+
+func testGroup() *group {
+	g := &group{
+		consumer: newFakeConsumerGroup(),
+		logger:   log.New(),
+	}
+	g.ctx, g.cancel = context.WithCancel(context.Background())
+	g.processCtx, g.processCancel = context.WithCancel(context.Background())
+	return g
+}
+
+func testHandler(subsystem string, callback Callback) *handler {
+	return &handler{
+		callback:  callback,
+		logger:    log.New(),
+		retrying:  make(map[*sarama.ConsumerMessage]time.Time),
+		subsystem: subsystem,
+		retry: RetryPolicy{
+			InitialBackoff: time.Millisecond,
+			MaxBackoff:     time.Millisecond,
+			Multiplier:     1,
+			Fallback:       FallbackBlock,
+		},
+	}
+}
+
+func testConsumer(callback Callback) *Consumer {
+	return &Consumer{
+		group:   testGroup(),
+		handler: testHandler("test", callback),
+	}
+}
+
+func TestConsumeClaimRetriesAndMarks(t *testing.T) {
+	attempts := make(map[int64]int)
+	c := testConsumer(func(ctx context.Context, message *sarama.ConsumerMessage, logger *log.Entry) error {
+		attempts[message.Offset]++
+		switch {
+		case message.Offset == 1 && attempts[message.Offset] < 3:
+			return fmt.Errorf("transient")
+		case message.Offset == 2:
+			return outcome.Permanent(fmt.Errorf("permanent"))
+		case message.Offset == 3:
+			return outcome.Skipped(fmt.Errorf("skipped"))
+		}
+		return nil
+	})
+
+	session := newFakeSession(context.Background())
+	err := c.ConsumeClaim(session, newFakeClaim(0, 0, 1, 2, 3, 4))
+	assert.NoError(t, err)
+
+	assert.Equal(t, map[int64]int{0: 1, 1: 3, 2: 1, 3: 1, 4: 1}, attempts)
+	assert.Equal(t, int64(5), session.offset(0))
+}
+
+func TestConsumeClaimFallbackDeadLetter(t *testing.T) {
+	deadLetters := make([]int64, 0)
+	c := testConsumer(func(ctx context.Context, message *sarama.ConsumerMessage, logger *log.Entry) error {
+		if message.Offset == 1 {
+			return fmt.Errorf("transient")
+		}
+		return nil
+	})
+	c.retry.MaxAttempts = 3
+	c.retry.Fallback = FallbackDeadLetter
+	c.deadLetter = func(message *sarama.ConsumerMessage, cause error) error {
+		deadLetters = append(deadLetters, message.Offset)
+		return nil
+	}
+
+	session := newFakeSession(context.Background())
+	err := c.ConsumeClaim(session, newFakeClaim(0, 0, 1, 2))
+	assert.NoError(t, err)
+
+	assert.Equal(t, []int64{1}, deadLetters)
+	assert.Equal(t, int64(3), session.offset(0))
+}
+
+func TestConsumeClaimDeferred(t *testing.T) {
+	acks := make(map[int64]Ack)
+	var lock sync.Mutex
+
+	c := testConsumer(func(ctx context.Context, message *sarama.ConsumerMessage, logger *log.Entry) error {
+		lock.Lock()
+		defer lock.Unlock()
+		acks[message.Offset] = Defer(ctx)
+		return nil
+	})
+
+	session := newFakeSession(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- c.ConsumeClaim(session, newFakeClaim(0, 0, 1, 2))
+	}()
+
+	assert.Eventually(t, func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return len(acks) == 3
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, int64(0), session.offset(0))
+
+	// out-of-order acknowledgement only commits contiguous messages
+	acks[1](nil)
+	assert.Equal(t, int64(0), session.offset(0))
+	acks[0](nil)
+	assert.Equal(t, int64(2), session.offset(0))
+
+	// ConsumeClaim waits for outstanding acknowledgements before returning
+	select {
+	case <-done:
+		t.Fatal("ConsumeClaim returned with messages in flight")
+	case <-time.After(time.Millisecond * 10):
+	}
+
+	acks[2](nil)
+	assert.NoError(t, <-done)
+	assert.Equal(t, int64(3), session.offset(0))
+}
+
+func TestConsumeClaimDeferredRetries(t *testing.T) {
+	var lock sync.Mutex
+	attempts := make(map[int64]int)
+
+	c := testConsumer(func(ctx context.Context, message *sarama.ConsumerMessage, logger *log.Entry) error {
+		lock.Lock()
+		attempts[message.Offset]++
+		attempt := attempts[message.Offset]
+		lock.Unlock()
+
+		ack := Defer(ctx)
+		go func() {
+			switch {
+			case message.Offset == 0 && attempt < 3:
+				ack(fmt.Errorf("transient"))
+			case message.Offset == 1:
+				ack(outcome.RateLimited(fmt.Errorf("slow down"), time.Millisecond))
+			default:
+				ack(nil)
+			}
+		}()
+		return nil
+	})
+	c.retry.MaxAttempts = 3
+	c.retry.Fallback = FallbackDrop
+
+	session := newFakeSession(context.Background())
+	err := c.ConsumeClaim(session, newFakeClaim(0, 0, 1, 2))
+	assert.NoError(t, err)
+
+	// the first message succeeds on the third attempt, the second is dropped once retries are exhausted
+	assert.Equal(t, map[int64]int{0: 3, 1: 3, 2: 1}, attempts)
+	assert.Equal(t, int64(3), session.offset(0))
+}
+
+func TestConsumeClaimDeferredRetriesOnWorker(t *testing.T) {
+	release := make(chan struct{})
+	var lock sync.Mutex
+	var order []int64
+
+	c := testConsumer(func(ctx context.Context, message *sarama.ConsumerMessage, logger *log.Entry) error {
+		lock.Lock()
+		order = append(order, message.Offset)
+		retried := len(order) > 2
+		lock.Unlock()
+
+		switch {
+		case message.Offset == 0 && !retried:
+			ack := Defer(ctx)
+			go ack(fmt.Errorf("transient"))
+		case message.Offset == 1:
+			<-release
+		}
+		return nil
+	})
+
+	session := newFakeSession(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- c.ConsumeClaim(session, newFakeClaim(0, 0, 1))
+	}()
+
+	// the failed deferred message is retried on the single worker, which is busy with the second message
+	assert.Eventually(t, func() bool {
+		return !c.Status().RetryingSince.IsZero()
+	}, time.Second, time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	lock.Lock()
+	assert.Equal(t, []int64{0, 1}, order)
+	lock.Unlock()
+
+	close(release)
+	assert.NoError(t, <-done)
+	assert.Equal(t, []int64{0, 1, 0}, order)
+	assert.Equal(t, int64(2), session.offset(0))
+}
+
+func TestConsumeClaimDeferredShutdownDuringRetry(t *testing.T) {
+	failing := make(chan struct{})
+	var once sync.Once
+	c := testConsumer(func(ctx context.Context, message *sarama.ConsumerMessage, logger *log.Entry) error {
+		ack := Defer(ctx)
+		go func() {
+			ack(fmt.Errorf("transient"))
+			once.Do(func() { close(failing) })
+		}()
+		return nil
+	})
+	c.retry.InitialBackoff = time.Hour
+	c.retry.MaxBackoff = time.Hour
+
+	session := newFakeSession(c.ctx)
+	done := make(chan error)
+	go func() {
+		done <- c.ConsumeClaim(session, newFakeClaim(0, 0))
+	}()
+
+	<-failing
+	assert.Eventually(t, func() bool {
+		return !c.Status().RetryingSince.IsZero()
+	}, time.Second, time.Millisecond)
+
+	// the deferred message waiting for retry is abandoned, and must not hold up shutdown
+	c.cancel()
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("ConsumeClaim did not return while a deferred message was waiting for retry")
+	}
+	assert.Equal(t, int64(0), session.offset(0))
+}
+
+func TestConsumeClaimAbandonsOnRebalance(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := testConsumer(func(callbackCtx context.Context, message *sarama.ConsumerMessage, logger *log.Entry) error {
+		cancel()
+		<-callbackCtx.Done()
+		return callbackCtx.Err()
+	})
+
+	session := newFakeSession(ctx)
+	err := c.ConsumeClaim(session, newFakeClaim(0, 0, 1))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), session.offset(0))
+}
+
+func TestStatusReportsRetries(t *testing.T) {
+	failing := make(chan struct{})
+	var once sync.Once
+	c := testConsumer(func(ctx context.Context, message *sarama.ConsumerMessage, logger *log.Entry) error {
+		once.Do(func() { close(failing) })
+		return fmt.Errorf("transient")
+	})
+	c.retry.InitialBackoff = time.Hour
+	c.retry.MaxBackoff = time.Hour
+
+	assert.NoError(t, c.Setup(nil))
+	assert.True(t, c.Status().Active)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = c.ConsumeClaim(newFakeSession(ctx), newFakeClaim(0, 0))
+	}()
+
+	<-failing
+	assert.Eventually(t, func() bool {
+		return !c.Status().RetryingSince.IsZero()
+	}, time.Second, time.Millisecond)
+
+	cancel()
+	<-done
+	assert.True(t, c.Status().RetryingSince.IsZero())
+
+	assert.NoError(t, c.Cleanup(nil))
+	assert.False(t, c.Status().Active)
+}
+
+func TestConsumeClaimWorkersPreserveKeyOrder(t *testing.T) {
+	release := make(chan struct{})
+	var lock sync.Mutex
+	processed := make(map[string][]int64)
+
+	c := testConsumer(func(ctx context.Context, message *sarama.ConsumerMessage, logger *log.Entry) error {
+		key := Decoded(ctx).(string)
+		if message.Offset == 0 {
+			<-release
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		processed[key] = append(processed[key], message.Offset)
+		return nil
+	})
+	c.workers = 2
+	// "a" and "b" are handled by different workers
+	c.decode = func(message *sarama.ConsumerMessage) (interface{}, error) {
+		return []string{"a", "b"}[message.Offset%2], nil
+	}
+	c.key = func(message *sarama.ConsumerMessage, decoded interface{}) string {
+		return decoded.(string)
+	}
+
+	session := newFakeSession(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- c.ConsumeClaim(session, newFakeClaim(0, 0, 1, 2, 3, 4, 5))
+	}()
+
+	// messages for "b" are processed while the first message for "a" is blocked, but nothing is committed
+	assert.Eventually(t, func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return len(processed["b"]) == 3
+	}, time.Second, time.Millisecond)
+	assert.Empty(t, processed["a"])
+	assert.Equal(t, int64(0), session.offset(0))
+
+	close(release)
+	assert.NoError(t, <-done)
+	assert.Equal(t, []int64{0, 2, 4}, processed["a"])
+	assert.Equal(t, []int64{1, 3, 5}, processed["b"])
+	assert.Equal(t, int64(6), session.offset(0))
+}
+
+func TestConsumeClaimShutdownDuringRetry(t *testing.T) {
+	failing := make(chan struct{})
+	var once sync.Once
+	c := testConsumer(func(ctx context.Context, message *sarama.ConsumerMessage, logger *log.Entry) error {
+		once.Do(func() { close(failing) })
+		return fmt.Errorf("transient")
+	})
+	c.retry.InitialBackoff = time.Hour
+	c.retry.MaxBackoff = time.Hour
+
+	done := make(chan error)
+	go func() {
+		done <- c.ConsumeClaim(newFakeSession(c.ctx), newFakeClaim(0, 0, 1))
+	}()
+
+	// closing the consumer ends the session without cancelling processing,
+	// and the message waiting for retry must not hold up shutdown
+	<-failing
+	c.cancel()
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("ConsumeClaim did not return while a message was waiting for retry")
+	}
+}
+
+func TestPauseAndResume(t *testing.T) {
+	var lock sync.Mutex
+	processed := make([]int64, 0)
+	c := testConsumer(func(ctx context.Context, message *sarama.ConsumerMessage, logger *log.Entry) error {
+		lock.Lock()
+		defer lock.Unlock()
+		processed = append(processed, message.Offset)
+		return nil
+	})
+
+	fake := newFakeConsumerGroup()
+	c.consumer = fake
+
+	assert.True(t, c.Status().Pausable)
+	assert.NoError(t, c.Pause())
+	assert.True(t, c.Status().Paused)
+	assert.True(t, fake.isPaused(0))
+
+	// partitions claimed while paused are not fetched either
+	fake.ResumeAll()
+	session := newFakeSession(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- c.ConsumeClaim(session, newFakeClaim(0, 0, 1))
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	lock.Lock()
+	assert.Empty(t, processed)
+	lock.Unlock()
+	assert.True(t, fake.isPaused(0))
+
+	c.Resume()
+	assert.False(t, c.Status().Paused)
+	assert.False(t, fake.isPaused(0))
+	assert.NoError(t, <-done)
+	assert.Equal(t, []int64{0, 1}, processed)
+	assert.Equal(t, int64(2), session.offset(0))
+}
+
+func TestShutdownWhilePaused(t *testing.T) {
+	c := testConsumer(func(ctx context.Context, message *sarama.ConsumerMessage, logger *log.Entry) error {
+		return nil
+	})
+	c.Pause()
+
+	done := make(chan error)
+	session := newFakeSession(c.ctx)
+	go func() {
+		done <- c.ConsumeClaim(session, newFakeClaim(0, 0))
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	c.cancel()
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("ConsumeClaim did not return while paused")
+	}
+	assert.Equal(t, int64(0), session.offset(0))
+}
+
+func TestCloseWaitsForInFlightMessages(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	c := testConsumer(func(ctx context.Context, message *sarama.ConsumerMessage, logger *log.Entry) error {
+		close(started)
+		<-release
+		return ctx.Err()
+	})
+	fake := newFakeConsumerGroup(0)
+	c.consumer = fake
+	c.done = make(chan struct{})
+	c.start(c)
+	<-started
+
+	closed := make(chan error)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		closed <- c.Close(ctx)
+	}()
+
+	select {
+	case <-closed:
+		t.Fatal("Close returned while a message was in flight")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	close(release)
+	assert.NoError(t, <-closed)
+	assert.Equal(t, int64(1), fake.session.offset(0))
+	assert.True(t, fake.closed)
+}
+
+func TestCloseCancelsInFlightMessagesAtDeadline(t *testing.T) {
+	started := make(chan struct{})
+	cancelled := make(chan struct{})
+	c := testConsumer(func(ctx context.Context, message *sarama.ConsumerMessage, logger *log.Entry) error {
+		close(started)
+		<-ctx.Done()
+		close(cancelled)
+		return ctx.Err()
+	})
+	c.groupID = "test"
+	c.consumer = newFakeConsumerGroup(0)
+	c.done = make(chan struct{})
+	c.start(c)
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err := c.Close(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.EqualError(t, err, "close consumer group test: context deadline exceeded")
+
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("in-flight message was not cancelled at the shutdown deadline")
+	}
+}
@@ -0,0 +1,52 @@
+package consumer
+
+import (
+	"context"
+	"sync"
+)
+
+// Ack reports the final result of a message whose processing was deferred with Defer.
+type Ack func(err error)
+
+type deferralKey struct{}
+
+// deferral is attached to the callback context, and records whether the callback deferred the message.
+type deferral struct {
+	lock      sync.Mutex
+	deferred  bool
+	cancelled bool
+	ack       Ack
+}
+
+// Defer tells the consumer that the message passed to the callback will be acknowledged later,
+// for instance after it has been written as part of a batch. The returned function must be called exactly once,
+// with the result of processing. The offset of the message is not committed until it has been acknowledged.
+//
+// Defer must be called from within the callback, and the callback must return nil,
+// otherwise the message is processed as if Defer was never called.
+//
+// Acknowledging with a retriable error makes the consumer retry the message according to its retry policy,
+// by running the callback again.
+func Defer(ctx context.Context) Ack {
+	d, ok := ctx.Value(deferralKey{}).(*deferral)
+	if !ok {
+		return func(error) {}
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.deferred = true
+	return d.ack
+}
+
+// cancel revokes the deferral, so that a later acknowledgement is ignored.
+func (d *deferral) cancel() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.cancelled = true
+}
+
+func (d *deferral) isDeferred() bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.deferred && !d.cancelled
+}
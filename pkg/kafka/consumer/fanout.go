@@ -0,0 +1,241 @@
+package consumer
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/navikt/deployment-event-relays/pkg/metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrPauseUnsupported is returned when pausing a subscriber of a fan-out consumer.
+var ErrPauseUnsupported = fmt.Errorf("subsystems that share a fan-out consumer group cannot be paused individually")
+
+// FanOut consumes the topic in a single consumer group, and dispatches each message to all of its subscribers.
+//
+// Each subscriber processes messages from an in-memory queue of its own, so that a subscriber that is
+// retrying a message does not hold up the others until its queue is full. Offsets are committed once
+// every subscriber has completed a message, while progress is reported per subscriber.
+type FanOut struct {
+	*group
+	decode    Decoder
+	handlers  []*handler
+	key       KeyFunc
+	queueSize int
+	workers   int
+}
+
+type FanOutConfig struct {
+	Brokers           []string
+	Decode            Decoder
+	GroupID           string
+	Key               KeyFunc
+	MaxProcessingTime time.Duration
+	Logger            *log.Logger
+	QueueSize         int
+	// SeedGroupIDs are the consumer groups that a new fan-out group continues from; see NewFanOut.
+	SeedGroupIDs []string
+	Subscribers  []Subscriber
+	TlsConfig    *tls.Config
+	Topic        string
+	Workers      int
+}
+
+// Subscription is the part of a fan-out consumer that processes messages on behalf of a single subscriber.
+type Subscription struct {
+	*handler
+	group *group
+}
+
+// Status returns the current state of the consumer on behalf of the subscriber.
+func (s *Subscription) Status() Status {
+	return s.status(s.group.active.Load(), false)
+}
+
+// Pause always fails with ErrPauseUnsupported. Messages are fetched for all subscribers together,
+// so a paused subscriber would hold up the others as soon as its queue is full.
+func (s *Subscription) Pause() error {
+	return ErrPauseUnsupported
+}
+
+// Subscription returns the subscription of the given subsystem, or nil if it is not a subscriber.
+func (f *FanOut) Subscription(subsystem string) *Subscription {
+	for _, h := range f.handlers {
+		if h.subsystem == subsystem {
+			return &Subscription{handler: h, group: f.group}
+		}
+	}
+	return nil
+}
+
+// ConsumeClaim decodes each message of the claim and hands it to the queue of every subscriber,
+// blocking while any queue is full.
+//
+// The session ends for all subscribers together. On shutdown, each subscriber is allowed to finish the message
+// it is processing, while messages that are still queued are left uncommitted.
+func (f *FanOut) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	ctx := session.Context()
+	processCtx, cancel := f.processContext(ctx)
+	defer cancel()
+
+	subsystems := make([]string, len(f.handlers))
+	for i, h := range f.handlers {
+		subsystems[i] = h.subsystem
+		defer metrics.ForgetPartition(h.subsystem, claim.Partition())
+		if claim.InitialOffset() >= 0 {
+			metrics.PartitionOffset(h.subsystem, claim.Partition(), claim.InitialOffset())
+		}
+	}
+	go watchHighWaterMark(ctx, claim, subsystems...)
+
+	wg := &sync.WaitGroup{}
+	defer wg.Wait()
+
+	queues := make([]chan *delivery, len(f.handlers))
+	for i, h := range f.handlers {
+		queues[i] = make(chan *delivery, f.queueSize)
+		defer close(queues[i])
+		wg.Add(1)
+		go func(h *handler, queue <-chan *delivery) {
+			defer wg.Done()
+			f.work(ctx, processCtx, h, claim.Partition(), queue)
+		}(h, queues[i])
+	}
+
+	tracker := newOffsetTracker()
+
+	for {
+		select {
+		case message, ok := <-claim.Messages():
+			if !ok || ctx.Err() != nil {
+				return nil
+			}
+			for _, subsystem := range subsystems {
+				metrics.HighWaterMark(subsystem, claim.Partition(), claim.HighWaterMarkOffset())
+			}
+			tracker.add(message.Offset)
+
+			remaining := &atomic.Int32{}
+			remaining.Store(int32(len(f.handlers)))
+			d := newDelivery(message, f.decode, f.key, f.logger)
+			d.complete = func() {
+				if remaining.Add(-1) > 0 {
+					return
+				}
+				offset, ok := tracker.complete(message.Offset)
+				if ok {
+					session.MarkOffset(message.Topic, message.Partition, offset+1, "")
+				}
+			}
+
+			for _, queue := range queues {
+				select {
+				case queue <- d:
+				case <-ctx.Done():
+					return nil
+				}
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// work processes the messages queued for a single subscriber until the queue is closed or ctx is cancelled.
+// Messages are processed concurrently by the configured number of workers, in order for each ordering key.
+// Before returning, it waits for messages still being processed or waiting to be acknowledged.
+func (f *FanOut) work(ctx, processCtx context.Context, h *handler, partition int32, queue <-chan *delivery) {
+	// The workers are stopped only once in-flight messages are done, as deferred messages
+	// that fail are queued on them again.
+	workers := newPool(f.workers)
+	defer workers.close()
+
+	tracker := newOffsetTracker()
+	defer tracker.wait(processCtx)
+
+	for {
+		select {
+		case d, ok := <-queue:
+			if !ok || ctx.Err() != nil {
+				return
+			}
+			tracker.add(d.message.Offset)
+			complete := func() {
+				offset, ok := tracker.complete(d.message.Offset)
+				if ok {
+					metrics.PartitionOffset(h.subsystem, partition, offset+1)
+				}
+				d.complete()
+			}
+			abandon := func() {
+				tracker.abandon(d.message.Offset)
+			}
+			requeue := func(task func()) bool {
+				return workers.submit(ctx, d.key, task)
+			}
+			if !workers.submit(ctx, d.key, func() { h.handle(ctx, processCtx, d, complete, abandon, requeue) }) {
+				abandon()
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// NewFanOut creates a consumer that dispatches every message to all subscribers.
+//
+// For partitions where the fan-out group has not committed an offset yet, it starts from the lowest offset
+// committed by the seed groups, usually the groups that the subscribers used before switching to fan-out mode.
+// No messages are lost when switching, but subscribers that were ahead of the others see some messages again.
+// If any seed group has not committed an offset for a partition either, the partition is read from the oldest offset,
+// like a new per-subsystem group would.
+func NewFanOut(cfg FanOutConfig) (*FanOut, error) {
+	if cfg.QueueSize <= 0 {
+		return nil, fmt.Errorf("queue size must be greater than zero")
+	}
+
+	handlers := make([]*handler, 0, len(cfg.Subscribers))
+	for _, sub := range cfg.Subscribers {
+		h, err := newHandler(sub, cfg.Logger)
+		if err != nil {
+			return nil, fmt.Errorf("subscriber %s: %w", sub.Subsystem, err)
+		}
+		handlers = append(handlers, h)
+	}
+
+	if len(cfg.SeedGroupIDs) > 0 {
+		client, err := sarama.NewClient(cfg.Brokers, newConfig(cfg.TlsConfig, cfg.MaxProcessingTime))
+		if err != nil {
+			return nil, err
+		}
+		err = seedGroup(client, cfg.GroupID, cfg.Topic, cfg.SeedGroupIDs, cfg.Logger)
+		_ = client.Close()
+		if err != nil {
+			return nil, fmt.Errorf("seed offsets from %s: %w", strings.Join(cfg.SeedGroupIDs, ", "), err)
+		}
+	}
+
+	g, err := newGroup(cfg.Brokers, cfg.GroupID, cfg.Topic, sarama.OffsetOldest, cfg.TlsConfig, cfg.MaxProcessingTime, cfg.Logger)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &FanOut{
+		group:     g,
+		decode:    cfg.Decode,
+		handlers:  handlers,
+		key:       cfg.Key,
+		queueSize: cfg.QueueSize,
+		workers:   cfg.Workers,
+	}
+	g.start(f)
+
+	return f, nil
+}
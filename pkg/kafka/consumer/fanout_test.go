@@ -0,0 +1,159 @@
+package consumer
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func testFanOut(queueSize int, decode Decoder, handlers ...*handler) *FanOut {
+	return &FanOut{
+		group:     testGroup(),
+		decode:    decode,
+		handlers:  handlers,
+		queueSize: queueSize,
+	}
+}
+
+// recorder collects the decoded values seen by a subscriber.
+type recorder struct {
+	lock   sync.Mutex
+	values []interface{}
+}
+
+func (r *recorder) callback(ctx context.Context, message *sarama.ConsumerMessage, logger *log.Entry) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.values = append(r.values, Decoded(ctx))
+	return nil
+}
+
+func (r *recorder) seen() []interface{} {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]interface{}{}, r.values...)
+}
+
+func TestFanOutDecodesOnceAndDispatchesToAll(t *testing.T) {
+	decoded := 0
+	decode := func(message *sarama.ConsumerMessage) (interface{}, error) {
+		decoded++
+		if message.Offset == 2 {
+			return nil, fmt.Errorf("unknown message type")
+		}
+		return message.Offset * 10, nil
+	}
+
+	attempts := 0
+	reliable := &recorder{}
+	flaky := &recorder{}
+	f := testFanOut(10, decode,
+		testHandler("reliable", reliable.callback),
+		testHandler("flaky", func(ctx context.Context, message *sarama.ConsumerMessage, logger *log.Entry) error {
+			if message.Offset == 1 {
+				attempts++
+				if attempts < 3 {
+					return fmt.Errorf("transient")
+				}
+			}
+			return flaky.callback(ctx, message, logger)
+		}),
+	)
+
+	session := newFakeSession(context.Background())
+	err := f.ConsumeClaim(session, newFakeClaim(0, 0, 1, 2, 3))
+	assert.NoError(t, err)
+
+	assert.Equal(t, 4, decoded)
+	assert.Equal(t, 3, attempts)
+	assert.Equal(t, []interface{}{int64(0), int64(10), int64(30)}, reliable.seen())
+	assert.Equal(t, []interface{}{int64(0), int64(10), int64(30)}, flaky.seen())
+	assert.Equal(t, int64(4), session.offset(0))
+}
+
+func TestFanOutCommitsOnlyWhenAllSubscribersComplete(t *testing.T) {
+	const queueSize = 2
+	// the slow subscriber holds one message in its callback, one waiting for a free worker,
+	// and fills both its worker queue and its subscriber queue, which stops dispatch to the fast subscriber
+	const absorbed = 1 + workerQueueSize + 1 + queueSize
+
+	release := make(chan struct{})
+	fast := &recorder{}
+	f := testFanOut(queueSize, nil,
+		testHandler("fast", fast.callback),
+		testHandler("slow", func(ctx context.Context, message *sarama.ConsumerMessage, logger *log.Entry) error {
+			<-release
+			return nil
+		}),
+	)
+
+	offsets := make([]int64, absorbed+5)
+	for i := range offsets {
+		offsets[i] = int64(i)
+	}
+
+	session := newFakeSession(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- f.ConsumeClaim(session, newFakeClaim(0, offsets...))
+	}()
+
+	assert.Eventually(t, func() bool {
+		return len(fast.seen()) == absorbed+1
+	}, time.Second, time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	assert.Len(t, fast.seen(), absorbed+1)
+	assert.Equal(t, int64(0), session.offset(0))
+
+	close(release)
+	assert.NoError(t, <-done)
+	assert.Len(t, fast.seen(), len(offsets))
+	assert.Equal(t, int64(len(offsets)), session.offset(0))
+}
+
+func TestFanOutStatus(t *testing.T) {
+	failing := make(chan struct{})
+	var once sync.Once
+	failer := testHandler("failing", func(ctx context.Context, message *sarama.ConsumerMessage, logger *log.Entry) error {
+		once.Do(func() { close(failing) })
+		return fmt.Errorf("transient")
+	})
+	failer.retry.InitialBackoff = time.Hour
+	failer.retry.MaxBackoff = time.Hour
+	f := testFanOut(1, nil, failer, testHandler("ok", (&recorder{}).callback))
+
+	assert.NoError(t, f.Setup(nil))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = f.ConsumeClaim(newFakeSession(ctx), newFakeClaim(0, 0))
+	}()
+
+	<-failing
+	assert.Eventually(t, func() bool {
+		return !f.Subscription("failing").Status().RetryingSince.IsZero()
+	}, time.Second, time.Millisecond)
+	assert.True(t, f.Subscription("failing").Status().Active)
+	assert.True(t, f.Subscription("ok").Status().RetryingSince.IsZero())
+
+	cancel()
+	<-done
+	assert.True(t, f.Subscription("failing").Status().RetryingSince.IsZero())
+}
+
+func TestFanOutSubscriptionCannotPause(t *testing.T) {
+	f := testFanOut(1, nil, testHandler("ok", (&recorder{}).callback))
+	sub := f.Subscription("ok")
+
+	assert.False(t, sub.Status().Pausable)
+	assert.ErrorIs(t, sub.Pause(), ErrPauseUnsupported)
+	assert.False(t, sub.Status().Paused)
+}
@@ -0,0 +1,165 @@
+package consumer
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/navikt/deployment-event-relays/pkg/metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+// highWaterMarkInterval is how often the high-water mark is recorded while no messages are received.
+const highWaterMarkInterval = 10 * time.Second
+
+// group runs a sarama consumer group session loop until it is closed.
+type group struct {
+	active        atomic.Bool
+	cancel        context.CancelFunc
+	consumer      sarama.ConsumerGroup
+	ctx           context.Context
+	done          chan struct{}
+	groupID       string
+	logger        *log.Logger
+	processCtx    context.Context
+	processCancel context.CancelFunc
+	topic         string
+}
+
+// newConfig returns the sarama configuration shared by all consumer groups.
+func newConfig(tlsConfig *tls.Config, maxProcessingTime time.Duration) *sarama.Config {
+	config := sarama.NewConfig()
+	config.Net.TLS.Enable = true
+	config.Net.TLS.Config = tlsConfig
+	config.Version = sarama.V2_6_0_0
+	config.Consumer.MaxProcessingTime = maxProcessingTime
+	config.ClientID, _ = os.Hostname()
+	return config
+}
+
+// newGroup creates a consumer group. The initial offset, either sarama.OffsetOldest or sarama.OffsetNewest,
+// is where the group starts reading partitions for which it has not committed an offset yet.
+func newGroup(brokers []string, groupID, topic string, initialOffset int64, tlsConfig *tls.Config, maxProcessingTime time.Duration, logger *log.Logger) (*group, error) {
+	config := newConfig(tlsConfig, maxProcessingTime)
+	config.Consumer.Offsets.Initial = initialOffset
+
+	consumer, err := sarama.NewConsumerGroup(brokers, groupID, config)
+	if err != nil {
+		return nil, err
+	}
+
+	g := &group{
+		consumer: consumer,
+		done:     make(chan struct{}),
+		groupID:  groupID,
+		logger:   logger,
+		topic:    topic,
+	}
+	g.ctx, g.cancel = context.WithCancel(context.Background())
+	g.processCtx, g.processCancel = context.WithCancel(context.Background())
+
+	return g, nil
+}
+
+// Setup is run at the beginning of a new session, before ConsumeClaim
+func (g *group) Setup(_ sarama.ConsumerGroupSession) error {
+	g.active.Store(true)
+	return nil
+}
+
+// Cleanup is run at the end of a session, once all ConsumeClaim goroutines have exited
+func (g *group) Cleanup(_ sarama.ConsumerGroupSession) error {
+	g.active.Store(false)
+	return nil
+}
+
+// start consumes the topic in the background, passing claims to the given handler, until the group is closed.
+func (g *group) start(handler sarama.ConsumerGroupHandler) {
+	go func() {
+		for err := range g.consumer.Errors() {
+			g.logger.Errorf("Consumer encountered error: %s", err)
+		}
+	}()
+
+	go func() {
+		defer close(g.done)
+		for {
+			g.logger.Infof("(re-)starting consumer on topic %s", g.topic)
+			err := g.consumer.Consume(g.ctx, []string{g.topic}, handler)
+			if err != nil {
+				g.logger.Errorf("Error setting up consumer: %s", err)
+			}
+			// check if context was cancelled, signaling that the consumer should stop
+			if g.ctx.Err() != nil {
+				g.logger.Infof("Consumer on topic %s stopped", g.topic)
+				return
+			}
+			select {
+			case <-time.After(10 * time.Second):
+			case <-g.ctx.Done():
+			}
+		}
+	}()
+}
+
+// processContext returns the context passed on to the callback during a session.
+//
+// It is cancelled when the session ends because of a rebalance, or when the shutdown deadline
+// given to Close expires. A graceful shutdown alone does not cancel it, so that in-flight
+// messages get a chance to finish.
+func (g *group) processContext(sessionCtx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(g.processCtx)
+	go func() {
+		select {
+		case <-sessionCtx.Done():
+			if g.ctx.Err() == nil {
+				cancel()
+			}
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// watchHighWaterMark periodically records the high-water mark of a claim for each subsystem until ctx is cancelled,
+// so that lag keeps increasing while the consumer is blocked on a message.
+func watchHighWaterMark(ctx context.Context, claim sarama.ConsumerGroupClaim, subsystems ...string) {
+	ticker := time.NewTicker(highWaterMarkInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			for _, subsystem := range subsystems {
+				metrics.HighWaterMark(subsystem, claim.Partition(), claim.HighWaterMarkOffset())
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Close stops fetching new messages and waits for in-flight messages to finish processing.
+// Marked offsets are committed and the consumer group is left cleanly.
+//
+// If ctx expires before this is done, in-flight messages are cancelled and Close returns immediately with an error.
+func (g *group) Close(ctx context.Context) error {
+	g.cancel()
+
+	closed := make(chan error, 1)
+	go func() {
+		<-g.done
+		closed <- g.consumer.Close()
+	}()
+
+	select {
+	case err := <-closed:
+		return err
+	case <-ctx.Done():
+		g.processCancel()
+		return fmt.Errorf("close consumer group %s: %w", g.groupID, ctx.Err())
+	}
+}
@@ -0,0 +1,405 @@
+package consumer
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/navikt/deployment-event-relays/pkg/metrics"
+	"github.com/navikt/deployment-event-relays/pkg/outcome"
+	log "github.com/sirupsen/logrus"
+)
+
+// Subscriber describes how messages are processed on behalf of a single subsystem.
+type Subscriber struct {
+	Callback   Callback
+	DeadLetter DeadLetterFunc
+	Retry      RetryPolicy
+	Subsystem  string
+	Timeout    time.Duration
+}
+
+// delivery is a decoded message on its way to be processed.
+type delivery struct {
+	message *sarama.ConsumerMessage
+	value   interface{}
+	err     error
+	key     string
+	// complete is called once the message has been completed; in fan-out mode, by each subscriber.
+	complete func()
+}
+
+// newDelivery decodes a message and derives its ordering key.
+func newDelivery(message *sarama.ConsumerMessage, decode Decoder, key KeyFunc, logger *log.Logger) *delivery {
+	d := &delivery{
+		message: message,
+	}
+	if decode != nil {
+		d.value, d.err = decode(message)
+		if d.err != nil {
+			logger.Tracef("Drop message: %s", d.err)
+		}
+	}
+	if key != nil && d.err == nil {
+		d.key = key(message, d.value)
+	}
+	return d
+}
+
+// handler processes messages for a single subsystem, applying its retry policy and dead-letter handling.
+type handler struct {
+	callback     Callback
+	deadLetter   DeadLetterFunc
+	logger       *log.Logger
+	retry        RetryPolicy
+	retrying     map[*sarama.ConsumerMessage]time.Time
+	retryingLock sync.Mutex
+	subsystem    string
+	timeout      time.Duration
+	pauseLock    sync.Mutex
+	// resumed is closed when a paused subsystem is resumed, and nil while it is not paused.
+	resumed chan struct{}
+}
+
+func newHandler(sub Subscriber, logger *log.Logger) (*handler, error) {
+	err := sub.Retry.Validate()
+	if err != nil {
+		return nil, fmt.Errorf("retry policy: %w", err)
+	}
+	if sub.Retry.Fallback == FallbackDeadLetter && sub.DeadLetter == nil {
+		return nil, fmt.Errorf("retry policy: fallback '%s' requires a dead-letter topic", sub.Retry.Fallback)
+	}
+	return &handler{
+		callback:   sub.Callback,
+		deadLetter: sub.DeadLetter,
+		logger:     logger,
+		retry:      sub.Retry,
+		retrying:   make(map[*sarama.ConsumerMessage]time.Time),
+		subsystem:  sub.Subsystem,
+		timeout:    sub.Timeout,
+	}, nil
+}
+
+// retryingSince returns when the oldest message that is currently being retried first failed,
+// or zero if no message is being retried.
+func (h *handler) retryingSince() time.Time {
+	h.retryingLock.Lock()
+	defer h.retryingLock.Unlock()
+
+	var oldest time.Time
+	for _, since := range h.retrying {
+		if oldest.IsZero() || since.Before(oldest) {
+			oldest = since
+		}
+	}
+	return oldest
+}
+
+// Pause stops processing messages for the subsystem, until Resume is called.
+// A message that is already being processed is allowed to finish, but is not retried while paused.
+func (h *handler) Pause() {
+	h.pauseLock.Lock()
+	defer h.pauseLock.Unlock()
+	if h.resumed == nil {
+		h.resumed = make(chan struct{})
+	}
+}
+
+// Resume continues processing messages after Pause.
+func (h *handler) Resume() {
+	h.pauseLock.Lock()
+	defer h.pauseLock.Unlock()
+	if h.resumed != nil {
+		close(h.resumed)
+		h.resumed = nil
+	}
+}
+
+func (h *handler) paused() bool {
+	h.pauseLock.Lock()
+	defer h.pauseLock.Unlock()
+	return h.resumed != nil
+}
+
+// waitResumed blocks while the subsystem is paused. Returns false if ctx was cancelled in the meantime.
+func (h *handler) waitResumed(ctx context.Context) bool {
+	h.pauseLock.Lock()
+	resumed := h.resumed
+	h.pauseLock.Unlock()
+
+	if resumed == nil {
+		return true
+	}
+	select {
+	case <-resumed:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// status returns the state of the subsystem, given whether its consumer group has an active session,
+// and whether the subsystem can be paused.
+func (h *handler) status(active, pausable bool) Status {
+	return Status{
+		Active:        active,
+		Paused:        h.paused(),
+		Pausable:      pausable,
+		RetryingSince: h.retryingSince(),
+	}
+}
+
+// markRetrying records that processing of a message has failed and will be retried.
+// Only the time of the first failure is kept.
+func (h *handler) markRetrying(message *sarama.ConsumerMessage) {
+	h.retryingLock.Lock()
+	defer h.retryingLock.Unlock()
+	if _, ok := h.retrying[message]; !ok {
+		h.retrying[message] = time.Now()
+	}
+}
+
+// clearRetrying records that a message is no longer being retried.
+func (h *handler) clearRetrying(message *sarama.ConsumerMessage) {
+	h.retryingLock.Lock()
+	defer h.retryingLock.Unlock()
+	delete(h.retrying, message)
+}
+
+// handle processes a delivered message, calling complete once it is done.
+// Messages that could not be decoded are dropped.
+//
+// If ctx was cancelled while the message was waiting for a worker, or processing is abandoned,
+// abandon is called instead, and the message is left to be redelivered in a later session.
+//
+// requeue queues a task on the worker responsible for the ordering key of the message;
+// it is used to retry deferred messages that fail after the callback has returned.
+func (h *handler) handle(ctx, processCtx context.Context, d *delivery, complete, abandon func(), requeue func(task func()) bool) {
+	if ctx.Err() != nil {
+		abandon()
+		return
+	}
+	if d.err != nil {
+		metrics.Process(h.subsystem, metrics.LabelValueProcessedDropped, d.message.Offset+1)
+		complete()
+		return
+	}
+	processCtx = context.WithValue(processCtx, decodedKey{}, d.value)
+	if !h.process(ctx, processCtx, d.message, complete, abandon, requeue, 0, time.Now()) {
+		abandon()
+	}
+}
+
+// process runs the callback until the message is either handled, skipped or permanently rejected,
+// and then calls complete. If the callback defers the message, complete is called once it is acknowledged,
+// or abandon if it fails and is abandoned while being retried; see acknowledge.
+// Counting starts after the given number of attempts.
+//
+// Rejected messages are forwarded to the dead-letter handler, if any.
+// When retries are exhausted, the fallback of the retry policy is applied.
+// Returns false if processing was abandoned, either because processCtx was cancelled
+// or because ctx was cancelled while waiting to retry the message or for the subsystem to be resumed.
+func (h *handler) process(ctx, processCtx context.Context, message *sarama.ConsumerMessage, complete, abandon func(), requeue func(task func()) bool, attempts int, started time.Time) bool {
+	logger := h.logger.WithFields(log.Fields{
+		"kafka_offset": message.Offset,
+	})
+
+	defer h.clearRetrying(message)
+
+	for attempts++; ; attempts++ {
+		if !h.waitResumed(ctx) {
+			return false
+		}
+
+		d := &deferral{}
+		attempt := attempts
+		d.ack = func(err error) {
+			if d.isDeferred() {
+				h.acknowledge(ctx, processCtx, message, logger, attempt, started, complete, abandon, requeue, err)
+			}
+		}
+
+		err := h.attempt(context.WithValue(processCtx, deferralKey{}, d), message, logger)
+		if err != nil {
+			d.cancel()
+		}
+		if processCtx.Err() != nil {
+			logger.Warnf("Abandoned processing of message: %s", processCtx.Err())
+			return false
+		}
+
+		switch outcome.Classify(err) {
+		case outcome.ClassOK:
+			if d.isDeferred() {
+				return true
+			}
+			h.record(metrics.LabelValueProcessedOK, attempts, started)
+			complete()
+			return true
+		case outcome.ClassSkipped:
+			logger.Infof("Skipped message: %s", err)
+			h.record(metrics.LabelValueProcessedSkipped, attempts, started)
+			complete()
+			return true
+		case outcome.ClassFiltered:
+			logger.Debugf("Filtered message: %s", err)
+			h.record(metrics.LabelValueProcessedFiltered, attempts, started)
+			complete()
+			return true
+		case outcome.ClassPermanent:
+			logger.Errorf("Message permanently rejected: %s", err)
+			h.record(metrics.LabelValueProcessedError, attempts, started)
+			return h.sendDeadLetter(ctx, message, err, logger, complete)
+		case outcome.ClassRateLimited:
+			logger.Warnf("Rate limited while processing message (attempt %d): %s", attempts, err)
+		default:
+			logger.Errorf("Consume Kafka message (attempt %d): %s", attempts, err)
+		}
+
+		retry, ok := h.retryLater(ctx, message, err, logger, attempts, started, complete)
+		if !retry {
+			return ok
+		}
+	}
+}
+
+// retryLater applies the retry policy after a message has failed with a retriable error.
+// Once retries are exhausted, the fallback is applied; otherwise it waits until the next attempt is due.
+//
+// Returns true if the message should be attempted again. Otherwise, the second result
+// is false if ctx was cancelled while waiting, and the message was not handled.
+func (h *handler) retryLater(ctx context.Context, message *sarama.ConsumerMessage, err error, logger *log.Entry, attempts int, started time.Time, complete func()) (bool, bool) {
+	if attempts == h.retry.MaxAttempts {
+		metrics.RetriesExhausted(h.subsystem)
+		switch h.retry.Fallback {
+		case FallbackDrop:
+			logger.Errorf("Giving up after %d attempts; dropping message", attempts)
+			h.record(metrics.LabelValueProcessedDropped, attempts, started)
+			complete()
+			return false, true
+		case FallbackDeadLetter:
+			logger.Errorf("Giving up after %d attempts; forwarding message to dead-letter topic", attempts)
+			h.record(metrics.LabelValueProcessedError, attempts, started)
+			return false, h.sendDeadLetter(ctx, message, err, logger, complete)
+		default:
+			logger.Errorf("Retries exhausted after %d attempts; blocking until message is processed", attempts)
+		}
+	}
+
+	h.markRetrying(message)
+	delay := h.retry.Backoff(attempts)
+	if retryAfter := outcome.RetryAfter(err); retryAfter > delay {
+		delay = retryAfter
+	}
+	return h.wait(ctx, delay), false
+}
+
+// acknowledge handles the result of a deferred message.
+//
+// Deferred messages that fail with a retriable error are retried according to the retry policy,
+// as if the callback itself had failed, and rejected messages are forwarded to the dead-letter topic.
+// Either is queued with requeue on the worker responsible for the ordering key of the message,
+// so that it is bounded by the workers and keeps its place among messages with the same key.
+// The task is queued from a separate goroutine, as the acknowledgement may come from the worker itself.
+// If ctx is cancelled or the workers stop in the meantime, the message is abandoned,
+// so that it is redelivered in a later session.
+func (h *handler) acknowledge(ctx, processCtx context.Context, message *sarama.ConsumerMessage, logger *log.Entry, attempts int, started time.Time, complete, abandon func(), requeue func(task func()) bool, err error) {
+	var task func()
+	switch outcome.Classify(err) {
+	case outcome.ClassOK:
+		h.record(metrics.LabelValueProcessedOK, attempts, started)
+		complete()
+		return
+	case outcome.ClassSkipped:
+		logger.Infof("Skipped message: %s", err)
+		h.record(metrics.LabelValueProcessedSkipped, attempts, started)
+		complete()
+		return
+	case outcome.ClassFiltered:
+		logger.Debugf("Filtered message: %s", err)
+		h.record(metrics.LabelValueProcessedFiltered, attempts, started)
+		complete()
+		return
+	case outcome.ClassPermanent:
+		logger.Errorf("Message permanently rejected: %s", err)
+		h.record(metrics.LabelValueProcessedError, attempts, started)
+		task = func() {
+			if !h.sendDeadLetter(ctx, message, err, logger, complete) {
+				abandon()
+			}
+		}
+	default:
+		logger.Errorf("Deferred processing failed (attempt %d): %s", attempts, err)
+		h.markRetrying(message)
+		task = func() {
+			defer h.clearRetrying(message)
+			retry, ok := h.retryLater(ctx, message, err, logger, attempts, started, complete)
+			if retry {
+				ok = h.process(ctx, processCtx, message, complete, abandon, requeue, attempts, started)
+			}
+			if !ok {
+				abandon()
+			}
+		}
+	}
+
+	go func() {
+		if !requeue(task) {
+			h.clearRetrying(message)
+			abandon()
+		}
+	}()
+}
+
+// record observes the number of attempts and the time spent on a message that has been handled or given up.
+func (h *handler) record(status metrics.ProcessStatus, attempts int, started time.Time) {
+	metrics.Attempts(h.subsystem, attempts)
+	metrics.Latency(h.subsystem, status, time.Since(started))
+}
+
+// attempt runs the callback once, bounded by the processing timeout.
+func (h *handler) attempt(ctx context.Context, message *sarama.ConsumerMessage, logger *log.Entry) error {
+	if h.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.timeout)
+		defer cancel()
+	}
+	return h.callback(ctx, message, logger)
+}
+
+// sendDeadLetter hands a rejected message to the dead-letter handler, retrying until it is accepted,
+// and then calls complete. Returns false if the context was cancelled while waiting to retry.
+func (h *handler) sendDeadLetter(ctx context.Context, message *sarama.ConsumerMessage, cause error, logger *log.Entry, complete func()) bool {
+	if h.deadLetter == nil {
+		complete()
+		return true
+	}
+
+	defer h.clearRetrying(message)
+
+	for attempts := 1; ; attempts++ {
+		err := h.deadLetter(message, cause)
+		if err == nil {
+			logger.Infof("Message forwarded to dead-letter topic")
+			complete()
+			return true
+		}
+		logger.Errorf("Forward message to dead-letter topic: %s", err)
+		h.markRetrying(message)
+		if !h.wait(ctx, h.retry.Backoff(attempts)) {
+			return false
+		}
+	}
+}
+
+// wait sleeps for the given duration. Returns false if the context was cancelled in the meantime.
+func (h *handler) wait(ctx context.Context, duration time.Duration) bool {
+	select {
+	case <-time.After(duration):
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,106 @@
+package consumer
+
+import (
+	"context"
+	"sort"
+	"sync"
+)
+
+// offsetTracker keeps track of in-flight messages on a single partition.
+//
+// Messages may complete out of order, but the committed offset must only
+// advance past messages that are all complete. The tracker reports the highest
+// offset that can be safely marked whenever the contiguous range of completed messages grows.
+type offsetTracker struct {
+	lock      sync.Mutex
+	pending   []int64
+	completed map[int64]bool
+	// abandoned is the number of pending messages that will never complete.
+	abandoned int
+	empty     chan struct{}
+}
+
+func newOffsetTracker() *offsetTracker {
+	return &offsetTracker{
+		completed: make(map[int64]bool),
+	}
+}
+
+// add registers a message as in-flight. Offsets must be added in increasing order.
+func (t *offsetTracker) add(offset int64) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.pending = append(t.pending, offset)
+}
+
+// complete marks a message as done. If this completes the oldest in-flight messages,
+// the offset of the newest message in the completed range is returned together with true.
+func (t *offsetTracker) complete(offset int64) (int64, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	index := sort.Search(len(t.pending), func(i int) bool {
+		return t.pending[i] >= offset
+	})
+	if index == len(t.pending) || t.pending[index] != offset {
+		return 0, false
+	}
+	t.completed[offset] = true
+
+	var last int64
+	var advanced bool
+	for len(t.pending) > 0 && t.completed[t.pending[0]] {
+		last = t.pending[0]
+		advanced = true
+		delete(t.completed, last)
+		t.pending = t.pending[1:]
+	}
+
+	t.notify()
+
+	return last, advanced
+}
+
+// abandon gives up on a message that will not be processed, because the session is ending.
+// The returned offsets never advance past it, but wait no longer waits for it.
+func (t *offsetTracker) abandon(offset int64) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.abandoned++
+	t.notify()
+}
+
+// outstanding returns the number of messages that are neither complete nor abandoned.
+func (t *offsetTracker) outstanding() int {
+	return len(t.pending) - len(t.completed) - t.abandoned
+}
+
+// notify wakes up wait once there are no more outstanding messages. The lock must be held.
+func (t *offsetTracker) notify() {
+	if t.outstanding() == 0 && t.empty != nil {
+		close(t.empty)
+		t.empty = nil
+	}
+}
+
+// wait blocks until there are no more in-flight messages, apart from abandoned ones, or ctx is cancelled.
+// Returns false if ctx was cancelled first.
+func (t *offsetTracker) wait(ctx context.Context) bool {
+	t.lock.Lock()
+	if t.outstanding() == 0 {
+		t.lock.Unlock()
+		return true
+	}
+	if t.empty == nil {
+		t.empty = make(chan struct{})
+	}
+	empty := t.empty
+	t.lock.Unlock()
+
+	select {
+	case <-empty:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
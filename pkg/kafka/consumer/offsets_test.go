@@ -0,0 +1,57 @@
+package consumer
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOffsetTracker(t *testing.T) {
+	tracker := newOffsetTracker()
+	for _, offset := range []int64{10, 11, 12, 14} {
+		tracker.add(offset)
+	}
+
+	_, ok := tracker.complete(11)
+	assert.False(t, ok)
+	_, ok = tracker.complete(14)
+	assert.False(t, ok)
+
+	offset, ok := tracker.complete(10)
+	assert.True(t, ok)
+	assert.Equal(t, int64(11), offset)
+
+	// unknown offsets are ignored
+	_, ok = tracker.complete(13)
+	assert.False(t, ok)
+	_, ok = tracker.complete(10)
+	assert.False(t, ok)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer cancel()
+	assert.False(t, tracker.wait(ctx))
+
+	go func() {
+		tracker.complete(12)
+	}()
+	assert.True(t, tracker.wait(context.Background()))
+}
+
+func TestOffsetTrackerAbandon(t *testing.T) {
+	tracker := newOffsetTracker()
+	for _, offset := range []int64{0, 1, 2} {
+		tracker.add(offset)
+	}
+
+	tracker.abandon(1)
+	offset, ok := tracker.complete(0)
+	assert.True(t, ok)
+	assert.Equal(t, int64(0), offset)
+
+	// the abandoned message keeps later messages from being committed, but is not waited for
+	_, ok = tracker.complete(2)
+	assert.False(t, ok)
+	assert.True(t, tracker.wait(context.Background()))
+}
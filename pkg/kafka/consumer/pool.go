@@ -0,0 +1,87 @@
+package consumer
+
+import (
+	"context"
+	"hash/fnv"
+	"sync"
+
+	"github.com/Shopify/sarama"
+)
+
+// workerQueueSize is the number of tasks that may wait for each worker before submit blocks.
+const workerQueueSize = 10
+
+// KeyFunc returns the ordering key of a message, given the value it was decoded to.
+// Messages with the same key are processed in the order they appear on the partition.
+type KeyFunc func(message *sarama.ConsumerMessage, decoded interface{}) string
+
+// pool runs tasks on a fixed number of workers.
+// Tasks submitted with the same key always run on the same worker, in the order they were submitted.
+type pool struct {
+	queues []chan func()
+	wg     sync.WaitGroup
+	// lock guards closed, so that tasks are never queued after the queues have been closed.
+	lock     sync.RWMutex
+	closed   bool
+	stopping chan struct{}
+}
+
+func newPool(workers int) *pool {
+	if workers < 1 {
+		workers = 1
+	}
+	p := &pool{
+		queues:   make([]chan func(), workers),
+		stopping: make(chan struct{}),
+	}
+	for i := range p.queues {
+		queue := make(chan func(), workerQueueSize)
+		p.queues[i] = queue
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			for task := range queue {
+				task()
+			}
+		}()
+	}
+	return p
+}
+
+// submit queues a task on the worker responsible for key, blocking while its queue is full.
+// Returns false if ctx was cancelled or the pool was closed before the task could be queued.
+func (p *pool) submit(ctx context.Context, key string, task func()) bool {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	if p.closed {
+		return false
+	}
+
+	queue := p.queues[0]
+	if len(p.queues) > 1 {
+		hash := fnv.New32a()
+		_, _ = hash.Write([]byte(key))
+		queue = p.queues[hash.Sum32()%uint32(len(p.queues))]
+	}
+	select {
+	case queue <- task:
+		return true
+	case <-ctx.Done():
+		return false
+	case <-p.stopping:
+		return false
+	}
+}
+
+// close waits for all queued tasks to run, and stops the workers.
+// Tasks submitted after close are rejected.
+func (p *pool) close() {
+	close(p.stopping)
+	p.lock.Lock()
+	p.closed = true
+	p.lock.Unlock()
+	for _, queue := range p.queues {
+		close(queue)
+	}
+	p.wg.Wait()
+}
@@ -0,0 +1,80 @@
+package consumer
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Fallback decides what happens to a message once all retry attempts have been spent.
+type Fallback string
+
+const (
+	// FallbackBlock keeps retrying the message at the maximum backoff interval, blocking the partition.
+	FallbackBlock Fallback = "block"
+	// FallbackDrop discards the message and moves on to the next one.
+	FallbackDrop Fallback = "drop"
+	// FallbackDeadLetter forwards the message to the dead-letter handler and moves on to the next one.
+	FallbackDeadLetter Fallback = "dead-letter"
+)
+
+// RetryPolicy describes how a message that fails with a retriable error is retried.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of processing attempts for a single message.
+	// Zero means unlimited.
+	MaxAttempts int
+	// InitialBackoff is the delay before the first retry.
+	InitialBackoff time.Duration
+	// MaxBackoff caps the delay between any two attempts.
+	MaxBackoff time.Duration
+	// Multiplier is applied to the delay after each attempt.
+	Multiplier float64
+	// Jitter randomizes each delay by up to this fraction in either direction, between 0 and 1.
+	Jitter float64
+	// Fallback is applied when MaxAttempts is reached.
+	Fallback Fallback
+}
+
+func (p RetryPolicy) Validate() error {
+	if p.MaxAttempts < 0 {
+		return fmt.Errorf("max attempts must be zero or greater")
+	}
+	if p.InitialBackoff <= 0 {
+		return fmt.Errorf("initial backoff must be greater than zero")
+	}
+	if p.MaxBackoff < p.InitialBackoff {
+		return fmt.Errorf("max backoff must be greater than or equal to initial backoff")
+	}
+	if p.Multiplier < 1 {
+		return fmt.Errorf("multiplier must be greater than or equal to 1")
+	}
+	if p.Jitter < 0 || p.Jitter > 1 {
+		return fmt.Errorf("jitter must be between 0 and 1")
+	}
+	switch p.Fallback {
+	case FallbackBlock, FallbackDrop, FallbackDeadLetter:
+	default:
+		return fmt.Errorf("fallback '%s' is not recognized", p.Fallback)
+	}
+	return nil
+}
+
+// Backoff returns the delay before the next attempt, after the given number of failed attempts.
+func (p RetryPolicy) Backoff(attempts int) time.Duration {
+	return p.backoff(attempts, rand.Float64())
+}
+
+// backoff computes the delay using a random number in the interval [0, 1).
+func (p RetryPolicy) backoff(attempts int, random float64) time.Duration {
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	delay := float64(p.InitialBackoff) * math.Pow(p.Multiplier, float64(attempts-1))
+	delay = math.Min(delay, float64(p.MaxBackoff))
+	delay += delay * p.Jitter * (random*2 - 1)
+	delay = math.Min(delay, float64(p.MaxBackoff))
+
+	return time.Duration(delay)
+}
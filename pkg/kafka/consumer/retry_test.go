@@ -0,0 +1,59 @@
+package consumer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := RetryPolicy{
+		InitialBackoff: time.Second,
+		MaxBackoff:     time.Second * 10,
+		Multiplier:     2,
+		Jitter:         0.5,
+		Fallback:       FallbackBlock,
+	}
+
+	// random = 0.5 cancels out jitter
+	assert.Equal(t, time.Second, policy.backoff(0, 0.5))
+	assert.Equal(t, time.Second, policy.backoff(1, 0.5))
+	assert.Equal(t, time.Second*2, policy.backoff(2, 0.5))
+	assert.Equal(t, time.Second*4, policy.backoff(3, 0.5))
+	assert.Equal(t, time.Second*8, policy.backoff(4, 0.5))
+	assert.Equal(t, time.Second*10, policy.backoff(5, 0.5))
+	assert.Equal(t, time.Second*10, policy.backoff(500, 0.5))
+
+	// jitter spreads the delay in both directions, but never beyond the maximum
+	assert.Equal(t, time.Second*2, policy.backoff(3, 0))
+	assert.Equal(t, time.Second*6, policy.backoff(3, 1))
+	assert.Equal(t, time.Second*5, policy.backoff(5, 0))
+	assert.Equal(t, time.Second*10, policy.backoff(5, 1))
+}
+
+func TestRetryPolicyValidate(t *testing.T) {
+	valid := RetryPolicy{
+		InitialBackoff: time.Second,
+		MaxBackoff:     time.Second,
+		Multiplier:     1,
+		Fallback:       FallbackDrop,
+	}
+	assert.NoError(t, valid.Validate())
+
+	invalid := valid
+	invalid.Fallback = "retry-forever"
+	assert.Error(t, invalid.Validate())
+
+	invalid = valid
+	invalid.MaxBackoff = time.Millisecond
+	assert.Error(t, invalid.Validate())
+
+	invalid = valid
+	invalid.Jitter = 1.5
+	assert.Error(t, invalid.Validate())
+
+	invalid = valid
+	invalid.Multiplier = 0.5
+	assert.Error(t, invalid.Validate())
+}
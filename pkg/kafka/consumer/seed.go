@@ -0,0 +1,124 @@
+package consumer
+
+import (
+	"fmt"
+
+	"github.com/Shopify/sarama"
+	log "github.com/sirupsen/logrus"
+)
+
+// committedFunc returns the offsets committed by a consumer group, by partition.
+// Partitions for which the group has not committed an offset are left out.
+type committedFunc func(groupID string) (map[int32]int64, error)
+
+// seedOffsets returns the offsets that a new consumer group should start from, so that it continues
+// where the slowest of the seed groups left off. Partitions for which the group has already committed an offset,
+// or for which some seed group has not, are left out.
+func seedOffsets(committed committedFunc, groupID string, seedGroupIDs []string, partitions []int32) (map[int32]int64, error) {
+	own, err := committed(groupID)
+	if err != nil {
+		return nil, fmt.Errorf("fetch offsets of %s: %w", groupID, err)
+	}
+
+	seeds := make([]map[int32]int64, 0, len(seedGroupIDs))
+	for _, seedGroupID := range seedGroupIDs {
+		seed, err := committed(seedGroupID)
+		if err != nil {
+			return nil, fmt.Errorf("fetch offsets of %s: %w", seedGroupID, err)
+		}
+		seeds = append(seeds, seed)
+	}
+
+	offsets := make(map[int32]int64)
+	for _, partition := range partitions {
+		if _, ok := own[partition]; ok || len(seeds) == 0 {
+			continue
+		}
+		lowest, complete := int64(-1), true
+		for _, seed := range seeds {
+			offset, ok := seed[partition]
+			if !ok {
+				complete = false
+				break
+			}
+			if lowest < 0 || offset < lowest {
+				lowest = offset
+			}
+		}
+		if complete {
+			offsets[partition] = lowest
+		}
+	}
+	return offsets, nil
+}
+
+// seedGroup commits the offsets returned by seedOffsets on behalf of a consumer group that is not running yet.
+func seedGroup(client sarama.Client, groupID, topic string, seedGroupIDs []string, logger *log.Logger) error {
+	admin, err := sarama.NewClusterAdminFromClient(client)
+	if err != nil {
+		return err
+	}
+
+	partitions, err := client.Partitions(topic)
+	if err != nil {
+		return fmt.Errorf("list partitions: %w", err)
+	}
+
+	committed := func(groupID string) (map[int32]int64, error) {
+		response, err := admin.ListConsumerGroupOffsets(groupID, map[string][]int32{topic: partitions})
+		if err != nil {
+			return nil, err
+		}
+		offsets := make(map[int32]int64)
+		for _, partition := range partitions {
+			block := response.GetBlock(topic, partition)
+			if block == nil {
+				continue
+			}
+			if block.Err != sarama.ErrNoError {
+				return nil, fmt.Errorf("partition %d: %w", partition, block.Err)
+			}
+			if block.Offset >= 0 {
+				offsets[partition] = block.Offset
+			}
+		}
+		return offsets, nil
+	}
+
+	offsets, err := seedOffsets(committed, groupID, seedGroupIDs, partitions)
+	if err != nil {
+		return err
+	}
+	if len(offsets) == 0 {
+		return nil
+	}
+
+	manager, err := sarama.NewOffsetManagerFromClient(groupID, client)
+	if err != nil {
+		return err
+	}
+	defer manager.Close()
+
+	for partition, offset := range offsets {
+		partitionManager, err := manager.ManagePartition(topic, partition)
+		if err != nil {
+			return fmt.Errorf("partition %d: %w", partition, err)
+		}
+		partitionManager.MarkOffset(offset, "")
+		partitionManager.AsyncClose()
+		logger.Infof("Consumer group %s starts partition %d at offset %d", groupID, partition, offset)
+	}
+	manager.Commit()
+
+	// The offset manager only logs errors, so check that the offsets were actually committed.
+	seeded, err := committed(groupID)
+	if err != nil {
+		return fmt.Errorf("fetch offsets of %s: %w", groupID, err)
+	}
+	for partition, offset := range offsets {
+		if committed, ok := seeded[partition]; !ok || committed < offset {
+			return fmt.Errorf("partition %d: offset %d was not committed", partition, offset)
+		}
+	}
+	return nil
+}
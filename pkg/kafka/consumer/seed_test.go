@@ -0,0 +1,40 @@
+package consumer
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSeedOffsets(t *testing.T) {
+	groups := map[string]map[int32]int64{
+		"fan-out":  {3: 40},
+		"influxdb": {0: 10, 1: 25, 2: 5, 3: 30},
+		"slack":    {0: 12, 1: 20, 3: 35},
+	}
+	committed := func(groupID string) (map[int32]int64, error) {
+		return groups[groupID], nil
+	}
+
+	offsets, err := seedOffsets(committed, "fan-out", []string{"influxdb", "slack"}, []int32{0, 1, 2, 3})
+	assert.NoError(t, err)
+	// partition 2 has no offset in one of the seed groups, and partition 3 is already committed
+	assert.Equal(t, map[int32]int64{0: 10, 1: 20}, offsets)
+
+	offsets, err = seedOffsets(committed, "fan-out", nil, []int32{0, 1, 2, 3})
+	assert.NoError(t, err)
+	assert.Empty(t, offsets)
+}
+
+func TestSeedOffsetsError(t *testing.T) {
+	committed := func(groupID string) (map[int32]int64, error) {
+		if groupID == "slack" {
+			return nil, fmt.Errorf("coordinator not available")
+		}
+		return nil, nil
+	}
+
+	_, err := seedOffsets(committed, "fan-out", []string{"influxdb", "slack"}, []int32{0})
+	assert.EqualError(t, err, "fetch offsets of slack: coordinator not available")
+}
@@ -0,0 +1,121 @@
+package deadletter
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// Headers attached to every dead-lettered message, describing where it came from and why it was rejected.
+const (
+	HeaderSubsystem = "dead-letter-subsystem"
+	HeaderError     = "dead-letter-error"
+	HeaderTopic     = "dead-letter-topic"
+	HeaderPartition = "dead-letter-partition"
+	HeaderOffset    = "dead-letter-offset"
+	HeaderTimestamp = "dead-letter-timestamp"
+)
+
+// Producer writes messages that a relay has permanently rejected to a dead-letter topic,
+// so that they can be audited and reprocessed later.
+type Producer struct {
+	producer  sarama.SyncProducer
+	subsystem string
+	topic     string
+}
+
+type Config struct {
+	Brokers   []string
+	Subsystem string
+	TlsConfig *tls.Config
+	Topic     string
+}
+
+func New(cfg Config) (*Producer, error) {
+	config := sarama.NewConfig()
+	config.Net.TLS.Enable = true
+	config.Net.TLS.Config = cfg.TlsConfig
+	config.Version = sarama.V2_6_0_0
+	config.Producer.RequiredAcks = sarama.WaitForAll
+	config.Producer.Return.Successes = true
+	config.Producer.Return.Errors = true
+	config.ClientID, _ = os.Hostname()
+
+	producer, err := sarama.NewSyncProducer(cfg.Brokers, config)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewWithProducer(producer, cfg.Subsystem, cfg.Topic), nil
+}
+
+// NewWithProducer creates a dead-letter producer on top of an existing Kafka producer.
+func NewWithProducer(producer sarama.SyncProducer, subsystem, topic string) *Producer {
+	return &Producer{
+		producer:  producer,
+		subsystem: subsystem,
+		topic:     topic,
+	}
+}
+
+// Send produces the original message bytes to the dead-letter topic, annotated with the cause of rejection.
+func (p *Producer) Send(message *sarama.ConsumerMessage, cause error) error {
+	_, _, err := p.producer.SendMessage(Message(p.topic, p.subsystem, message, cause))
+	if err != nil {
+		return fmt.Errorf("produce to dead-letter topic %s: %w", p.topic, err)
+	}
+	return nil
+}
+
+func (p *Producer) Close() error {
+	return p.producer.Close()
+}
+
+// Message builds a dead-letter message from a consumed message.
+// The key and value are copied verbatim, and the original headers are retained.
+func Message(topic, subsystem string, message *sarama.ConsumerMessage, cause error) *sarama.ProducerMessage {
+	headers := make([]sarama.RecordHeader, 0, len(message.Headers)+6)
+	for _, header := range message.Headers {
+		if header != nil {
+			headers = append(headers, *header)
+		}
+	}
+
+	var errorText string
+	if cause != nil {
+		errorText = cause.Error()
+	}
+
+	headers = append(headers,
+		header(HeaderSubsystem, subsystem),
+		header(HeaderError, errorText),
+		header(HeaderTopic, message.Topic),
+		header(HeaderPartition, strconv.FormatInt(int64(message.Partition), 10)),
+		header(HeaderOffset, strconv.FormatInt(message.Offset, 10)),
+		header(HeaderTimestamp, message.Timestamp.UTC().Format(time.RFC3339Nano)),
+	)
+
+	msg := &sarama.ProducerMessage{
+		Topic:   topic,
+		Headers: headers,
+	}
+	if message.Key != nil {
+		msg.Key = sarama.ByteEncoder(message.Key)
+	}
+	if message.Value != nil {
+		msg.Value = sarama.ByteEncoder(message.Value)
+	}
+
+	return msg
+}
+
+func header(key, value string) sarama.RecordHeader {
+	return sarama.RecordHeader{
+		Key:   []byte(key),
+		Value: []byte(value),
+	}
+}
@@ -0,0 +1,69 @@
+package deadletter_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/Shopify/sarama/mocks"
+	"github.com/navikt/deployment-event-relays/pkg/kafka/deadletter"
+	"github.com/stretchr/testify/assert"
+)
+
+func headerMap(headers []sarama.RecordHeader) map[string]string {
+	result := make(map[string]string)
+	for _, header := range headers {
+		result[string(header.Key)] = string(header.Value)
+	}
+	return result
+}
+
+func TestMessage(t *testing.T) {
+	message := &sarama.ConsumerMessage{
+		Headers: []*sarama.RecordHeader{
+			{Key: []byte("original"), Value: []byte("header")},
+		},
+		Timestamp: time.Date(2021, 3, 4, 5, 6, 7, 8, time.UTC),
+		Key:       []byte("key"),
+		Value:     []byte("value"),
+		Topic:     "deployment-events",
+		Partition: 3,
+		Offset:    1234,
+	}
+
+	msg := deadletter.Message("dead-letters", "vera", message, fmt.Errorf("rejected"))
+
+	assert.Equal(t, "dead-letters", msg.Topic)
+	assert.Equal(t, sarama.ByteEncoder("key"), msg.Key)
+	assert.Equal(t, sarama.ByteEncoder("value"), msg.Value)
+	assert.Equal(t, map[string]string{
+		"original":                 "header",
+		deadletter.HeaderSubsystem: "vera",
+		deadletter.HeaderError:     "rejected",
+		deadletter.HeaderTopic:     "deployment-events",
+		deadletter.HeaderPartition: "3",
+		deadletter.HeaderOffset:    "1234",
+		deadletter.HeaderTimestamp: "2021-03-04T05:06:07.000000008Z",
+	}, headerMap(msg.Headers))
+}
+
+func TestProducerSend(t *testing.T) {
+	mock := mocks.NewSyncProducer(t, nil)
+	producer := deadletter.NewWithProducer(mock, "vera", "dead-letters")
+
+	mock.ExpectSendMessageWithCheckerFunctionAndSucceed(func(val []byte) error {
+		if string(val) != "value" {
+			return fmt.Errorf("unexpected value %q", val)
+		}
+		return nil
+	})
+	err := producer.Send(&sarama.ConsumerMessage{Value: []byte("value")}, fmt.Errorf("rejected"))
+	assert.NoError(t, err)
+
+	mock.ExpectSendMessageAndFail(sarama.ErrOutOfBrokers)
+	err = producer.Send(&sarama.ConsumerMessage{Value: []byte("value")}, fmt.Errorf("rejected"))
+	assert.ErrorIs(t, err, sarama.ErrOutOfBrokers)
+
+	assert.NoError(t, producer.Close())
+}
@@ -0,0 +1,232 @@
+// Package reader reads a bounded range of messages from a Kafka topic without joining a consumer group.
+// No offsets are committed, so reading does not affect the progress of any consumer group.
+package reader
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/Shopify/sarama"
+	log "github.com/sirupsen/logrus"
+)
+
+// Range selects the messages to read on each partition.
+type Range struct {
+	// Partitions to read. All partitions of the topic are read if empty.
+	Partitions []int32
+	// StartOffset is the first offset to read. If negative, StartTime is used instead.
+	StartOffset int64
+	// StartTime selects the first message produced at or after this time.
+	// Reading starts at the oldest message if neither StartOffset nor StartTime is given.
+	StartTime time.Time
+	// EndOffset is the offset to stop before. Negative means no limit.
+	EndOffset int64
+	// EndTime stops reading before the first message produced at or after this time. Zero means no limit.
+	EndTime time.Time
+	// IdleTimeout gives up on a partition when no message has arrived for this long,
+	// and the remaining offsets before the end are reported as unread.
+	// Offsets can be missing after compaction, or when they were used for transaction markers.
+	// Zero means waiting until the end offset is reached, or the context is cancelled.
+	IdleTimeout time.Duration
+}
+
+// Handler is called with each message in the range, in order for each partition.
+// If it returns an error, reading stops.
+type Handler func(message *sarama.ConsumerMessage) error
+
+// Offsets looks up offsets of a partition, like sarama.Client.
+// The time is either in milliseconds since the epoch, or sarama.OffsetOldest or sarama.OffsetNewest.
+type Offsets interface {
+	GetOffset(topic string, partitionID int32, time int64) (int64, error)
+}
+
+type Reader struct {
+	client   sarama.Client
+	consumer sarama.Consumer
+	offsets  Offsets
+	topic    string
+}
+
+type Config struct {
+	Brokers   []string
+	TlsConfig *tls.Config
+	Topic     string
+}
+
+func New(cfg Config) (*Reader, error) {
+	config := sarama.NewConfig()
+	config.Net.TLS.Enable = true
+	config.Net.TLS.Config = cfg.TlsConfig
+	config.Version = sarama.V2_6_0_0
+	config.ClientID, _ = os.Hostname()
+
+	client, err := sarama.NewClient(cfg.Brokers, config)
+	if err != nil {
+		return nil, err
+	}
+
+	consumer, err := sarama.NewConsumerFromClient(client)
+	if err != nil {
+		_ = client.Close()
+		return nil, err
+	}
+
+	r := NewWithConsumer(consumer, client, cfg.Topic)
+	r.client = client
+	return r, nil
+}
+
+// NewWithConsumer creates a reader on top of an existing Kafka consumer and offset lookup.
+func NewWithConsumer(consumer sarama.Consumer, offsets Offsets, topic string) *Reader {
+	return &Reader{
+		consumer: consumer,
+		offsets:  offsets,
+		topic:    topic,
+	}
+}
+
+// Read passes the messages in the range to handler, one partition at a time.
+// Messages produced after Read is called are not read.
+//
+// It returns the number of offsets that were not read because a partition was given up after rng.IdleTimeout.
+func (r *Reader) Read(ctx context.Context, rng Range, handler Handler) (int64, error) {
+	partitions := rng.Partitions
+	if len(partitions) == 0 {
+		var err error
+		partitions, err = r.consumer.Partitions(r.topic)
+		if err != nil {
+			return 0, fmt.Errorf("list partitions: %w", err)
+		}
+	}
+
+	var unread int64
+	for _, partition := range partitions {
+		start, end, err := r.bounds(partition, rng)
+		if err != nil {
+			return unread, fmt.Errorf("partition %d: %w", partition, err)
+		}
+		if start >= end {
+			log.Infof("Partition %d: no messages in range", partition)
+			continue
+		}
+		log.Infof("Partition %d: reading offsets %d to %d", partition, start, end-1)
+		next, err := r.readPartition(ctx, partition, start, end, rng.IdleTimeout, handler)
+		if err != nil {
+			return unread, fmt.Errorf("partition %d: %w", partition, err)
+		}
+		if next < end {
+			log.Warnf("Partition %d: no message for %s, offsets %d to %d were not read", partition, rng.IdleTimeout, next, end-1)
+			unread += end - next
+		}
+	}
+
+	return unread, nil
+}
+
+// bounds returns the first offset to read on a partition, and the offset to stop before.
+func (r *Reader) bounds(partition int32, rng Range) (int64, int64, error) {
+	oldest, err := r.offsets.GetOffset(r.topic, partition, sarama.OffsetOldest)
+	if err != nil {
+		return 0, 0, fmt.Errorf("get oldest offset: %w", err)
+	}
+	end, err := r.offsets.GetOffset(r.topic, partition, sarama.OffsetNewest)
+	if err != nil {
+		return 0, 0, fmt.Errorf("get newest offset: %w", err)
+	}
+
+	start := oldest
+	switch {
+	case rng.StartOffset >= 0:
+		if rng.StartOffset > start {
+			start = rng.StartOffset
+		}
+	case !rng.StartTime.IsZero():
+		start, err = r.offsetAt(partition, rng.StartTime, end)
+		if err != nil {
+			return 0, 0, fmt.Errorf("get offset at start time: %w", err)
+		}
+	}
+
+	if rng.EndOffset >= 0 && rng.EndOffset < end {
+		end = rng.EndOffset
+	}
+	if !rng.EndTime.IsZero() {
+		offset, err := r.offsetAt(partition, rng.EndTime, end)
+		if err != nil {
+			return 0, 0, fmt.Errorf("get offset at end time: %w", err)
+		}
+		if offset < end {
+			end = offset
+		}
+	}
+
+	return start, end, nil
+}
+
+// offsetAt returns the offset of the first message produced at or after the given time,
+// or newest if there is no such message.
+func (r *Reader) offsetAt(partition int32, t time.Time, newest int64) (int64, error) {
+	offset, err := r.offsets.GetOffset(r.topic, partition, t.UnixNano()/int64(time.Millisecond))
+	if err != nil {
+		return 0, err
+	}
+	if offset < 0 {
+		return newest, nil
+	}
+	return offset, nil
+}
+
+// readPartition passes the messages of a partition to handler, until the end offset is reached.
+// It returns the offset after the last message read, which is before the end if the partition was given up
+// after the idle timeout.
+func (r *Reader) readPartition(ctx context.Context, partition int32, start, end int64, idleTimeout time.Duration, handler Handler) (int64, error) {
+	pc, err := r.consumer.ConsumePartition(r.topic, partition, start)
+	if err != nil {
+		return start, fmt.Errorf("consume partition: %w", err)
+	}
+	defer pc.AsyncClose()
+
+	next := start
+	var idle <-chan time.Time
+	for {
+		if idleTimeout > 0 {
+			idle = time.After(idleTimeout)
+		}
+		select {
+		case message, ok := <-pc.Messages():
+			if !ok {
+				return next, fmt.Errorf("partition consumer closed before offset %d", end)
+			}
+			if message.Offset >= end {
+				return end, nil
+			}
+			err = handler(message)
+			if err != nil {
+				return next, err
+			}
+			next = message.Offset + 1
+			if next >= end {
+				return next, nil
+			}
+		case <-idle:
+			return next, nil
+		case <-ctx.Done():
+			return next, ctx.Err()
+		}
+	}
+}
+
+// Close releases the connection to Kafka.
+func (r *Reader) Close() error {
+	err := r.consumer.Close()
+	if r.client != nil {
+		closeErr := r.client.Close()
+		if err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
@@ -0,0 +1,145 @@
+package reader_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/Shopify/sarama/mocks"
+	"github.com/navikt/deployment-event-relays/pkg/kafka/reader"
+	"github.com/stretchr/testify/assert"
+)
+
+const topic = "deployment-events"
+
+var (
+	startTime = time.Date(2021, 3, 4, 5, 0, 0, 0, time.UTC)
+	endTime   = time.Date(2021, 3, 4, 6, 0, 0, 0, time.UTC)
+)
+
+// offsets maps a partition and a time, or sarama.OffsetOldest or sarama.OffsetNewest, to an offset.
+type offsets map[int32]map[int64]int64
+
+func (o offsets) GetOffset(topic string, partition int32, time int64) (int64, error) {
+	offset, ok := o[partition][time]
+	if !ok {
+		return 0, fmt.Errorf("unexpected offset lookup for %s/%d at %d", topic, partition, time)
+	}
+	return offset, nil
+}
+
+func millis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// yield makes a partition consumer return count messages, with consecutive offsets from where it was expected to start.
+func yield(pc *mocks.PartitionConsumer, count int) {
+	for i := 0; i < count; i++ {
+		pc.YieldMessage(&sarama.ConsumerMessage{Value: []byte("event")})
+	}
+}
+
+// collect returns a handler that records the partition and offset of each message.
+func collect(read *[]string) reader.Handler {
+	return func(message *sarama.ConsumerMessage) error {
+		*read = append(*read, fmt.Sprintf("%d/%d", message.Partition, message.Offset))
+		return nil
+	}
+}
+
+func TestReadOffsetRange(t *testing.T) {
+	consumer := mocks.NewConsumer(t, nil)
+	consumer.SetTopicMetadata(map[string][]int32{topic: {0, 1}})
+	yield(consumer.ExpectConsumePartition(topic, 0, 1), 5)
+
+	r := reader.NewWithConsumer(consumer, offsets{
+		0: {sarama.OffsetOldest: 1, sarama.OffsetNewest: 6},
+		1: {sarama.OffsetOldest: 8, sarama.OffsetNewest: 8},
+	}, topic)
+	defer r.Close()
+
+	read := make([]string, 0)
+	unread, err := r.Read(context.Background(), reader.Range{StartOffset: 0, EndOffset: 4}, collect(&read))
+	assert.NoError(t, err)
+	assert.Zero(t, unread)
+	assert.Equal(t, []string{"0/1", "0/2", "0/3"}, read)
+}
+
+func TestReadTimeRange(t *testing.T) {
+	consumer := mocks.NewConsumer(t, nil)
+	yield(consumer.ExpectConsumePartition(topic, 2, 1), 5)
+
+	r := reader.NewWithConsumer(consumer, offsets{
+		2: {sarama.OffsetOldest: 0, sarama.OffsetNewest: 4, millis(startTime): 1, millis(endTime): -1},
+		3: {sarama.OffsetOldest: 0, sarama.OffsetNewest: 4, millis(startTime): -1, millis(endTime): -1},
+	}, topic)
+	defer r.Close()
+
+	rng := reader.Range{
+		Partitions:  []int32{2, 3},
+		StartOffset: -1,
+		StartTime:   startTime,
+		EndOffset:   -1,
+		EndTime:     endTime,
+	}
+	read := make([]string, 0)
+	_, err := r.Read(context.Background(), rng, collect(&read))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"2/1", "2/2", "2/3"}, read)
+}
+
+func TestReadIdleTimeout(t *testing.T) {
+	consumer := mocks.NewConsumer(t, nil)
+	yield(consumer.ExpectConsumePartition(topic, 0, 1), 3)
+
+	r := reader.NewWithConsumer(consumer, offsets{
+		0: {sarama.OffsetOldest: 1, sarama.OffsetNewest: 6},
+	}, topic)
+	defer r.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// offsets 4 and 5 never arrive, as if they had been removed by compaction
+	read := make([]string, 0)
+	rng := reader.Range{Partitions: []int32{0}, StartOffset: -1, EndOffset: -1, IdleTimeout: 50 * time.Millisecond}
+	unread, err := r.Read(ctx, rng, collect(&read))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"0/1", "0/2", "0/3"}, read)
+	assert.Equal(t, int64(2), unread)
+}
+
+func TestReadHandlerError(t *testing.T) {
+	consumer := mocks.NewConsumer(t, nil)
+	yield(consumer.ExpectConsumePartition(topic, 0, 0), 3)
+
+	r := reader.NewWithConsumer(consumer, offsets{
+		0: {sarama.OffsetOldest: 0, sarama.OffsetNewest: 10},
+	}, topic)
+	defer r.Close()
+
+	rng := reader.Range{Partitions: []int32{0}, StartOffset: -1, EndOffset: -1}
+	_, err := r.Read(context.Background(), rng, func(message *sarama.ConsumerMessage) error {
+		return fmt.Errorf("rejected offset %d", message.Offset)
+	})
+	assert.EqualError(t, err, "partition 0: rejected offset 0")
+}
+
+func TestReadCancel(t *testing.T) {
+	consumer := mocks.NewConsumer(t, nil)
+	consumer.ExpectConsumePartition(topic, 0, 0)
+
+	r := reader.NewWithConsumer(consumer, offsets{
+		0: {sarama.OffsetOldest: 0, sarama.OffsetNewest: 10},
+	}, topic)
+	defer r.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	rng := reader.Range{Partitions: []int32{0}, StartOffset: -1, EndOffset: -1}
+	_, err := r.Read(ctx, rng, func(*sarama.ConsumerMessage) error { return nil })
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
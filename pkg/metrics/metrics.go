@@ -1,19 +1,30 @@
 package metrics
 
 import (
+	"strconv"
+	"sync"
+	"time"
+
 	"github.com/prometheus/client_golang/prometheus"
 )
 
 type ProcessStatus string
 
 const (
+	labelCode      = "code"
+	labelError     = "error"
+	labelHost      = "host"
+	labelPartition = "partition"
 	labelStatus    = "status"
 	labelSubsystem = "subsystem"
 
-	LabelValueProcessedOK      ProcessStatus = "ok"
-	LabelValueProcessedDropped ProcessStatus = "dropped"
-	LabelValueProcessedError   ProcessStatus = "error"
-	LabelValueProcessedRetry   ProcessStatus = "retry"
+	LabelValueProcessedOK          ProcessStatus = "ok"
+	LabelValueProcessedDropped     ProcessStatus = "dropped"
+	LabelValueProcessedSkipped     ProcessStatus = "skipped"
+	LabelValueProcessedFiltered    ProcessStatus = "filtered"
+	LabelValueProcessedError       ProcessStatus = "error"
+	LabelValueProcessedRetry       ProcessStatus = "retry"
+	LabelValueProcessedRateLimited ProcessStatus = "rate_limited"
 )
 
 var (
@@ -26,6 +37,31 @@ var (
 		labelStatus,
 	})
 
+	deadLetters = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "deployment_event_relays",
+		Name:      "dead_letters",
+		Help:      "Number of rejected messages forwarded to the dead-letter topic",
+	}, []string{
+		labelSubsystem,
+	})
+
+	attempts = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "deployment_event_relays",
+		Name:      "attempts",
+		Help:      "Number of processing attempts spent on each message before it was handled or given up",
+		Buckets:   []float64{1, 2, 3, 5, 10, 20, 50, 100},
+	}, []string{
+		labelSubsystem,
+	})
+
+	retriesExhausted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "deployment_event_relays",
+		Name:      "retries_exhausted",
+		Help:      "Number of messages that reached the maximum number of processing attempts",
+	}, []string{
+		labelSubsystem,
+	})
+
 	offset = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Namespace: "deployment_event_relays",
 		Name:      "offset",
@@ -33,13 +69,94 @@ var (
 	}, []string{
 		labelSubsystem,
 	})
+
+	partitionOffset = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "deployment_event_relays",
+		Name:      "partition_offset",
+		Help:      "Next Kafka offset to be committed, after all messages before it have been processed",
+	}, []string{
+		labelSubsystem,
+		labelPartition,
+	})
+
+	highWaterMark = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "deployment_event_relays",
+		Name:      "high_water_mark",
+		Help:      "Offset of the next message to be produced to the partition",
+	}, []string{
+		labelSubsystem,
+		labelPartition,
+	})
+
+	lag = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "deployment_event_relays",
+		Name:      "lag",
+		Help:      "Number of messages in the partition that have not yet been processed",
+	}, []string{
+		labelSubsystem,
+		labelPartition,
+	})
+
+	latency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "deployment_event_relays",
+		Name:      "processing_latency_seconds",
+		Help:      "Time from the first processing attempt of a message until it was handled or given up, labeled by status",
+		Buckets:   []float64{0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30, 60, 300, 900},
+	}, []string{
+		labelSubsystem,
+		labelStatus,
+	})
+
+	httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "deployment_event_relays",
+		Name:      "http_request_duration_seconds",
+		Help:      "Time until response headers were received from a relay target, labeled by status code",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{
+		labelSubsystem,
+		labelHost,
+		labelCode,
+	})
+
+	httpTransportErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "deployment_event_relays",
+		Name:      "http_transport_errors",
+		Help:      "Number of requests to a relay target that failed without a response, labeled by kind of error",
+	}, []string{
+		labelSubsystem,
+		labelHost,
+		labelError,
+	})
+)
+
+// partition identifies a single partition consumed by a subsystem.
+type partition struct {
+	subsystem string
+	partition int32
+}
+
+// partitionState holds the latest known offsets of a partition, so that lag can be computed when either changes.
+// Offsets are negative until known.
+type partitionState struct {
+	offset        int64
+	highWaterMark int64
+}
+
+var (
+	partitionsLock sync.Mutex
+	partitions     = make(map[partition]*partitionState)
 )
 
 func Init(subsystem string) {
 	messages.WithLabelValues(subsystem, string(LabelValueProcessedOK)).Add(0)
 	messages.WithLabelValues(subsystem, string(LabelValueProcessedDropped)).Add(0)
 	messages.WithLabelValues(subsystem, string(LabelValueProcessedError)).Add(0)
+	messages.WithLabelValues(subsystem, string(LabelValueProcessedSkipped)).Add(0)
+	messages.WithLabelValues(subsystem, string(LabelValueProcessedFiltered)).Add(0)
 	messages.WithLabelValues(subsystem, string(LabelValueProcessedRetry)).Add(0)
+	messages.WithLabelValues(subsystem, string(LabelValueProcessedRateLimited)).Add(0)
+	deadLetters.WithLabelValues(subsystem).Add(0)
+	retriesExhausted.WithLabelValues(subsystem).Add(0)
 	offset.WithLabelValues(subsystem).Set(0)
 }
 
@@ -48,7 +165,100 @@ func Process(subsystem string, status ProcessStatus, offset_ int64) {
 	offset.WithLabelValues(subsystem).Set(float64(offset_))
 }
 
+// PartitionOffset records the next offset to be committed for a partition.
+func PartitionOffset(subsystem string, partition int32, offset int64) {
+	updatePartition(subsystem, partition, func(state *partitionState) {
+		state.offset = offset
+	})
+}
+
+// HighWaterMark records the offset of the next message to be produced to a partition.
+func HighWaterMark(subsystem string, partition int32, offset int64) {
+	updatePartition(subsystem, partition, func(state *partitionState) {
+		state.highWaterMark = offset
+	})
+}
+
+// ForgetPartition removes the metrics of a partition that is no longer consumed.
+func ForgetPartition(subsystem string, partition_ int32) {
+	partitionsLock.Lock()
+	defer partitionsLock.Unlock()
+
+	delete(partitions, partition{subsystem: subsystem, partition: partition_})
+	labels := prometheus.Labels{
+		labelSubsystem: subsystem,
+		labelPartition: strconv.Itoa(int(partition_)),
+	}
+	partitionOffset.Delete(labels)
+	highWaterMark.Delete(labels)
+	lag.Delete(labels)
+}
+
+func updatePartition(subsystem string, partition_ int32, update func(state *partitionState)) {
+	partitionsLock.Lock()
+	defer partitionsLock.Unlock()
+
+	key := partition{subsystem: subsystem, partition: partition_}
+	state, ok := partitions[key]
+	if !ok {
+		state = &partitionState{offset: -1, highWaterMark: -1}
+		partitions[key] = state
+	}
+	update(state)
+
+	label := strconv.Itoa(int(partition_))
+	if state.offset >= 0 {
+		partitionOffset.WithLabelValues(subsystem, label).Set(float64(state.offset))
+	}
+	if state.highWaterMark >= 0 {
+		highWaterMark.WithLabelValues(subsystem, label).Set(float64(state.highWaterMark))
+	}
+	if state.offset >= 0 && state.highWaterMark >= 0 {
+		lag_ := state.highWaterMark - state.offset
+		if lag_ < 0 {
+			lag_ = 0
+		}
+		lag.WithLabelValues(subsystem, label).Set(float64(lag_))
+	}
+}
+
+// Latency records the time spent processing a message, from the first attempt until it was handled or given up.
+func Latency(subsystem string, status ProcessStatus, duration time.Duration) {
+	latency.WithLabelValues(subsystem, string(status)).Observe(duration.Seconds())
+}
+
+// HTTPRequest records a response from a relay target.
+func HTTPRequest(subsystem, host string, code int, duration time.Duration) {
+	httpRequestDuration.WithLabelValues(subsystem, host, strconv.Itoa(code)).Observe(duration.Seconds())
+}
+
+// HTTPTransportError records a request to a relay target that failed without a response.
+func HTTPTransportError(subsystem, host, kind string) {
+	httpTransportErrors.WithLabelValues(subsystem, host, kind).Inc()
+}
+
+func DeadLetter(subsystem string) {
+	deadLetters.WithLabelValues(subsystem).Inc()
+}
+
+func Attempts(subsystem string, count int) {
+	attempts.WithLabelValues(subsystem).Observe(float64(count))
+}
+
+func RetriesExhausted(subsystem string) {
+	retriesExhausted.WithLabelValues(subsystem).Inc()
+}
+
 func init() {
 	prometheus.MustRegister(messages)
+	prometheus.MustRegister(deadLetters)
+	prometheus.MustRegister(attempts)
+	prometheus.MustRegister(retriesExhausted)
 	prometheus.MustRegister(offset)
+	prometheus.MustRegister(partitionOffset)
+	prometheus.MustRegister(highWaterMark)
+	prometheus.MustRegister(lag)
+	prometheus.MustRegister(latency)
+	prometheus.MustRegister(httpRequestDuration)
+	prometheus.MustRegister(httpTransportErrors)
 }
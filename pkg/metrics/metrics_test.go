@@ -0,0 +1,25 @@
+package metrics
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPartitionLag(t *testing.T) {
+	PartitionOffset("test", 3, 10)
+	assert.Equal(t, 10.0, testutil.ToFloat64(partitionOffset.WithLabelValues("test", "3")))
+	assert.Equal(t, 0, testutil.CollectAndCount(lag.MustCurryWith(map[string]string{labelSubsystem: "test"})))
+
+	HighWaterMark("test", 3, 15)
+	assert.Equal(t, 15.0, testutil.ToFloat64(highWaterMark.WithLabelValues("test", "3")))
+	assert.Equal(t, 5.0, testutil.ToFloat64(lag.WithLabelValues("test", "3")))
+
+	PartitionOffset("test", 3, 15)
+	assert.Equal(t, 0.0, testutil.ToFloat64(lag.WithLabelValues("test", "3")))
+
+	ForgetPartition("test", 3)
+	assert.Equal(t, 0, testutil.CollectAndCount(lag.MustCurryWith(map[string]string{labelSubsystem: "test"})))
+	assert.Equal(t, 0, testutil.CollectAndCount(partitionOffset.MustCurryWith(map[string]string{labelSubsystem: "test"})))
+}
@@ -1,7 +1,7 @@
 package nora
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -9,11 +9,15 @@ import (
 	"strings"
 
 	"github.com/navikt/deployment-event-relays/pkg/deployment"
+	"github.com/navikt/deployment-event-relays/pkg/httpclient"
+	"github.com/navikt/deployment-event-relays/pkg/outcome"
+	"github.com/navikt/deployment-event-relays/pkg/relay"
 	log "github.com/sirupsen/logrus"
 )
 
 var (
-	ErrNotProduction = errors.New("event does not belong to production")
+	ErrTeamRegistered    = errors.New("application is already registered to another team")
+	ErrAlreadyRegistered = errors.New("application is already registered")
 )
 
 // Payload represents the JSON payload supported by the nora API. All fields are required
@@ -27,45 +31,57 @@ type Payload struct {
 
 type Relay struct {
 	URL string
+	// Client performs the HTTP requests. Nil means http.DefaultClient.
+	Client *http.Client
 }
 
-func (r *Relay) Process(event *deployment.Event) (retry bool, err error) {
-	if event.GetEnvironment() != deployment.Environment_production {
-		return false, ErrNotProduction
+// Process registers the application in Nora.
+// Only production events should be sent to Nora; see the default filters of the subsystem.
+func (r *Relay) Process(ctx context.Context, event *deployment.Event) error {
+	payload, err := r.Build(event)
+	if err != nil {
+		return err
 	}
+	return r.Deliver(ctx, payload)
+}
 
-	noraEvent := BuildEvent(event)
-	payload, err := noraEvent.Marshal()
-	log.Infof("Posting payload to Nora: %s", payload)
+// Build creates the request that registers the application in Nora.
+func (r *Relay) Build(event *deployment.Event) (*relay.Payload, error) {
+	body, err := BuildEvent(event).Marshal()
 	if err != nil {
-		return false, fmt.Errorf("marshal Nora payload: %s", err)
+		return nil, outcome.Permanent(fmt.Errorf("marshal Nora payload: %s", err))
 	}
+	return &relay.Payload{
+		Method:      "POST",
+		URL:         r.URL,
+		ContentType: "application/json",
+		Body:        body,
+	}, nil
+}
+
+// Deliver posts a payload to Nora.
+func (r *Relay) Deliver(ctx context.Context, payload *relay.Payload) error {
+	log.Infof("Posting payload to Nora: %s", payload.Body)
 
-	body := bytes.NewReader(payload)
-	request, err := http.NewRequest("POST", r.URL, body)
+	request, err := payload.Request(ctx)
 	if err != nil {
-		return true, fmt.Errorf("create new HTTP request object: %s", err)
+		return outcome.Transient(fmt.Errorf("create new HTTP request object: %s", err))
 	}
-	request.Header.Set("Content-Type", "application/json")
 
-	response, err := http.DefaultClient.Do(request)
+	response, err := httpclient.OrDefault(r.Client).Do(request)
 	if err != nil {
-		return true, fmt.Errorf("post to Nora: %s", err)
+		return outcome.Transient(fmt.Errorf("post to Nora: %w", httpclient.RedactError(err)))
 	}
 
 	defer response.Body.Close()
 
 	switch response.StatusCode {
-	case http.StatusOK: // Application created
-		return false, nil
-	case http.StatusCreated: // Application created
-		return false, nil
 	case http.StatusForbidden: // Writing null team name to entry with team registered
-		return false, nil
+		return outcome.Skipped(ErrTeamRegistered)
 	case http.StatusUnprocessableEntity: // Application is already registered
-		return false, nil
+		return outcome.Skipped(ErrAlreadyRegistered)
 	default:
-		return true, fmt.Errorf("POST %s: %s", r.URL, response.Status)
+		return outcome.HTTPStatus(response)
 	}
 }
 
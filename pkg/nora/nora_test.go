@@ -1,10 +1,14 @@
 package nora_test
 
 import (
+	"context"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 
 	"github.com/navikt/deployment-event-relays/pkg/deployment"
 	"github.com/navikt/deployment-event-relays/pkg/nora"
+	"github.com/navikt/deployment-event-relays/pkg/outcome"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -61,8 +65,35 @@ var eventNoraTests = []eventNoraTest{
 }
 
 func TestNoraPayload(t *testing.T) {
-	for _, test := range eventNoraTests {
+	for i := range eventNoraTests {
+		test := &eventNoraTests[i]
 		noraPayload := nora.BuildEvent(&test.event)
 		assert.Equal(t, test.data, noraPayload)
 	}
 }
+
+func TestRelayClassification(t *testing.T) {
+	status := http.StatusCreated
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	relay := &nora.Relay{URL: server.URL}
+	production := &deployment.Event{Environment: deployment.Environment_production}
+
+	for code, class := range map[int]outcome.Class{
+		http.StatusOK:                  outcome.ClassOK,
+		http.StatusCreated:             outcome.ClassOK,
+		http.StatusForbidden:           outcome.ClassSkipped,
+		http.StatusUnprocessableEntity: outcome.ClassSkipped,
+		http.StatusBadRequest:          outcome.ClassPermanent,
+		http.StatusUnauthorized:        outcome.ClassTransient,
+		http.StatusNotFound:            outcome.ClassTransient,
+		http.StatusBadGateway:          outcome.ClassTransient,
+	} {
+		status = code
+		err := relay.Process(context.Background(), production)
+		assert.Equal(t, class, outcome.Classify(err), "HTTP %d", code)
+	}
+}
@@ -0,0 +1,62 @@
+package nora
+
+import (
+	"github.com/navikt/deployment-event-relays/pkg/config"
+	"github.com/navikt/deployment-event-relays/pkg/httpclient"
+	"github.com/navikt/deployment-event-relays/pkg/relay"
+	"github.com/spf13/pflag"
+)
+
+const RelayType = "nora"
+
+// Settings configure a Nora relay.
+type Settings struct {
+	URL              string `json:"url"`
+	config.Subsystem `json:",squash"`
+}
+
+func init() {
+	relay.Register(relay.Factory{
+		Type:      RelayType,
+		Key:       RelayType,
+		Defaults:  func() config.Settings { return DefaultSettings() },
+		BindFlags: func(settings config.Settings, prefix string) { settings.(*Settings).bindFlags(prefix) },
+		New: func(name string, settings config.Settings) (relay.Relay, error) {
+			return New(name, *settings.(*Settings))
+		},
+	})
+}
+
+// DefaultSettings only let production deployments through to Nora.
+// Set an empty list of filters to send all events.
+func DefaultSettings() *Settings {
+	settings := &Settings{
+		Subsystem: config.DefaultSubsystem(),
+	}
+	settings.Filters = []config.Filter{
+		{Key: "environment", Equals: "production"},
+	}
+	return settings
+}
+
+func (s *Settings) bindFlags(prefix string) {
+	pflag.StringVar(&s.URL, prefix+".url", s.URL, "Nora API endpoint. Enables the nora subsystem")
+	config.BindSubsystemFlags(&s.Subsystem, prefix)
+}
+
+func (s *Settings) Enabled() bool {
+	return len(s.URL) > 0
+}
+
+func (s *Settings) Validate(v *config.Validator, key string) {
+	v.URL(key+".url", s.URL)
+}
+
+func New(name string, s Settings) (relay.Relay, error) {
+	return relay.Relay{
+		Processor: &Relay{
+			URL:    s.URL,
+			Client: httpclient.New(name),
+		},
+	}, nil
+}
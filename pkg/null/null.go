@@ -1,13 +1,34 @@
 package null
 
 import (
+	"context"
+
 	"github.com/navikt/deployment-event-relays/pkg/deployment"
+	"github.com/navikt/deployment-event-relays/pkg/outcome"
+	"github.com/navikt/deployment-event-relays/pkg/relay"
 )
 
 type Relay struct {
 	URL string
 }
 
-func (r *Relay) Process(event *deployment.Event) (retry bool, err error) {
-	return false, nil
+func (r *Relay) Process(ctx context.Context, event *deployment.Event) error {
+	payload, err := r.Build(event)
+	if err != nil {
+		return err
+	}
+	return r.Deliver(ctx, payload)
+}
+
+// Build returns an empty payload, as nothing is sent anywhere.
+func (r *Relay) Build(event *deployment.Event) (*relay.Payload, error) {
+	return &relay.Payload{URL: r.URL}, nil
+}
+
+func (r *Relay) Deliver(ctx context.Context, payload *relay.Payload) error {
+	err := ctx.Err()
+	if err != nil {
+		return outcome.Transient(err)
+	}
+	return nil
 }
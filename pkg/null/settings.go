@@ -0,0 +1,45 @@
+package null
+
+import (
+	"github.com/navikt/deployment-event-relays/pkg/config"
+	"github.com/navikt/deployment-event-relays/pkg/relay"
+	"github.com/spf13/pflag"
+)
+
+const RelayType = "null"
+
+// Settings configure a relay that discards all events.
+type Settings struct {
+	Enable           bool `json:"enabled"`
+	config.Subsystem `json:",squash"`
+}
+
+func init() {
+	relay.Register(relay.Factory{
+		Type:      RelayType,
+		Key:       RelayType,
+		Defaults:  func() config.Settings { return DefaultSettings() },
+		BindFlags: func(settings config.Settings, prefix string) { settings.(*Settings).bindFlags(prefix) },
+		New: func(name string, settings config.Settings) (relay.Relay, error) {
+			return relay.Relay{Processor: &Relay{}}, nil
+		},
+	})
+}
+
+func DefaultSettings() *Settings {
+	return &Settings{
+		Subsystem: config.DefaultSubsystem(),
+	}
+}
+
+func (s *Settings) bindFlags(prefix string) {
+	pflag.BoolVar(&s.Enable, prefix+".enabled", s.Enable, "Enable the null subsystem, which discards all events")
+	config.BindSubsystemFlags(&s.Subsystem, prefix)
+}
+
+func (s *Settings) Enabled() bool {
+	return s.Enable
+}
+
+func (s *Settings) Validate(v *config.Validator, key string) {
+}
@@ -0,0 +1,141 @@
+package outcome
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Class describes how the consumer should treat the result of processing an event.
+type Class string
+
+const (
+	// ClassOK means the event was processed successfully.
+	ClassOK Class = "ok"
+	// ClassSkipped means the event was deliberately not processed by the relay.
+	ClassSkipped Class = "skipped"
+	// ClassFiltered means the event was excluded by the filter rules of the subsystem, before reaching the relay.
+	ClassFiltered Class = "filtered"
+	// ClassPermanent means the event was rejected and will never succeed, no matter how many times it is retried.
+	ClassPermanent Class = "permanent"
+	// ClassTransient means processing failed, but might succeed if retried.
+	ClassTransient Class = "transient"
+	// ClassRateLimited means the destination asked us to back off before retrying.
+	ClassRateLimited Class = "rate_limited"
+)
+
+// Error wraps an error with its class.
+type Error struct {
+	Class      Class
+	RetryAfter time.Duration
+	Err        error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Skipped marks the event as deliberately not processed.
+func Skipped(err error) error {
+	return &Error{Class: ClassSkipped, Err: err}
+}
+
+// Filtered marks the event as excluded by filter rules.
+func Filtered(err error) error {
+	return &Error{Class: ClassFiltered, Err: err}
+}
+
+// Permanent marks the event as permanently rejected.
+func Permanent(err error) error {
+	return &Error{Class: ClassPermanent, Err: err}
+}
+
+// Transient marks the event as failed, but retriable.
+func Transient(err error) error {
+	return &Error{Class: ClassTransient, Err: err}
+}
+
+// RateLimited marks the event as retriable after waiting at least the given duration.
+func RateLimited(err error, retryAfter time.Duration) error {
+	return &Error{Class: ClassRateLimited, RetryAfter: retryAfter, Err: err}
+}
+
+// Classify returns the class of an error returned from processing an event.
+// A nil error is ClassOK. Errors without a class are treated as transient,
+// so that events are never lost because of an unexpected error.
+func Classify(err error) Class {
+	if err == nil {
+		return ClassOK
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Class
+	}
+	return ClassTransient
+}
+
+// RetryAfter returns the minimum time to wait before retrying, or zero if unspecified.
+func RetryAfter(err error) time.Duration {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.RetryAfter
+	}
+	return 0
+}
+
+// HTTPStatus classifies the response to an HTTP request.
+//
+// Successful responses yield nil. HTTP 429 is rate limited, honoring any Retry-After header.
+// Request timeouts, server errors, authentication failures and missing resources are transient,
+// as they are usually caused by configuration or outages that can be fixed without losing events.
+// Other client errors are permanent, as sending the same request again will not change the result.
+func HTTPStatus(response *http.Response) error {
+	if response.StatusCode < 300 {
+		return nil
+	}
+
+	err := fmt.Errorf("%s %s: %s", response.Request.Method, origin(response.Request.URL), response.Status)
+
+	switch response.StatusCode {
+	case http.StatusTooManyRequests:
+		return RateLimited(err, RetryAfterHeader(response))
+	case http.StatusRequestTimeout, http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound:
+		return Transient(err)
+	}
+	if response.StatusCode >= 400 && response.StatusCode < 500 {
+		return Permanent(err)
+	}
+	return Transient(err)
+}
+
+// origin returns the scheme and host of a URL. The rest of the URL is left out of error messages,
+// as it may contain credentials.
+func origin(u *url.URL) string {
+	return u.Scheme + "://" + u.Host
+}
+
+// RetryAfterHeader returns the duration requested by the Retry-After header of a response, or zero if absent.
+func RetryAfterHeader(response *http.Response) time.Duration {
+	return parseRetryAfter(response.Header.Get("Retry-After"), time.Now())
+}
+
+// parseRetryAfter parses the Retry-After header, which is either a number of seconds or an HTTP date.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if len(value) == 0 {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil && date.After(now) {
+		return date.Sub(now)
+	}
+	return 0
+}
@@ -0,0 +1,76 @@
+package outcome
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClassify(t *testing.T) {
+	err := fmt.Errorf("boom")
+
+	assert.Equal(t, ClassOK, Classify(nil))
+	assert.Equal(t, ClassTransient, Classify(err))
+	assert.Equal(t, ClassSkipped, Classify(Skipped(err)))
+	assert.Equal(t, ClassPermanent, Classify(Permanent(err)))
+	assert.Equal(t, ClassTransient, Classify(Transient(err)))
+	assert.Equal(t, ClassRateLimited, Classify(RateLimited(err, time.Second)))
+
+	wrapped := fmt.Errorf("wrapped: %w", Permanent(err))
+	assert.Equal(t, ClassPermanent, Classify(wrapped))
+	assert.ErrorIs(t, wrapped, err)
+	assert.Equal(t, "wrapped: boom", wrapped.Error())
+
+	assert.Equal(t, time.Second, RetryAfter(fmt.Errorf("wrapped: %w", RateLimited(err, time.Second))))
+	assert.Equal(t, time.Duration(0), RetryAfter(err))
+}
+
+func TestHTTPStatus(t *testing.T) {
+	request := &http.Request{
+		Method: "POST",
+		URL:    &url.URL{Scheme: "http", Host: "example.com"},
+	}
+	response := func(code int, header http.Header) *http.Response {
+		return &http.Response{
+			StatusCode: code,
+			Status:     fmt.Sprintf("%d %s", code, http.StatusText(code)),
+			Header:     header,
+			Request:    request,
+		}
+	}
+
+	assert.NoError(t, HTTPStatus(response(http.StatusOK, nil)))
+	assert.NoError(t, HTTPStatus(response(http.StatusNoContent, nil)))
+	assert.Equal(t, ClassPermanent, Classify(HTTPStatus(response(http.StatusBadRequest, nil))))
+	assert.Equal(t, ClassPermanent, Classify(HTTPStatus(response(http.StatusConflict, nil))))
+	assert.Equal(t, ClassTransient, Classify(HTTPStatus(response(http.StatusUnauthorized, nil))))
+	assert.Equal(t, ClassTransient, Classify(HTTPStatus(response(http.StatusForbidden, nil))))
+	assert.Equal(t, ClassTransient, Classify(HTTPStatus(response(http.StatusNotFound, nil))))
+	assert.Equal(t, ClassTransient, Classify(HTTPStatus(response(http.StatusRequestTimeout, nil))))
+	assert.Equal(t, ClassTransient, Classify(HTTPStatus(response(http.StatusInternalServerError, nil))))
+	assert.Equal(t, ClassTransient, Classify(HTTPStatus(response(http.StatusServiceUnavailable, nil))))
+
+	err := HTTPStatus(response(http.StatusTooManyRequests, http.Header{"Retry-After": []string{"120"}}))
+	assert.Equal(t, ClassRateLimited, Classify(err))
+	assert.Equal(t, time.Minute*2, RetryAfter(err))
+	assert.EqualError(t, err, "POST http://example.com: 429 Too Many Requests")
+
+	// only the scheme and host of the URL are included, as the rest may contain credentials
+	request.URL = &url.URL{Scheme: "https", User: url.UserPassword("user", "password"), Host: "example.com", Path: "/services/secret", RawQuery: "token=secret"}
+	assert.EqualError(t, HTTPStatus(response(http.StatusNotFound, nil)), "POST https://example.com: 404 Not Found")
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2021, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	assert.Equal(t, time.Duration(0), parseRetryAfter("", now))
+	assert.Equal(t, time.Duration(0), parseRetryAfter("soon", now))
+	assert.Equal(t, time.Duration(0), parseRetryAfter("-5", now))
+	assert.Equal(t, time.Second*5, parseRetryAfter("5", now))
+	assert.Equal(t, time.Minute, parseRetryAfter("Fri, 01 Jan 2021 12:01:00 GMT", now))
+	assert.Equal(t, time.Duration(0), parseRetryAfter("Fri, 01 Jan 2021 11:00:00 GMT", now))
+}
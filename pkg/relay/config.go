@@ -0,0 +1,140 @@
+package relay
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/navikt/deployment-event-relays/pkg/config"
+)
+
+// BindFlags creates the top-level section of each relay type with default settings, and binds its command-line flags.
+func BindFlags(cfg *config.Config) {
+	if cfg.Sections == nil {
+		cfg.Sections = make(map[string]interface{})
+	}
+	for _, factory := range Factories() {
+		if len(factory.Key) == 0 || factory.Named {
+			continue
+		}
+		settings := factory.Defaults()
+		if factory.BindFlags != nil {
+			factory.BindFlags(settings, factory.Key)
+		}
+		cfg.Sections[factory.Key] = settings
+	}
+}
+
+// Decode replaces the relay sections read by config.Load with the settings of each relay type,
+// with default values for settings that are not given. Sections that are already decoded are kept.
+//
+// Top-level sections become config.Settings, or a map of config.Settings for relay types with named instances.
+// Sections that do not belong to a registered relay type are rejected.
+// All errors are returned together, like those of config.Validate.
+func Decode(cfg *config.Config) error {
+	raw := cfg.Sections
+	sections := make(map[string]interface{})
+	var errs []error
+
+	for _, factory := range Factories() {
+		if len(factory.Key) == 0 {
+			continue
+		}
+		input, ok := raw[factory.Key]
+		delete(raw, factory.Key)
+
+		if !factory.Named {
+			settings, err := decode(factory, input, factory.Key)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			sections[factory.Key] = settings
+			continue
+		}
+
+		instances, decoded := input.(map[string]config.Settings)
+		if decoded {
+			sections[factory.Key] = instances
+			continue
+		}
+		instances = make(map[string]config.Settings)
+		if ok && input != nil {
+			inputs, ok := input.(map[string]interface{})
+			if !ok {
+				errs = append(errs, fmt.Errorf("%s: must be a map of named instances", factory.Key))
+				continue
+			}
+			for _, name := range sortedKeys(inputs) {
+				settings, err := decode(factory, inputs[name], factory.Key+"."+name)
+				if err != nil {
+					errs = append(errs, err)
+					continue
+				}
+				instances[name] = settings
+			}
+		}
+		sections[factory.Key] = instances
+	}
+
+	for _, key := range sortedKeys(raw) {
+		errs = append(errs, config.UnknownKey(key))
+	}
+
+	for i := range cfg.Relays {
+		relay := &cfg.Relays[i]
+		key := fmt.Sprintf("relays[%d]", i)
+
+		factory, ok := Lookup(relay.Type)
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s.type: relay type '%s' is not supported", key, relay.Type))
+			continue
+		}
+
+		input := relay.Sections[relay.Type]
+		delete(relay.Sections, relay.Type)
+		for _, section := range sortedKeys(relay.Sections) {
+			errs = append(errs, config.UnknownKey(config.JoinKey(key, section)))
+		}
+
+		settings, err := decode(factory, input, key+"."+relay.Type)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		relay.Sections = map[string]interface{}{
+			relay.Type: settings,
+		}
+	}
+
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+	cfg.Sections = sections
+	return nil
+}
+
+// decode decodes a settings section into the default settings of a relay type.
+func decode(factory Factory, input interface{}, key string) (config.Settings, error) {
+	if settings, ok := input.(config.Settings); ok {
+		return settings, nil
+	}
+	settings := factory.Defaults()
+	if input == nil {
+		return settings, nil
+	}
+	err := config.Decode(key, input, settings)
+	if err != nil {
+		return nil, err
+	}
+	return settings, nil
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,87 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/navikt/deployment-event-relays/pkg/deployment"
+	"github.com/navikt/deployment-event-relays/pkg/outcome"
+	log "github.com/sirupsen/logrus"
+)
+
+// Payload is the request a relay sends to its destination for an event.
+type Payload struct {
+	Method string
+	// URL is the full target of the request. It may contain secrets, and is never shown; see Destination.
+	URL         string
+	ContentType string
+	Body        []byte
+}
+
+// Destination describes where the payload is sent, without revealing any secrets in the URL.
+// Only the method and host are included.
+func (p *Payload) Destination() string {
+	u, err := url.Parse(p.URL)
+	if err != nil || len(u.Host) == 0 {
+		return p.Method
+	}
+	return p.Method + " " + u.Host
+}
+
+// Request creates the HTTP request for the payload.
+func (p *Payload) Request(ctx context.Context) (*http.Request, error) {
+	request, err := http.NewRequestWithContext(ctx, p.Method, p.URL, bytes.NewReader(p.Body))
+	if err != nil {
+		return nil, err
+	}
+	if len(p.ContentType) > 0 {
+		request.Header.Set("Content-Type", p.ContentType)
+	}
+	return request, nil
+}
+
+// Builder is a processor that builds the payload of an event separately from delivering it.
+// Process is equivalent to Build followed by Deliver.
+type Builder interface {
+	Processor
+	// Build creates the payload for an event, or returns an error classified by the outcome package
+	// if the event cannot or should not be delivered.
+	Build(event *deployment.Event) (*Payload, error)
+	// Deliver sends a payload created by Build.
+	Deliver(ctx context.Context, payload *Payload) error
+}
+
+// DryRunError is returned by dry-run processors instead of delivering an event.
+// It holds the payload that would have been sent.
+type DryRunError struct {
+	Payload *Payload
+}
+
+func (e *DryRunError) Error() string {
+	return fmt.Sprintf("dry run; not sent to %s", e.Payload.Destination())
+}
+
+type dryRun struct {
+	builder Builder
+}
+
+// DryRun returns a processor that builds the payload of each event and logs it, without delivering it.
+// Events are reported as skipped, with a DryRunError holding the payload.
+func DryRun(builder Builder) Processor {
+	return &dryRun{builder: builder}
+}
+
+func (d *dryRun) Process(ctx context.Context, event *deployment.Event) error {
+	payload, err := d.builder.Build(event)
+	if err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{
+		"correlation_id": event.GetCorrelationID(),
+		"destination":    payload.Destination(),
+	}).Infof("Dry run payload: %s", payload.Body)
+	return outcome.Skipped(&DryRunError{Payload: payload})
+}
@@ -0,0 +1,87 @@
+// Package relay keeps a registry of relay types. Each relay package registers a Factory,
+// which declares the settings, command-line flags and constructor of the relay,
+// so that relays can be configured and built without the rest of the program knowing about them.
+package relay
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/navikt/deployment-event-relays/pkg/config"
+	"github.com/navikt/deployment-event-relays/pkg/deployment"
+)
+
+// Processor delivers deployment events to a destination.
+type Processor interface {
+	Process(ctx context.Context, event *deployment.Event) error
+}
+
+// Relay is a relay built by a Factory.
+type Relay struct {
+	Processor Processor
+	// Closer, if set, is called on shutdown, after the Kafka consumers have stopped.
+	Closer func(ctx context.Context) error
+}
+
+// Factory describes a relay type.
+type Factory struct {
+	// Type identifies the relay type in relay instances, and names the section with its settings.
+	Type string
+
+	// Key is the top-level configuration section of the relay type, such as "influxdb".
+	// It configures a single instance, named after the type, unless Named is set.
+	Key string
+	// Named means that the top-level section is a map of instances, named "<type>/<name>".
+	Named bool
+
+	// Defaults returns a pointer to new settings with default values.
+	Defaults func() config.Settings
+	// BindFlags binds command-line flags to the settings of the top-level section, prefixed with Key.
+	// Optional, and not used for relay types with named instances.
+	BindFlags func(settings config.Settings, prefix string)
+	// New builds a relay from its settings. The name is used as the subsystem in metrics and logs.
+	New func(name string, settings config.Settings) (Relay, error)
+}
+
+var (
+	factories     = make(map[string]Factory)
+	factoriesLock sync.RWMutex
+)
+
+// Register makes a relay type available. It is meant to be called from the init function of the relay package,
+// and panics if the relay type is registered twice.
+func Register(factory Factory) {
+	factoriesLock.Lock()
+	defer factoriesLock.Unlock()
+
+	if _, ok := factories[factory.Type]; ok {
+		panic(fmt.Sprintf("relay type '%s' is already registered", factory.Type))
+	}
+	factories[factory.Type] = factory
+}
+
+// Lookup returns the factory of a relay type.
+func Lookup(relayType string) (Factory, bool) {
+	factoriesLock.RLock()
+	defer factoriesLock.RUnlock()
+
+	factory, ok := factories[relayType]
+	return factory, ok
+}
+
+// Factories returns all registered relay types, ordered by type.
+func Factories() []Factory {
+	factoriesLock.RLock()
+	defer factoriesLock.RUnlock()
+
+	result := make([]Factory, 0, len(factories))
+	for _, factory := range factories {
+		result = append(result, factory)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Type < result[j].Type
+	})
+	return result
+}
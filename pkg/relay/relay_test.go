@@ -0,0 +1,190 @@
+package relay_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/navikt/deployment-event-relays/pkg/config"
+	"github.com/navikt/deployment-event-relays/pkg/deployment"
+	"github.com/navikt/deployment-event-relays/pkg/relay"
+	"github.com/stretchr/testify/assert"
+)
+
+type settings struct {
+	URL              string `json:"url"`
+	config.Subsystem `json:",squash"`
+}
+
+func (s *settings) Enabled() bool {
+	return len(s.URL) > 0
+}
+
+func (s *settings) Validate(v *config.Validator, key string) {
+	v.URL(key+".url", s.URL)
+}
+
+type processor struct {
+	url string
+}
+
+func (p *processor) Process(ctx context.Context, event *deployment.Event) error {
+	return nil
+}
+
+func factory(relayType, key string, named bool) relay.Factory {
+	return relay.Factory{
+		Type:  relayType,
+		Key:   key,
+		Named: named,
+		Defaults: func() config.Settings {
+			return &settings{Subsystem: config.DefaultSubsystem()}
+		},
+		New: func(name string, s config.Settings) (relay.Relay, error) {
+			return relay.Relay{Processor: &processor{url: s.(*settings).URL}}, nil
+		},
+	}
+}
+
+func init() {
+	relay.Register(factory("single", "single", false))
+	relay.Register(factory("named", "nameds", true))
+	relay.Register(factory("instance", "", false))
+}
+
+func TestRegister(t *testing.T) {
+	assert.Panics(t, func() {
+		relay.Register(factory("single", "other", false))
+	})
+
+	f, ok := relay.Lookup("named")
+	assert.True(t, ok)
+	assert.Equal(t, "nameds", f.Key)
+
+	_, ok = relay.Lookup("unknown")
+	assert.False(t, ok)
+
+	types := make([]string, 0)
+	for _, f := range relay.Factories() {
+		types = append(types, f.Type)
+	}
+	assert.Equal(t, []string{"instance", "named", "single"}, types)
+}
+
+func TestDecode(t *testing.T) {
+	cfg := config.DefaultConfig()
+	cfg.Sections = map[string]interface{}{
+		"single": map[string]interface{}{
+			"url":     "http://single",
+			"timeout": "1s",
+		},
+		"nameds": map[string]interface{}{
+			"first": map[string]interface{}{
+				"url": "http://first",
+			},
+		},
+	}
+	cfg.Relays = []config.Relay{
+		{
+			Name: "instance",
+			Type: "instance",
+			Sections: map[string]interface{}{
+				"instance": map[string]interface{}{
+					"url":     "http://instance",
+					"filters": []interface{}{},
+				},
+			},
+		},
+		{
+			Name: "defaults",
+			Type: "single",
+		},
+	}
+
+	err := relay.Decode(cfg)
+	assert.NoError(t, err)
+
+	single := cfg.Sections["single"].(*settings)
+	assert.Equal(t, "http://single", single.URL)
+	assert.Equal(t, config.DefaultSubsystem().Retry, single.Retry)
+	assert.Equal(t, "1s", single.Timeout.String())
+
+	named := cfg.Sections["nameds"].(map[string]config.Settings)
+	assert.Len(t, named, 1)
+	assert.Equal(t, "http://first", named["first"].(*settings).URL)
+
+	instance := cfg.Relays[0].Settings().(*settings)
+	assert.Equal(t, "http://instance", instance.URL)
+	assert.NotNil(t, instance.Filters)
+	assert.Empty(t, instance.Filters)
+
+	assert.Equal(t, config.DefaultSubsystem(), cfg.Relays[1].Settings().Common())
+
+	// Decoding again keeps the decoded settings.
+	assert.NoError(t, relay.Decode(cfg))
+	assert.Same(t, single, cfg.Sections["single"])
+}
+
+func TestDecodeErrors(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		cfg      config.Config
+		expected string
+	}{
+		{
+			name: "unknown section",
+			cfg: config.Config{
+				Sections: map[string]interface{}{"vear": map[string]interface{}{}},
+			},
+			expected: "vear: unknown key",
+		},
+		{
+			name: "unknown setting",
+			cfg: config.Config{
+				Sections: map[string]interface{}{"single": map[string]interface{}{"ulr": "http://single"}},
+			},
+			expected: "single.ulr: unknown key",
+		},
+		{
+			name: "all unknown keys",
+			cfg: config.Config{
+				Sections: map[string]interface{}{
+					"single": map[string]interface{}{
+						"ulr":   "http://single",
+						"retry": map[string]interface{}{"fallbak": "drop"},
+					},
+					"nameds": map[string]interface{}{
+						"first": map[string]interface{}{"bogus": true},
+					},
+					"vear": map[string]interface{}{},
+				},
+			},
+			expected: "nameds.first.bogus: unknown key\n" +
+				"single.retry.fallbak: unknown key\n" +
+				"single.ulr: unknown key\n" +
+				"vear: unknown key",
+		},
+		{
+			name: "unknown relay type",
+			cfg: config.Config{
+				Relays: []config.Relay{{Name: "pigeon", Type: "carrier-pigeon"}},
+			},
+			expected: "relays[0].type: relay type 'carrier-pigeon' is not supported",
+		},
+		{
+			name: "section of other relay type",
+			cfg: config.Config{
+				Relays: []config.Relay{{
+					Name:     "instance",
+					Type:     "instance",
+					Sections: map[string]interface{}{"single": map[string]interface{}{}},
+				}},
+			},
+			expected: "relays[0].single: unknown key",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			err := relay.Decode(&test.cfg)
+			assert.EqualError(t, err, test.expected)
+		})
+	}
+}
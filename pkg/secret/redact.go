@@ -0,0 +1,98 @@
+package secret
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Redacted replaces secrets in logs and printed configuration.
+const Redacted = "*** REDACTED ***"
+
+// minLength is the length of the shortest value that is redacted.
+// Shorter values would match large parts of unrelated log messages.
+const minLength = 4
+
+var registry = struct {
+	sync.RWMutex
+	values   map[string]bool
+	replacer *strings.Replacer
+}{
+	values:   make(map[string]bool),
+	replacer: strings.NewReplacer(),
+}
+
+// Register marks a value as secret, so that it is replaced by Redacted wherever it occurs in Redact.
+// Values read from files are registered automatically, including previous values after a reload.
+func Register(value string) {
+	if len(value) < minLength {
+		return
+	}
+
+	registry.Lock()
+	defer registry.Unlock()
+
+	if registry.values[value] {
+		return
+	}
+	registry.values[value] = true
+
+	// Replace longer values first, so that a secret containing another one is redacted as a whole.
+	values := make([]string, 0, len(registry.values))
+	for v := range registry.values {
+		values = append(values, v)
+	}
+	sort.Slice(values, func(i, j int) bool {
+		return len(values[i]) > len(values[j])
+	})
+	pairs := make([]string, 0, len(values)*2)
+	for _, v := range values {
+		pairs = append(pairs, v, Redacted)
+	}
+	registry.replacer = strings.NewReplacer(pairs...)
+}
+
+// Redact replaces all registered secrets in s.
+func Redact(s string) string {
+	registry.RLock()
+	defer registry.RUnlock()
+	return registry.replacer.Replace(s)
+}
+
+// Formatter wraps a log formatter, redacting secrets from the message and fields of each entry,
+// as well as from the formatted output.
+type Formatter struct {
+	Formatter log.Formatter
+}
+
+func (f *Formatter) Format(entry *log.Entry) ([]byte, error) {
+	redacted := *entry
+	redacted.Message = Redact(entry.Message)
+	redacted.Data = make(log.Fields, len(entry.Data))
+	for key, value := range entry.Data {
+		switch value := value.(type) {
+		case string:
+			redacted.Data[key] = Redact(value)
+		case error:
+			redacted.Data[key] = Redact(value.Error())
+		default:
+			redacted.Data[key] = value
+		}
+	}
+
+	output, err := f.Formatter.Format(&redacted)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(Redact(string(output))), nil
+}
+
+// RedactLogs installs a Formatter on the logger, wrapping its current formatter.
+func RedactLogs(logger *log.Logger) {
+	if _, ok := logger.Formatter.(*Formatter); ok {
+		return
+	}
+	logger.SetFormatter(&Formatter{Formatter: logger.Formatter})
+}
@@ -0,0 +1,123 @@
+// Package secret holds credentials that are given in configuration or read from mounted files,
+// and keeps their values out of logs.
+package secret
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Value is a credential that may be replaced while the program runs.
+// A nil Value is empty.
+//
+// Formatting a Value with the fmt package prints Redacted, so that it cannot be logged by accident.
+type Value struct {
+	value atomic.Pointer[string]
+	path  string
+}
+
+var (
+	files     []*Value
+	filesLock sync.Mutex
+)
+
+// Static returns a Value that never changes.
+func Static(value string) *Value {
+	v := &Value{}
+	v.set(value)
+	return v
+}
+
+// File returns a Value read from a file, such as a mounted Kubernetes secret.
+// Leading and trailing whitespace is removed. The file is read again by Watch.
+func File(path string) (*Value, error) {
+	v := &Value{path: path}
+	_, err := v.Reload()
+	if err != nil {
+		return nil, err
+	}
+
+	filesLock.Lock()
+	defer filesLock.Unlock()
+	files = append(files, v)
+
+	return v, nil
+}
+
+// Load returns a Value read from path if it is set, or the given value otherwise.
+func Load(value, path string) (*Value, error) {
+	if len(path) > 0 {
+		return File(path)
+	}
+	return Static(value), nil
+}
+
+// Reveal returns the credential itself. It must only be used when sending it to the party it is meant for.
+func (v *Value) Reveal() string {
+	if v == nil {
+		return ""
+	}
+	return *v.value.Load()
+}
+
+func (v *Value) String() string {
+	return Redacted
+}
+
+// Reload reads the file backing the Value, and reports whether its contents changed.
+// Values that are not read from a file never change.
+func (v *Value) Reload() (bool, error) {
+	if len(v.path) == 0 {
+		return false, nil
+	}
+	data, err := os.ReadFile(v.path)
+	if err != nil {
+		return false, fmt.Errorf("read secret: %w", err)
+	}
+	value := string(bytes.TrimSpace(data))
+	if current := v.value.Load(); current != nil && *current == value {
+		return false, nil
+	}
+	v.set(value)
+	return true, nil
+}
+
+func (v *Value) set(value string) {
+	Register(value)
+	v.value.Store(&value)
+}
+
+// Watch reloads all values read from files at the given interval, until the context is cancelled.
+// If a file cannot be read, the previous value is kept.
+func Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		filesLock.Lock()
+		watched := append([]*Value(nil), files...)
+		filesLock.Unlock()
+
+		for _, v := range watched {
+			changed, err := v.Reload()
+			if err != nil {
+				log.Errorf("Reload secret from %s: %s", v.path, err)
+			} else if changed {
+				log.Infof("Reloaded secret from %s", v.path)
+			}
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package secret_test
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/navikt/deployment-event-relays/pkg/secret"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValueIsNotFormatted(t *testing.T) {
+	value := secret.Static("static-password")
+	assert.Equal(t, "static-password", value.Reveal())
+	assert.Equal(t, secret.Redacted, fmt.Sprint(value))
+
+	var empty *secret.Value
+	assert.Equal(t, "", empty.Reveal())
+}
+
+func TestFileReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	assert.NoError(t, os.WriteFile(path, []byte("first-token\n"), 0600))
+
+	value, err := secret.File(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "first-token", value.Reveal())
+
+	changed, err := value.Reload()
+	assert.NoError(t, err)
+	assert.False(t, changed)
+
+	assert.NoError(t, os.WriteFile(path, []byte("second-token"), 0600))
+	changed, err = value.Reload()
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, "second-token", value.Reveal())
+
+	// Both the current and the previous value are kept out of logs.
+	assert.Equal(t, secret.Redacted+" "+secret.Redacted, secret.Redact("first-token second-token"))
+
+	assert.NoError(t, os.Remove(path))
+	_, err = value.Reload()
+	assert.Error(t, err)
+	assert.Equal(t, "second-token", value.Reveal())
+
+	_, err = secret.File(path)
+	assert.Error(t, err)
+}
+
+func TestRedact(t *testing.T) {
+	secret.Register("abc")
+	secret.Register("hunter2")
+	secret.Register("hunter2-extended")
+
+	assert.Equal(t, "abc", secret.Redact("abc"))
+	assert.Equal(t, "password="+secret.Redacted, secret.Redact("password=hunter2"))
+	assert.Equal(t, secret.Redacted+"!", secret.Redact("hunter2-extended!"))
+}
+
+func TestFormatter(t *testing.T) {
+	secret.Register("formatter-secret")
+
+	buf := &bytes.Buffer{}
+	logger := log.New()
+	logger.SetOutput(buf)
+	logger.SetFormatter(&log.JSONFormatter{})
+	secret.RedactLogs(logger)
+
+	logger.WithFields(log.Fields{
+		"payload": "token=formatter-secret",
+		"error":   fmt.Errorf("post https://formatter-secret@example.com"),
+		"count":   3,
+	}).Infof("sending formatter-secret")
+
+	output := buf.String()
+	assert.NotContains(t, output, "formatter-secret")
+	assert.Contains(t, output, `"count":3`)
+	assert.Contains(t, output, "sending "+secret.Redacted)
+}
@@ -0,0 +1,136 @@
+package slack
+
+import (
+	"fmt"
+
+	"github.com/navikt/deployment-event-relays/pkg/config"
+	"github.com/navikt/deployment-event-relays/pkg/httpclient"
+	"github.com/navikt/deployment-event-relays/pkg/relay"
+	"github.com/navikt/deployment-event-relays/pkg/secret"
+	"github.com/spf13/pflag"
+)
+
+const RelayType = "slack"
+
+// Settings configure a Slack relay. Webhook URLs contain credentials, and are treated as secrets.
+// Each URL can also be read from a file, such as a mounted Kubernetes secret, which is reloaded when it changes.
+type Settings struct {
+	URL                 string            `json:"url" secret:"true"`
+	URLFile             string            `json:"url-file"`
+	TeamURLs            map[string]string `json:"team-urls" secret:"true"`
+	TeamURLFiles        map[string]string `json:"team-url-files"`
+	EnvironmentURLs     map[string]string `json:"environment-urls" secret:"true"`
+	EnvironmentURLFiles map[string]string `json:"environment-url-files"`
+	RolloutStatuses     []string          `json:"rollout-statuses"`
+	config.Subsystem    `json:",squash"`
+}
+
+func init() {
+	relay.Register(relay.Factory{
+		Type:      RelayType,
+		Key:       RelayType,
+		Defaults:  func() config.Settings { return DefaultSettings() },
+		BindFlags: func(settings config.Settings, prefix string) { settings.(*Settings).bindFlags(prefix) },
+		New: func(name string, settings config.Settings) (relay.Relay, error) {
+			return New(name, *settings.(*Settings))
+		},
+	})
+}
+
+func DefaultSettings() *Settings {
+	return &Settings{
+		RolloutStatuses: []string{"complete"},
+		Subsystem:       config.DefaultSubsystem(),
+	}
+}
+
+func (s *Settings) bindFlags(prefix string) {
+	pflag.StringVar(&s.URL, prefix+".url", s.URL, "Default Slack incoming webhook URL")
+	pflag.StringVar(&s.URLFile, prefix+".url-file", s.URLFile, "Path to a file with the default Slack incoming webhook URL, used instead of --"+prefix+".url")
+	pflag.StringToStringVar(&s.TeamURLs, prefix+".team-urls", s.TeamURLs, "Slack webhook URLs per team, as team=url pairs")
+	pflag.StringToStringVar(&s.TeamURLFiles, prefix+".team-url-files", s.TeamURLFiles, "Paths to files with Slack webhook URLs per team, as team=path pairs")
+	pflag.StringToStringVar(&s.EnvironmentURLs, prefix+".environment-urls", s.EnvironmentURLs, "Slack webhook URLs per environment, as environment=url pairs")
+	pflag.StringToStringVar(&s.EnvironmentURLFiles, prefix+".environment-url-files", s.EnvironmentURLFiles, "Paths to files with Slack webhook URLs per environment, as environment=path pairs")
+	pflag.StringSliceVar(&s.RolloutStatuses, prefix+".rollout-statuses", s.RolloutStatuses, "Rollout statuses to notify about")
+	config.BindSubsystemFlags(&s.Subsystem, prefix)
+}
+
+func (s *Settings) Enabled() bool {
+	return len(s.URL) > 0 || len(s.URLFile) > 0 ||
+		len(s.TeamURLs) > 0 || len(s.TeamURLFiles) > 0 ||
+		len(s.EnvironmentURLs) > 0 || len(s.EnvironmentURLFiles) > 0
+}
+
+func (s *Settings) Validate(v *config.Validator, key string) {
+	v.Secret(key+".url", s.URL, s.URLFile)
+	if len(s.URL) > 0 {
+		v.URL(key+".url", s.URL)
+	}
+	for team, teamURL := range s.TeamURLs {
+		v.URL(key+".team-urls."+team, teamURL)
+	}
+	for team := range s.TeamURLFiles {
+		if _, ok := s.TeamURLs[team]; ok {
+			v.Errorf(key+".team-url-files."+team, "team is also given in team-urls")
+		}
+	}
+	for environment, environmentURL := range s.EnvironmentURLs {
+		v.URL(key+".environment-urls."+environment, environmentURL)
+	}
+	for environment := range s.EnvironmentURLFiles {
+		if _, ok := s.EnvironmentURLs[environment]; ok {
+			v.Errorf(key+".environment-url-files."+environment, "environment is also given in environment-urls")
+		}
+	}
+	if !s.Enabled() {
+		v.Errorf(key+".url", "at least one webhook URL is required")
+	}
+	if _, err := ParseRolloutStatuses(s.RolloutStatuses); err != nil {
+		v.Errorf(key+".rollout-statuses", "%s", err)
+	}
+}
+
+// New builds a Slack relay from its settings, reading webhook URLs from their files.
+func New(name string, s Settings) (relay.Relay, error) {
+	rolloutStatuses, err := ParseRolloutStatuses(s.RolloutStatuses)
+	if err != nil {
+		return relay.Relay{}, err
+	}
+	defaultURL, err := secret.Load(s.URL, s.URLFile)
+	if err != nil {
+		return relay.Relay{}, fmt.Errorf("load webhook URL: %w", err)
+	}
+	teamURLs, err := loadURLs(s.TeamURLs, s.TeamURLFiles)
+	if err != nil {
+		return relay.Relay{}, fmt.Errorf("load webhook URL for team %w", err)
+	}
+	environmentURLs, err := loadURLs(s.EnvironmentURLs, s.EnvironmentURLFiles)
+	if err != nil {
+		return relay.Relay{}, fmt.Errorf("load webhook URL for environment %w", err)
+	}
+	return relay.Relay{
+		Processor: &Relay{
+			URL:             defaultURL,
+			TeamURLs:        teamURLs,
+			EnvironmentURLs: environmentURLs,
+			RolloutStatuses: rolloutStatuses,
+			Client:          httpclient.New(name),
+		},
+	}, nil
+}
+
+// loadURLs combines webhook URLs given directly with those read from files, by team or environment name.
+func loadURLs(urls, files map[string]string) (map[string]*secret.Value, error) {
+	values := make(map[string]*secret.Value, len(urls)+len(files))
+	for name, value := range urls {
+		values[name] = secret.Static(value)
+	}
+	for name, path := range files {
+		value, err := secret.File(path)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		values[name] = value
+	}
+	return values, nil
+}
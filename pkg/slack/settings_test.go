@@ -0,0 +1,84 @@
+package slack_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/navikt/deployment-event-relays/pkg/config"
+	"github.com/navikt/deployment-event-relays/pkg/deployment"
+	"github.com/navikt/deployment-event-relays/pkg/slack"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSettingsValidate(t *testing.T) {
+	validate := func(settings *slack.Settings) error {
+		cfg := config.DefaultConfig()
+		cfg.Kafka.Brokers = []string{"localhost:9092"}
+		cfg.Kafka.Topic = "deployment-events"
+		cfg.Sections[slack.RelayType] = settings
+		return config.Validate(cfg)
+	}
+
+	settings := slack.DefaultSettings()
+	settings.URLFile = "/var/run/secrets/slack/url"
+	settings.TeamURLFiles = map[string]string{"aura": "/var/run/secrets/slack/aura"}
+	settings.EnvironmentURLFiles = map[string]string{"production": "/var/run/secrets/slack/production"}
+	assert.NoError(t, validate(settings))
+
+	settings.URL = "https://hooks.slack.com/services/T000/B000/default"
+	assert.EqualError(t, validate(settings), "slack.url: cannot be given together with url-file")
+
+	settings = slack.DefaultSettings()
+	settings.TeamURLs = map[string]string{"aura": "https://hooks.slack.com/services/T000/B000/aura"}
+	settings.TeamURLFiles = map[string]string{"aura": "/var/run/secrets/slack/aura"}
+	assert.EqualError(t, validate(settings), "slack.team-url-files.aura: team is also given in team-urls")
+
+	settings = slack.DefaultSettings()
+	settings.EnvironmentURLs = map[string]string{"production": "https://hooks.slack.com/services/T000/B000/production"}
+	settings.EnvironmentURLFiles = map[string]string{"production": "/var/run/secrets/slack/production"}
+	assert.EqualError(t, validate(settings), "slack.environment-url-files.production: environment is also given in environment-urls")
+}
+
+func TestNewReadsURLFiles(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, url string) string {
+		path := filepath.Join(dir, name)
+		assert.NoError(t, os.WriteFile(path, []byte(url+"\n"), 0o600))
+		return path
+	}
+
+	settings := slack.DefaultSettings()
+	settings.URLFile = write("default", "https://hooks.slack.com/services/default")
+	settings.TeamURLs = map[string]string{"nais": "https://hooks.slack.com/services/nais"}
+	settings.TeamURLFiles = map[string]string{"aura": write("aura", "https://hooks.slack.com/services/aura")}
+	settings.EnvironmentURLFiles = map[string]string{"development": write("development", "https://hooks.slack.com/services/development")}
+
+	r, err := slack.New("slack", *settings)
+	assert.NoError(t, err)
+	processor := r.Processor.(*slack.Relay)
+
+	route := func(event *deployment.Event) string {
+		event.RolloutStatus = deployment.RolloutStatus_complete
+		payload, err := processor.Build(event)
+		if !assert.NoError(t, err) {
+			return ""
+		}
+		return payload.URL
+	}
+	assert.Equal(t, "https://hooks.slack.com/services/aura", route(&deployment.Event{Team: "aura"}))
+	assert.Equal(t, "https://hooks.slack.com/services/nais", route(&deployment.Event{Team: "nais"}))
+	assert.Equal(t, "https://hooks.slack.com/services/development", route(&deployment.Event{Environment: deployment.Environment_development}))
+	assert.Equal(t, "https://hooks.slack.com/services/default", route(&deployment.Event{Environment: deployment.Environment_production}))
+
+	// a rotated webhook is used once the file has been reloaded
+	write("aura", "https://hooks.slack.com/services/rotated")
+	changed, err := processor.TeamURLs["aura"].Reload()
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, "https://hooks.slack.com/services/rotated", route(&deployment.Event{Team: "aura"}))
+
+	settings.URLFile = filepath.Join(dir, "missing")
+	_, err = slack.New("slack", *settings)
+	assert.Error(t, err)
+}
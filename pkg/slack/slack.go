@@ -0,0 +1,233 @@
+package slack
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/navikt/deployment-event-relays/pkg/deployment"
+	"github.com/navikt/deployment-event-relays/pkg/httpclient"
+	"github.com/navikt/deployment-event-relays/pkg/outcome"
+	"github.com/navikt/deployment-event-relays/pkg/relay"
+	"github.com/navikt/deployment-event-relays/pkg/secret"
+)
+
+var (
+	ErrRolloutStatus = errors.New("rollout status is not selected for notification")
+	ErrNoRoute       = errors.New("no webhook configured for this team or environment")
+)
+
+// Message represents the JSON payload supported by Slack incoming webhooks.
+//
+// https://api.slack.com/messaging/webhooks
+type Message struct {
+	Text   string  `json:"text"`
+	Blocks []Block `json:"blocks"`
+}
+
+// Block is a Block Kit layout block. Only section and context blocks are used.
+//
+// https://api.slack.com/reference/block-kit/blocks
+type Block struct {
+	Type     string `json:"type"`
+	Text     *Text  `json:"text,omitempty"`
+	Fields   []Text `json:"fields,omitempty"`
+	Elements []Text `json:"elements,omitempty"`
+}
+
+type Text struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+type Relay struct {
+	// URL is the default webhook, used when no team or environment route matches.
+	URL *secret.Value
+	// TeamURLs routes events to a webhook based on the team name.
+	TeamURLs map[string]*secret.Value
+	// EnvironmentURLs routes events to a webhook based on the environment name.
+	EnvironmentURLs map[string]*secret.Value
+	// RolloutStatuses selects which events to notify about. If empty, all events are notified.
+	RolloutStatuses []deployment.RolloutStatus
+	// Client performs the HTTP requests. Nil means http.DefaultClient.
+	Client *http.Client
+}
+
+func (r *Relay) Process(ctx context.Context, event *deployment.Event) error {
+	payload, err := r.Build(event)
+	if err != nil {
+		return err
+	}
+	return r.Deliver(ctx, payload)
+}
+
+// Build creates the message for an event, addressed to the webhook of its team or environment.
+// Events that are not selected for notification, or have no webhook, are skipped.
+func (r *Relay) Build(event *deployment.Event) (*relay.Payload, error) {
+	if !r.selected(event.GetRolloutStatus()) {
+		return nil, outcome.Skipped(ErrRolloutStatus)
+	}
+
+	webhookURL := r.route(event)
+	if len(webhookURL) == 0 {
+		return nil, outcome.Skipped(ErrNoRoute)
+	}
+
+	body, err := json.Marshal(BuildMessage(event))
+	if err != nil {
+		return nil, outcome.Permanent(fmt.Errorf("marshal Slack payload: %s", err))
+	}
+
+	return &relay.Payload{
+		Method:      "POST",
+		URL:         webhookURL,
+		ContentType: "application/json",
+		Body:        body,
+	}, nil
+}
+
+// Deliver posts a message to its Slack webhook.
+func (r *Relay) Deliver(ctx context.Context, payload *relay.Payload) error {
+	request, err := payload.Request(ctx)
+	if err != nil {
+		return outcome.Transient(fmt.Errorf("unable to create new HTTP request object: %s", httpclient.RedactError(err)))
+	}
+
+	response, err := httpclient.OrDefault(r.Client).Do(request)
+	if err != nil {
+		// The webhook URL is a secret, so it must not be part of the error message.
+		return outcome.Transient(fmt.Errorf("post to Slack: %w", httpclient.RedactError(err)))
+	}
+
+	defer response.Body.Close()
+
+	return outcome.HTTPStatus(response)
+}
+
+func (r *Relay) selected(status deployment.RolloutStatus) bool {
+	if len(r.RolloutStatuses) == 0 {
+		return true
+	}
+	for _, selected := range r.RolloutStatuses {
+		if status == selected {
+			return true
+		}
+	}
+	return false
+}
+
+// route returns the webhook URL for an event. Team routes take precedence over environment routes.
+func (r *Relay) route(event *deployment.Event) string {
+	if url, ok := r.TeamURLs[event.GetTeam()]; ok {
+		return url.Reveal()
+	}
+	if url, ok := r.EnvironmentURLs[event.GetEnvironment().String()]; ok {
+		return url.Reveal()
+	}
+	return r.URL.Reveal()
+}
+
+// BuildMessage creates a Block Kit message describing a deployment event.
+func BuildMessage(event *deployment.Event) Message {
+	summary := fmt.Sprintf("%s %s: %s %s in %s/%s",
+		statusEmoji(event.GetRolloutStatus()),
+		event.GetRolloutStatus().String(),
+		valueOrUnknown(event.GetApplication()),
+		valueOrUnknown(event.GetVersion()),
+		valueOrUnknown(event.GetCluster()),
+		valueOrUnknown(event.GetNamespace()),
+	)
+
+	return Message{
+		Text: summary,
+		Blocks: []Block{
+			{
+				Type: "section",
+				Text: &Text{Type: "mrkdwn", Text: fmt.Sprintf("*Deployment of %s %s*", valueOrUnknown(event.GetApplication()), statusEmoji(event.GetRolloutStatus()))},
+			},
+			{
+				Type: "section",
+				Fields: []Text{
+					field("Application", event.GetApplication()),
+					field("Team", event.GetTeam()),
+					field("Cluster", event.GetCluster()),
+					field("Namespace", event.GetNamespace()),
+					field("Version", event.GetVersion()),
+					field("Image", image(event.GetImage())),
+					field("Deployer", deployer(event.GetDeployer())),
+					field("Rollout status", event.GetRolloutStatus().String()),
+				},
+			},
+			{
+				Type: "context",
+				Elements: []Text{
+					{Type: "mrkdwn", Text: fmt.Sprintf("Correlation ID: %s", valueOrUnknown(event.GetCorrelationID()))},
+				},
+			},
+		},
+	}
+}
+
+func field(title, value string) Text {
+	return Text{
+		Type: "mrkdwn",
+		Text: fmt.Sprintf("*%s*\n%s", title, valueOrUnknown(value)),
+	}
+}
+
+func statusEmoji(status deployment.RolloutStatus) string {
+	switch status {
+	case deployment.RolloutStatus_complete:
+		return ":white_check_mark:"
+	case deployment.RolloutStatus_initialized:
+		return ":hourglass_flowing_sand:"
+	default:
+		return ":grey_question:"
+	}
+}
+
+func image(image *deployment.ContainerImage) string {
+	name := image.GetName()
+	if len(name) == 0 {
+		return ""
+	}
+	if len(image.GetTag()) > 0 {
+		return name + ":" + image.GetTag()
+	}
+	if len(image.GetHash()) > 0 {
+		return name + "@" + image.GetHash()
+	}
+	return name
+}
+
+func deployer(actor *deployment.Actor) string {
+	for _, value := range []string{actor.GetName(), actor.GetIdent(), actor.GetEmail()} {
+		if len(value) > 0 {
+			return value
+		}
+	}
+	return ""
+}
+
+func valueOrUnknown(value string) string {
+	if len(value) == 0 {
+		return "unknown"
+	}
+	return value
+}
+
+// ParseRolloutStatuses converts rollout status names to their enumeration values.
+func ParseRolloutStatuses(names []string) ([]deployment.RolloutStatus, error) {
+	statuses := make([]deployment.RolloutStatus, 0, len(names))
+	for _, name := range names {
+		value, ok := deployment.RolloutStatus_value[strings.ToLower(name)]
+		if !ok {
+			return nil, fmt.Errorf("rollout status '%s' is not recognized", name)
+		}
+		statuses = append(statuses, deployment.RolloutStatus(value))
+	}
+	return statuses, nil
+}
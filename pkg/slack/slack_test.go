@@ -0,0 +1,169 @@
+package slack_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/navikt/deployment-event-relays/pkg/deployment"
+	"github.com/navikt/deployment-event-relays/pkg/outcome"
+	"github.com/navikt/deployment-event-relays/pkg/secret"
+	"github.com/navikt/deployment-event-relays/pkg/slack"
+	"github.com/stretchr/testify/assert"
+)
+
+var event = &deployment.Event{
+	Application:   "app",
+	Team:          "aura",
+	Cluster:       "prod-gcp",
+	Namespace:     "aura",
+	Version:       "1.2.3",
+	Environment:   deployment.Environment_production,
+	RolloutStatus: deployment.RolloutStatus_complete,
+	Image: &deployment.ContainerImage{
+		Name: "ghcr.io/nais/app",
+		Tag:  "1.2.3",
+	},
+	Deployer: &deployment.Actor{
+		Ident: "A123456",
+	},
+	CorrelationID: "abc",
+}
+
+func TestBuildMessage(t *testing.T) {
+	message := slack.BuildMessage(event)
+
+	assert.Equal(t, ":white_check_mark: complete: app 1.2.3 in prod-gcp/aura", message.Text)
+	assert.Len(t, message.Blocks, 3)
+	assert.Equal(t, []slack.Text{
+		{Type: "mrkdwn", Text: "*Application*\napp"},
+		{Type: "mrkdwn", Text: "*Team*\naura"},
+		{Type: "mrkdwn", Text: "*Cluster*\nprod-gcp"},
+		{Type: "mrkdwn", Text: "*Namespace*\naura"},
+		{Type: "mrkdwn", Text: "*Version*\n1.2.3"},
+		{Type: "mrkdwn", Text: "*Image*\nghcr.io/nais/app:1.2.3"},
+		{Type: "mrkdwn", Text: "*Deployer*\nA123456"},
+		{Type: "mrkdwn", Text: "*Rollout status*\ncomplete"},
+	}, message.Blocks[1].Fields)
+	assert.Equal(t, "Correlation ID: abc", message.Blocks[2].Elements[0].Text)
+}
+
+func TestRelayRouting(t *testing.T) {
+	received := make(map[string]int)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		message := slack.Message{}
+		err := json.NewDecoder(r.Body).Decode(&message)
+		assert.NoError(t, err)
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		received[r.URL.Path]++
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	relay := &slack.Relay{
+		URL: secret.Static(server.URL + "/default"),
+		TeamURLs: map[string]*secret.Value{
+			"aura": secret.Static(server.URL + "/team"),
+		},
+		EnvironmentURLs: map[string]*secret.Value{
+			"development": secret.Static(server.URL + "/dev"),
+		},
+		RolloutStatuses: []deployment.RolloutStatus{deployment.RolloutStatus_complete},
+	}
+
+	assert.NoError(t, relay.Process(context.Background(), event))
+	assert.NoError(t, relay.Process(context.Background(), &deployment.Event{
+		Team:          "other",
+		Environment:   deployment.Environment_development,
+		RolloutStatus: deployment.RolloutStatus_complete,
+	}))
+	assert.NoError(t, relay.Process(context.Background(), &deployment.Event{
+		Team:          "other",
+		RolloutStatus: deployment.RolloutStatus_complete,
+	}))
+
+	err := relay.Process(context.Background(), &deployment.Event{
+		Team:          "aura",
+		RolloutStatus: deployment.RolloutStatus_initialized,
+	})
+	assert.Equal(t, outcome.ClassSkipped, outcome.Classify(err))
+
+	assert.Equal(t, map[string]int{"/team": 1, "/dev": 1, "/default": 1}, received)
+
+	relay.URL = nil
+	err = relay.Process(context.Background(), &deployment.Event{
+		Team:          "other",
+		RolloutStatus: deployment.RolloutStatus_complete,
+	})
+	assert.ErrorIs(t, err, slack.ErrNoRoute)
+}
+
+func TestRelayClassification(t *testing.T) {
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	relay := &slack.Relay{URL: secret.Static(server.URL)}
+
+	for code, class := range map[int]outcome.Class{
+		http.StatusOK:                  outcome.ClassOK,
+		http.StatusBadRequest:          outcome.ClassPermanent,
+		http.StatusUnauthorized:        outcome.ClassTransient,
+		http.StatusForbidden:           outcome.ClassTransient,
+		http.StatusNotFound:            outcome.ClassTransient,
+		http.StatusTooManyRequests:     outcome.ClassRateLimited,
+		http.StatusInternalServerError: outcome.ClassTransient,
+	} {
+		status = code
+		err := relay.Process(context.Background(), event)
+		assert.Equal(t, class, outcome.Classify(err), "HTTP %d", code)
+	}
+}
+
+func TestRelayErrorsDoNotLeakURL(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	relay := &slack.Relay{URL: secret.Static(server.URL + "/services/secret")}
+	err := relay.Process(context.Background(), event)
+	assert.Equal(t, outcome.ClassTransient, outcome.Classify(err))
+	assert.NotContains(t, err.Error(), "secret")
+
+	server.Close()
+	err = relay.Process(context.Background(), event)
+	assert.Equal(t, outcome.ClassTransient, outcome.Classify(err))
+	assert.NotContains(t, err.Error(), "secret")
+}
+
+func TestParseRolloutStatuses(t *testing.T) {
+	statuses, err := slack.ParseRolloutStatuses([]string{"complete", "Initialized"})
+	assert.NoError(t, err)
+	assert.Equal(t, []deployment.RolloutStatus{deployment.RolloutStatus_complete, deployment.RolloutStatus_initialized}, statuses)
+
+	_, err = slack.ParseRolloutStatuses([]string{"done"})
+	assert.Error(t, err)
+}
+
+func TestBuild(t *testing.T) {
+	relay := &slack.Relay{
+		TeamURLs: map[string]*secret.Value{"aura": secret.Static("https://hooks.slack.com/services/T000/B000/secret")},
+	}
+
+	payload, err := relay.Build(event)
+	assert.NoError(t, err)
+	assert.Equal(t, "https://hooks.slack.com/services/T000/B000/secret", payload.URL)
+	assert.Equal(t, "POST hooks.slack.com", payload.Destination())
+
+	message := slack.Message{}
+	assert.NoError(t, json.Unmarshal(payload.Body, &message))
+	assert.Equal(t, slack.BuildMessage(event), message)
+
+	_, err = relay.Build(&deployment.Event{Team: "other"})
+	assert.ErrorIs(t, err, slack.ErrNoRoute)
+}
@@ -1,12 +1,15 @@
 package vera
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
 
 	"github.com/navikt/deployment-event-relays/pkg/deployment"
+	"github.com/navikt/deployment-event-relays/pkg/httpclient"
+	"github.com/navikt/deployment-event-relays/pkg/outcome"
+	"github.com/navikt/deployment-event-relays/pkg/relay"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -21,42 +24,51 @@ type Payload struct {
 
 type Relay struct {
 	URL string
+	// Client performs the HTTP requests. Nil means http.DefaultClient.
+	Client *http.Client
 }
 
-func (r *Relay) Process(event *deployment.Event) (retry bool, err error) {
-	if event.GetRolloutStatus() != deployment.RolloutStatus_complete {
-		return false, fmt.Errorf("discarding message because rollout status is != complete")
+// Process posts the deployment to Vera.
+// Only completed rollouts should be sent to Vera; see the default filters of the subsystem.
+func (r *Relay) Process(ctx context.Context, event *deployment.Event) error {
+	payload, err := r.Build(event)
+	if err != nil {
+		return err
 	}
+	return r.Deliver(ctx, payload)
+}
 
-	veraEvent := BuildVeraEvent(event)
-	payload, err := veraEvent.Marshal()
-	log.Infof("Posting payload to Vera: %s", payload)
+// Build creates the request that registers the deployment in Vera.
+func (r *Relay) Build(event *deployment.Event) (*relay.Payload, error) {
+	body, err := BuildVeraEvent(event).Marshal()
 	if err != nil {
-		return false, fmt.Errorf("marshal Vera payload: %s", err)
+		return nil, outcome.Permanent(fmt.Errorf("marshal Vera payload: %s", err))
 	}
+	return &relay.Payload{
+		Method:      "POST",
+		URL:         r.URL,
+		ContentType: "application/json",
+		Body:        body,
+	}, nil
+}
 
-	body := bytes.NewReader(payload)
-	request, err := http.NewRequest("POST", r.URL, body)
+// Deliver posts a payload to Vera.
+func (r *Relay) Deliver(ctx context.Context, payload *relay.Payload) error {
+	log.Infof("Posting payload to Vera: %s", payload.Body)
+
+	request, err := payload.Request(ctx)
 	if err != nil {
-		return true, fmt.Errorf("unable to create new HTTP request object: %s", err)
+		return outcome.Transient(fmt.Errorf("unable to create new HTTP request object: %s", err))
 	}
-	request.Header.Set("Content-Type", "application/json")
 
-	// Create a callback function wrapping recoverable network errors.
-	// This callback will be run as many times as necessary in order to
-	// ensure the data is fully written to Vera.
-	response, err := http.DefaultClient.Do(request)
+	response, err := httpclient.OrDefault(r.Client).Do(request)
 	if err != nil {
-		return true, fmt.Errorf("post to Vera: %s", err)
+		return outcome.Transient(fmt.Errorf("post to Vera: %w", httpclient.RedactError(err)))
 	}
 
 	defer response.Body.Close()
 
-	if response.StatusCode > 299 {
-		return true, fmt.Errorf("POST %s: %s", r.URL, response.Status)
-	}
-
-	return false, nil
+	return outcome.HTTPStatus(response)
 }
 
 // BuildVeraEvent collects data from a deployment event and creates a valid payload for POSTing to the vera api.
@@ -1,9 +1,14 @@
 package vera_test
 
 import (
+	"context"
+	"net/http"
+	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/navikt/deployment-event-relays/pkg/deployment"
+	"github.com/navikt/deployment-event-relays/pkg/outcome"
 	"github.com/navikt/deployment-event-relays/pkg/vera"
 	"github.com/stretchr/testify/assert"
 )
@@ -123,8 +128,65 @@ var eventVeraTests = []eventVeraTest{
 }
 
 func TestVeraPayload(t *testing.T) {
-	for _, test := range eventVeraTests {
+	for i := range eventVeraTests {
+		test := &eventVeraTests[i]
 		veraPayload := vera.BuildVeraEvent(&test.event)
 		assert.Equal(t, test.data, veraPayload)
 	}
 }
+
+func TestRelayHonorsContextDeadline(t *testing.T) {
+	unblock := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-unblock
+	}))
+	defer server.Close()
+	defer close(unblock)
+
+	relay := &vera.Relay{URL: server.URL}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+
+	err := relay.Process(ctx, &deployment.Event{RolloutStatus: deployment.RolloutStatus_complete})
+	assert.Equal(t, outcome.ClassTransient, outcome.Classify(err))
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestRelayClassification(t *testing.T) {
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	relay := &vera.Relay{URL: server.URL}
+	event := &eventVeraTests[0].event
+
+	for code, class := range map[int]outcome.Class{
+		http.StatusOK:                  outcome.ClassOK,
+		http.StatusBadRequest:          outcome.ClassPermanent,
+		http.StatusUnauthorized:        outcome.ClassTransient,
+		http.StatusForbidden:           outcome.ClassTransient,
+		http.StatusNotFound:            outcome.ClassTransient,
+		http.StatusInternalServerError: outcome.ClassTransient,
+	} {
+		status = code
+		err := relay.Process(context.Background(), event)
+		assert.Equal(t, class, outcome.Classify(err), "HTTP %d", code)
+	}
+}
+
+func TestBuild(t *testing.T) {
+	relay := &vera.Relay{URL: "https://vera.example.com/api/v1/deploylog"}
+	event := &eventVeraTests[0].event
+
+	payload, err := relay.Build(event)
+	assert.NoError(t, err)
+	assert.Equal(t, "POST", payload.Method)
+	assert.Equal(t, "https://vera.example.com/api/v1/deploylog", payload.URL)
+	assert.Equal(t, "application/json", payload.ContentType)
+
+	expected, err := vera.BuildVeraEvent(event).Marshal()
+	assert.NoError(t, err)
+	assert.JSONEq(t, string(expected), string(payload.Body))
+}
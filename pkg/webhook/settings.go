@@ -0,0 +1,105 @@
+package webhook
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/navikt/deployment-event-relays/pkg/config"
+	"github.com/navikt/deployment-event-relays/pkg/httpclient"
+	"github.com/navikt/deployment-event-relays/pkg/relay"
+	"github.com/navikt/deployment-event-relays/pkg/secret"
+)
+
+const RelayType = "webhook"
+
+// Settings configure a webhook relay. Header values are treated as secrets.
+type Settings struct {
+	URL              string            `json:"url"`
+	Method           string            `json:"method"`
+	Headers          map[string]string `json:"headers" secret:"true"`
+	HeaderFiles      map[string]string `json:"header-files"`
+	Template         string            `json:"template"`
+	Format           string            `json:"format"`
+	StatusOutcomes   map[string]string `json:"status-outcomes"`
+	config.Subsystem `json:",squash"`
+}
+
+// Webhooks can be configured as any number of named instances in the top-level "webhooks" section,
+// which has no command-line flags.
+func init() {
+	relay.Register(relay.Factory{
+		Type:     RelayType,
+		Key:      "webhooks",
+		Named:    true,
+		Defaults: func() config.Settings { return DefaultSettings() },
+		New: func(name string, settings config.Settings) (relay.Relay, error) {
+			return NewRelay(name, *settings.(*Settings))
+		},
+	})
+}
+
+func DefaultSettings() *Settings {
+	return &Settings{
+		Subsystem: config.DefaultSubsystem(),
+	}
+}
+
+func (s *Settings) Enabled() bool {
+	return true
+}
+
+func (s *Settings) Validate(v *config.Validator, key string) {
+	v.URL(key+".url", s.URL)
+	if _, err := ParseTemplate(s.Template); err != nil {
+		v.Errorf(key+".template", "%s", err)
+	}
+	switch s.Format {
+	case "", FormatJSON, FormatText:
+	default:
+		v.Errorf(key+".format", "format must be either 'json' or 'text'")
+	}
+	statuses := make([]string, 0, len(s.StatusOutcomes))
+	for status := range s.StatusOutcomes {
+		statuses = append(statuses, status)
+	}
+	sort.Strings(statuses)
+	for _, status := range statuses {
+		if _, _, err := ParseStatusOutcome(status, s.StatusOutcomes[status]); err != nil {
+			v.Errorf(key+".status-outcomes."+status, "%s", err)
+		}
+	}
+	for header := range s.HeaderFiles {
+		for other := range s.Headers {
+			if strings.EqualFold(header, other) {
+				v.Errorf(key+".header-files."+header, "header is also given in headers")
+			}
+		}
+	}
+}
+
+// NewRelay builds a webhook relay from its settings, reading secret headers from their files.
+func NewRelay(name string, s Settings) (relay.Relay, error) {
+	secretHeaders := make(map[string]*secret.Value)
+	for header, path := range s.HeaderFiles {
+		value, err := secret.File(path)
+		if err != nil {
+			return relay.Relay{}, fmt.Errorf("load header %s: %w", header, err)
+		}
+		secretHeaders[header] = value
+	}
+	r, err := New(Config{
+		URL:            s.URL,
+		Method:         s.Method,
+		Headers:        s.Headers,
+		SecretHeaders:  secretHeaders,
+		Template:       s.Template,
+		Format:         s.Format,
+		StatusOutcomes: s.StatusOutcomes,
+		Client:         httpclient.New(name),
+	})
+	if err != nil {
+		return relay.Relay{}, err
+	}
+	return relay.Relay{Processor: r}, nil
+}
@@ -0,0 +1,253 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/navikt/deployment-event-relays/pkg/deployment"
+	"github.com/navikt/deployment-event-relays/pkg/httpclient"
+	"github.com/navikt/deployment-event-relays/pkg/outcome"
+	"github.com/navikt/deployment-event-relays/pkg/relay"
+	"github.com/navikt/deployment-event-relays/pkg/secret"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// Data is passed to the payload template.
+type Data struct {
+	Event     *deployment.Event
+	Fields    map[string]string
+	Timestamp time.Time
+}
+
+type Config struct {
+	URL     string
+	Method  string
+	Headers map[string]string
+	// SecretHeaders are set on each request after Headers, with their current values.
+	SecretHeaders map[string]*secret.Value
+	// Template is a Go text/template rendered with Data.
+	Template string
+	// Format is either "text" or "json". JSON payloads are validated before they are sent.
+	Format string
+	// StatusOutcomes maps HTTP status codes to outcome classes.
+	// Keys are either exact status codes such as "404", or classes of status codes such as "4xx".
+	StatusOutcomes map[string]string
+	// Client performs the HTTP requests. Nil means http.DefaultClient.
+	Client *http.Client
+}
+
+// Relay posts a templated payload to an arbitrary HTTP endpoint.
+type Relay struct {
+	url            string
+	method         string
+	headers        http.Header
+	secretHeaders  map[string]*secret.Value
+	template       *template.Template
+	format         string
+	statusOutcomes map[string]outcome.Class
+	client         *http.Client
+}
+
+var funcs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+}
+
+// ParseTemplate parses a payload template. The template is required, as the payload would otherwise be empty.
+func ParseTemplate(text string) (*template.Template, error) {
+	if len(strings.TrimSpace(text)) == 0 {
+		return nil, fmt.Errorf("template is required")
+	}
+	return template.New("payload").Funcs(funcs).Option("missingkey=zero").Parse(text)
+}
+
+// ParseStatusOutcome parses a status code, such as 404, or a class of status codes, such as 4xx,
+// together with the outcome of responses with that status. The status is returned in lower case.
+func ParseStatusOutcome(status, value string) (string, outcome.Class, error) {
+	status = strings.ToLower(status)
+	if !validStatusKey(status) {
+		return "", "", fmt.Errorf("status code '%s' is not recognized", status)
+	}
+	class := outcome.Class(value)
+	switch class {
+	case outcome.ClassOK, outcome.ClassSkipped, outcome.ClassPermanent, outcome.ClassTransient, outcome.ClassRateLimited:
+	default:
+		return "", "", fmt.Errorf("outcome '%s' for status code '%s' is not recognized", value, status)
+	}
+	return status, class, nil
+}
+
+func New(cfg Config) (*Relay, error) {
+	if len(cfg.URL) == 0 {
+		return nil, fmt.Errorf("url is required")
+	}
+
+	method := strings.ToUpper(cfg.Method)
+	if len(method) == 0 {
+		method = http.MethodPost
+	}
+
+	format := cfg.Format
+	if len(format) == 0 {
+		format = FormatJSON
+	}
+	if format != FormatText && format != FormatJSON {
+		return nil, fmt.Errorf("format '%s' is not recognized", cfg.Format)
+	}
+
+	tpl, err := ParseTemplate(cfg.Template)
+	if err != nil {
+		return nil, fmt.Errorf("parse template: %w", err)
+	}
+
+	headers := make(http.Header)
+	if format == FormatJSON {
+		headers.Set("Content-Type", "application/json")
+	} else {
+		headers.Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	for key, value := range cfg.Headers {
+		headers.Set(key, value)
+	}
+
+	statusOutcomes := make(map[string]outcome.Class)
+	for key, value := range cfg.StatusOutcomes {
+		status, class, err := ParseStatusOutcome(key, value)
+		if err != nil {
+			return nil, err
+		}
+		statusOutcomes[status] = class
+	}
+
+	return &Relay{
+		url:            cfg.URL,
+		method:         method,
+		headers:        headers,
+		secretHeaders:  cfg.SecretHeaders,
+		template:       tpl,
+		format:         format,
+		statusOutcomes: statusOutcomes,
+		client:         httpclient.OrDefault(cfg.Client),
+	}, nil
+}
+
+func (r *Relay) Process(ctx context.Context, event *deployment.Event) error {
+	payload, err := r.Build(event)
+	if err != nil {
+		return err
+	}
+	return r.Deliver(ctx, payload)
+}
+
+// Build renders the request for an event.
+func (r *Relay) Build(event *deployment.Event) (*relay.Payload, error) {
+	body, err := r.Render(event)
+	if err != nil {
+		return nil, outcome.Permanent(err)
+	}
+	return &relay.Payload{
+		Method:      r.method,
+		URL:         r.url,
+		ContentType: r.headers.Get("Content-Type"),
+		Body:        body,
+	}, nil
+}
+
+// Deliver sends a rendered request to the webhook, with the configured headers.
+func (r *Relay) Deliver(ctx context.Context, payload *relay.Payload) error {
+	request, err := payload.Request(ctx)
+	if err != nil {
+		return outcome.Transient(fmt.Errorf("unable to create new HTTP request object: %s", err))
+	}
+	for key, values := range r.headers {
+		request.Header[key] = values
+	}
+	for key, value := range r.secretHeaders {
+		request.Header.Set(key, value.Reveal())
+	}
+
+	response, err := r.client.Do(request)
+	if err != nil {
+		return outcome.Transient(fmt.Errorf("%s webhook: %w", r.method, httpclient.RedactError(err)))
+	}
+
+	defer response.Body.Close()
+
+	return r.classify(response)
+}
+
+// Render executes the payload template for an event.
+func (r *Relay) Render(event *deployment.Event) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	err := r.template.Execute(buf, Data{
+		Event:     event,
+		Fields:    event.Flatten(),
+		Timestamp: event.GetTimestampAsTime(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("render webhook payload: %w", err)
+	}
+
+	payload := buf.Bytes()
+	if r.format == FormatJSON && !json.Valid(payload) {
+		log.Debugf("Invalid webhook payload: %s", payload)
+		return nil, fmt.Errorf("render webhook payload: template produced invalid JSON")
+	}
+
+	return payload, nil
+}
+
+// classify maps the response status code to an outcome, using the configured mapping if present.
+// Exact status codes take precedence over status code classes.
+func (r *Relay) classify(response *http.Response) error {
+	code := strconv.Itoa(response.StatusCode)
+	class, ok := r.statusOutcomes[code]
+	if !ok {
+		class, ok = r.statusOutcomes[code[:1]+"xx"]
+	}
+	if !ok {
+		return outcome.HTTPStatus(response)
+	}
+
+	err := fmt.Errorf("%s webhook: %s", r.method, response.Status)
+	switch class {
+	case outcome.ClassOK:
+		return nil
+	case outcome.ClassSkipped:
+		return outcome.Skipped(err)
+	case outcome.ClassPermanent:
+		return outcome.Permanent(err)
+	case outcome.ClassRateLimited:
+		return outcome.RateLimited(err, outcome.RetryAfterHeader(response))
+	default:
+		return outcome.Transient(err)
+	}
+}
+
+func validStatusKey(key string) bool {
+	if len(key) != 3 {
+		return false
+	}
+	if key[0] < '1' || key[0] > '5' {
+		return false
+	}
+	if key[1:] == "xx" {
+		return true
+	}
+	_, err := strconv.Atoi(key)
+	return err == nil
+}
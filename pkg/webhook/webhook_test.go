@@ -0,0 +1,220 @@
+package webhook_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/navikt/deployment-event-relays/pkg/config"
+	"github.com/navikt/deployment-event-relays/pkg/deployment"
+	"github.com/navikt/deployment-event-relays/pkg/outcome"
+	"github.com/navikt/deployment-event-relays/pkg/secret"
+	"github.com/navikt/deployment-event-relays/pkg/webhook"
+	"github.com/stretchr/testify/assert"
+)
+
+var event = &deployment.Event{
+	Application:   "app",
+	Namespace:     "ns",
+	Cluster:       "prod-gcp",
+	RolloutStatus: deployment.RolloutStatus_complete,
+	Version:       `1.2.3 "quoted"`,
+	Timestamp: &timestamp.Timestamp{
+		Seconds: 1600000000,
+	},
+}
+
+func TestRender(t *testing.T) {
+	relay, err := webhook.New(webhook.Config{
+		URL:      "http://localhost",
+		Template: `{"app":{{ json .Fields.application }},"version":{{ json .Event.Version }},"status":"{{ .Event.RolloutStatus }}","time":{{ .Timestamp.Unix }},"team":{{ json .Fields.team }}}`,
+	})
+	assert.NoError(t, err)
+
+	payload, err := relay.Render(event)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"app":"app","version":"1.2.3 \"quoted\"","status":"complete","time":1600000000,"team":""}`, string(payload))
+}
+
+func TestRenderInvalidJSON(t *testing.T) {
+	relay, err := webhook.New(webhook.Config{
+		URL:      "http://localhost",
+		Template: `{"version":"{{ .Event.Version }}"}`,
+	})
+	assert.NoError(t, err)
+
+	_, err = relay.Render(event)
+	assert.Error(t, err)
+
+	relay, err = webhook.New(webhook.Config{
+		URL:      "http://localhost",
+		Template: `{{ .Event.Application }} was deployed`,
+		Format:   webhook.FormatText,
+	})
+	assert.NoError(t, err)
+
+	payload, err := relay.Render(event)
+	assert.NoError(t, err)
+	assert.Equal(t, "app was deployed", string(payload))
+}
+
+func TestNewInvalidConfig(t *testing.T) {
+	for _, cfg := range []webhook.Config{
+		{Template: `{}`},
+		{URL: "http://localhost"},
+		{URL: "http://localhost", Template: `{{ .Event`},
+		{URL: "http://localhost", Template: `{}`, Format: "xml"},
+		{URL: "http://localhost", Template: `{}`, StatusOutcomes: map[string]string{"4x": "skipped"}},
+		{URL: "http://localhost", Template: `{}`, StatusOutcomes: map[string]string{"404": "ignore"}},
+	} {
+		_, err := webhook.New(cfg)
+		assert.Error(t, err)
+	}
+}
+
+func TestSettingsValidate(t *testing.T) {
+	validate := func(template string, statusOutcomes map[string]string) error {
+		settings := webhook.DefaultSettings()
+		settings.URL = "https://example.com/hook"
+		settings.Template = template
+		settings.StatusOutcomes = statusOutcomes
+
+		cfg := config.DefaultConfig()
+		cfg.Kafka.Brokers = []string{"localhost:9092"}
+		cfg.Kafka.Topic = "deployment-events"
+		cfg.Sections["webhooks"] = map[string]config.Settings{"dashboard": settings}
+		return config.Validate(cfg)
+	}
+
+	assert.NoError(t, validate(`{"app":{{ json .Fields.application }}}`, map[string]string{"404": "skipped", "5XX": "transient"}))
+	assert.EqualError(t, validate("", nil), "webhooks.dashboard.template: template is required")
+	err := validate(`{"app":{{ .Event`, nil)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "webhooks.dashboard.template: template: payload:1: unclosed action")
+	}
+	assert.EqualError(t, validate(`{}`, map[string]string{"404": "ignore", "4x": "skipped"}),
+		"webhooks.dashboard.status-outcomes.404: outcome 'ignore' for status code '404' is not recognized\n"+
+			"webhooks.dashboard.status-outcomes.4x: status code '4x' is not recognized")
+}
+
+func TestProcessErrorsDoNotLeakURL(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	for _, statusOutcomes := range []map[string]string{nil, {"5xx": "transient"}} {
+		relay, err := webhook.New(webhook.Config{
+			URL:            server.URL + "/hook?token=secret",
+			Template:       `{}`,
+			StatusOutcomes: statusOutcomes,
+		})
+		assert.NoError(t, err)
+
+		err = relay.Process(context.Background(), event)
+		assert.Equal(t, outcome.ClassTransient, outcome.Classify(err))
+		assert.NotContains(t, err.Error(), "secret")
+	}
+
+	relay, err := webhook.New(webhook.Config{URL: "http://localhost:0/hook?token=secret", Template: `{}`})
+	assert.NoError(t, err)
+	err = relay.Process(context.Background(), event)
+	assert.Equal(t, outcome.ClassTransient, outcome.Classify(err))
+	assert.NotContains(t, err.Error(), "secret")
+}
+
+func TestProcess(t *testing.T) {
+	var status int
+	var request *http.Request
+	var body []byte
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		request = r
+		body, _ = io.ReadAll(r.Body)
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	relay, err := webhook.New(webhook.Config{
+		URL:    server.URL,
+		Method: "put",
+		Headers: map[string]string{
+			"authorization": "Bearer secret",
+		},
+		SecretHeaders: map[string]*secret.Value{
+			"x-api-key": secret.Static("api-key"),
+		},
+		Template: `{"app":{{ json .Fields.application }}}`,
+		StatusOutcomes: map[string]string{
+			"409": "ok",
+			"4xx": "skipped",
+		},
+	})
+	assert.NoError(t, err)
+
+	for code, class := range map[int]outcome.Class{
+		http.StatusOK:                  outcome.ClassOK,
+		http.StatusConflict:            outcome.ClassOK,
+		http.StatusNotFound:            outcome.ClassSkipped,
+		http.StatusServiceUnavailable:  outcome.ClassTransient,
+		http.StatusNotImplemented:      outcome.ClassTransient,
+		http.StatusUnprocessableEntity: outcome.ClassSkipped,
+	} {
+		status = code
+		err = relay.Process(context.Background(), event)
+		assert.Equal(t, class, outcome.Classify(err), "HTTP %d", code)
+	}
+
+	assert.Equal(t, http.MethodPut, request.Method)
+	assert.Equal(t, "Bearer secret", request.Header.Get("Authorization"))
+	assert.Equal(t, "api-key", request.Header.Get("X-Api-Key"))
+	assert.Equal(t, "application/json", request.Header.Get("Content-Type"))
+	assert.Equal(t, `{"app":"app"}`, string(body))
+}
+
+func TestProcessDefaultClassification(t *testing.T) {
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	relay, err := webhook.New(webhook.Config{
+		URL:      server.URL,
+		Template: `{"app":{{ json .Fields.application }}}`,
+	})
+	assert.NoError(t, err)
+
+	for code, class := range map[int]outcome.Class{
+		http.StatusOK:                  outcome.ClassOK,
+		http.StatusBadRequest:          outcome.ClassPermanent,
+		http.StatusUnauthorized:        outcome.ClassTransient,
+		http.StatusForbidden:           outcome.ClassTransient,
+		http.StatusNotFound:            outcome.ClassTransient,
+		http.StatusInternalServerError: outcome.ClassTransient,
+	} {
+		status = code
+		err = relay.Process(context.Background(), event)
+		assert.Equal(t, class, outcome.Classify(err), "HTTP %d", code)
+	}
+}
+
+func TestBuild(t *testing.T) {
+	relay, err := webhook.New(webhook.Config{
+		URL:      "http://localhost/hook",
+		Method:   "put",
+		Format:   webhook.FormatText,
+		Template: `{{ .Fields.application }} {{ .Event.Version }}`,
+	})
+	assert.NoError(t, err)
+
+	payload, err := relay.Build(event)
+	assert.NoError(t, err)
+	assert.Equal(t, "PUT", payload.Method)
+	assert.Equal(t, "http://localhost/hook", payload.URL)
+	assert.Equal(t, "text/plain; charset=utf-8", payload.ContentType)
+	assert.Equal(t, `app 1.2.3 "quoted"`, string(payload.Body))
+}